@@ -6,14 +6,24 @@
 package commonspec
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/alt-research/operator-kit/must"
 	"github.com/alt-research/operator-kit/s3util"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/dustin/go-humanize"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type S3ObjectRef struct {
@@ -33,6 +43,15 @@ type S3ObjectRef struct {
 	Filename string `json:"filename,omitempty"`
 	// The URL where the object was uploaded to.
 	Location string `json:"location,omitempty"`
+	// AddressingStyle of the bucket in the object URL, by default the virtual host style on AWS
+	// and the path style on custom endpoints
+	//+kubebuilder:validation:Enum=path;virtual
+	//+optional
+	AddressingStyle string `json:"addressingStyle,omitempty"`
+	// PublicBaseUrl is the URL the objects are publicly served from instead of the bucket URL,
+	// e.g. a CDN fronting the bucket, the object URL is PublicBaseUrl/Key
+	//+optional
+	PublicBaseUrl string `json:"publicBaseUrl,omitempty"`
 
 	Size int64 `json:"size,omitempty"`
 
@@ -63,6 +82,31 @@ type S3ObjectRef struct {
 	// https://docs.aws.amazon.com/AmazonS3/latest/userguide/acl-overview.html#canned-acl
 	//+kubebuilder:validation:Enum=private;public-read;public-read-write;authenticated-read;aws-exec-read;bucket-owner-read;bucket-owner-full-control
 	ObjectACL string `json:"objectACL,omitempty"`
+
+	//+optional
+	ContentType string `json:"contentType,omitempty"`
+	//+optional
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	//+optional
+	CacheControl string `json:"cacheControl,omitempty"`
+	//+optional
+	ContentDisposition string `json:"contentDisposition,omitempty"`
+	// Metadata is the user-defined metadata of the object
+	//+optional
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// UploadOptions returns the upload options of the object: its ACL, storage class, content headers and metadata
+func (o *S3ObjectRef) UploadOptions() *s3util.UploadOptions {
+	return &s3util.UploadOptions{
+		ACL:                s3types.ObjectCannedACL(o.ObjectACL),
+		StorageClass:       s3types.StorageClass(o.StorageClass),
+		Metadata:           o.Metadata,
+		ContentType:        o.ContentType,
+		ContentEncoding:    o.ContentEncoding,
+		CacheControl:       o.CacheControl,
+		ContentDisposition: o.ContentDisposition,
+	}
 }
 
 type S3ObjectRefStatus struct {
@@ -70,20 +114,61 @@ type S3ObjectRefStatus struct {
 	Filename  string  `json:"filename,omitempty"`
 	ETag      *string `json:"etag,omitempty"`
 	Key       string  `json:"key,omitempty"`
+	VersionID string  `json:"versionId,omitempty"`
 	Size      string  `json:"size,omitempty"`
 	SizeBytes int64   `json:"sizeBytes,omitempty"`
 	Url       string  `json:"url,omitempty"`
 	S3Url     string  `json:"s3Url,omitempty"`
+	// DownloadUrl is a presigned URL to download the object without credentials, see RefreshDownloadUrl
+	DownloadUrl string `json:"downloadUrl,omitempty"`
+	//+kubebuilder:validation:Format="date-time"
+	DownloadUrlExpiry string `json:"downloadUrlExpiry,omitempty"`
+	// DownloadUrlKey and DownloadUrlVersionID are the object DownloadUrl was signed for
+	DownloadUrlKey       string `json:"downloadUrlKey,omitempty"`
+	DownloadUrlVersionID string `json:"downloadUrlVersionId,omitempty"`
 
 	//+kubebuilder:validation:Format="date-time"
 	LastModified string `json:"createTime,omitempty"`
+	ContentType  string `json:"contentType,omitempty"`
 }
 
+// Url returns the public URL of the object if PublicBaseUrl is set, otherwise the upload location
+// or the URL of the object on its endpoint
 func (o *S3ObjectRef) Url() string {
+	if o.PublicBaseUrl != "" {
+		return strings.TrimSuffix(o.PublicBaseUrl, "/") + "/" + s3util.EscapeKey(strings.TrimPrefix(o.Key, "/"))
+	}
 	if o.Location != "" {
 		return o.Location
 	}
-	return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", o.Region, o.Bucket, o.Key)
+	return s3util.ObjectURL(o.Endpoint, o.Region, o.Bucket, o.Key, s3util.AddressingStyle(o.AddressingStyle))
+}
+
+// FromUrl sets the location of the object from an URL of any of the forms built by Url or a s3:// URI,
+// the URLs under PublicBaseUrl keep the current bucket
+func (o *S3ObjectRef) FromUrl(rawURL string) error {
+	if o.PublicBaseUrl != "" {
+		if path, ok := strings.CutPrefix(rawURL, strings.TrimSuffix(o.PublicBaseUrl, "/")+"/"); ok {
+			key, err := url.PathUnescape(path)
+			if err != nil {
+				return err
+			}
+			o.Key = key
+			return nil
+		}
+	}
+	loc, err := s3util.ParseObjectURL(rawURL, o.Endpoint)
+	if err != nil {
+		return err
+	}
+	if loc.Endpoint != "" || !strings.HasPrefix(rawURL, "s3://") {
+		o.Endpoint = loc.Endpoint
+		o.Region = must.Default(loc.Region, o.Region)
+		o.AddressingStyle = string(loc.Style)
+	}
+	o.Bucket = loc.Bucket
+	o.Key = loc.Key
+	return nil
 }
 
 func (o *S3ObjectRef) S3Url() string {
@@ -116,6 +201,8 @@ func (o *S3ObjectRef) FromUpload(up s3util.UploadOutput) error {
 	o.Expiration = up.Expiration
 	o.UploadID = up.UploadID
 	o.VersionID = up.VersionID
+	o.ContentType = up.ContentType
+	o.Metadata = up.Metadata
 	return nil
 }
 
@@ -127,11 +214,18 @@ func (o *S3ObjectRef) FromHeadOutput(head s3util.HeadObjectOutput) {
 	o.ETag = head.ETag
 	o.Expiration = head.Expiration
 	o.StorageClass = string(head.StorageClass)
-	o.LastModified = head.LastModified.Format(time.RFC3339)
+	if head.LastModified != nil {
+		o.LastModified = head.LastModified.Format(time.RFC3339)
+	}
 	o.VersionID = head.VersionId
 	if head.ContentLength != nil {
 		o.Size = *head.ContentLength
 	}
+	o.ContentType = aws.ToString(head.ContentType)
+	o.ContentEncoding = aws.ToString(head.ContentEncoding)
+	o.CacheControl = aws.ToString(head.CacheControl)
+	o.ContentDisposition = aws.ToString(head.ContentDisposition)
+	o.Metadata = head.Metadata
 }
 
 func (o *S3ObjectRef) ToStatus(s *S3ObjectRefStatus) {
@@ -141,8 +235,10 @@ func (o *S3ObjectRef) ToStatus(s *S3ObjectRefStatus) {
 	s.Size = o.SizeReadable()
 	s.SizeBytes = o.Size
 	s.Key = o.Key
+	s.VersionID = aws.ToString(o.VersionID)
 	s.ETag = o.ETag
 	s.LastModified = o.LastModified
+	s.ContentType = o.ContentType
 }
 
 func (r *S3ObjectRef) SetDefaults() {
@@ -153,6 +249,24 @@ func (r *S3ObjectRef) SetDefaults() {
 	}
 }
 
+// RestoreVersion makes VersionID the latest version of the object, rolling back the newer ones,
+// and updates the ref from the restored object. b must manage the bucket of the ref.
+func (o *S3ObjectRef) RestoreVersion(ctx context.Context, b *s3util.BucketManager) error {
+	if o.VersionID == nil || *o.VersionID == "" {
+		return errors.New("object ref has no version to restore")
+	}
+	out, err := b.RestoreVersion(ctx, o.Key, *o.VersionID)
+	if err != nil {
+		return err
+	}
+	head, err := b.HeadObjectVersion(ctx, o.Key, aws.ToString(out.VersionId))
+	if err != nil {
+		return err
+	}
+	o.FromHeadOutput(head)
+	return nil
+}
+
 func (s *S3ObjectRefStatus) FromUpload(up s3util.UploadOutput) {
 	s.Filename = filepath.Base(*up.Key)
 	s.ETag = up.ETag
@@ -160,6 +274,9 @@ func (s *S3ObjectRefStatus) FromUpload(up s3util.UploadOutput) {
 	s.SizeBytes = up.Size
 	s.Url = up.Location
 	s.S3Url = fmt.Sprintf("s3://%s/%s", up.Bucket, *up.Key)
+	s.Key = *up.Key
+	s.VersionID = aws.ToString(up.VersionID)
+	s.ContentType = up.ContentType
 }
 
 func (s *S3ObjectRefStatus) FromHeadOutput(head s3util.HeadObjectOutput) {
@@ -167,3 +284,76 @@ func (s *S3ObjectRefStatus) FromHeadOutput(head s3util.HeadObjectOutput) {
 	r.FromHeadOutput(head)
 	r.ToStatus(s)
 }
+
+// RefreshDownloadUrl presigns a new DownloadUrl valid for expiry when there is none, when it expires
+// within refreshBefore or when it was signed for another key or version. It returns the duration after
+// which the URL must be refreshed again, to be used as the RequeueAfter of the reconcile.
+func (s *S3ObjectRefStatus) RefreshDownloadUrl(ctx context.Context, b *s3util.BucketManager, expiry, refreshBefore time.Duration) (time.Duration, error) {
+	expiry = must.Default(expiry, s3util.DefaultPresignExpiry)
+	if refreshBefore >= expiry {
+		refreshBefore = expiry / 2
+	}
+	signed := s.DownloadUrlKey == s.Key && s.DownloadUrlVersionID == s.VersionID
+	if expires, err := time.Parse(time.RFC3339, s.DownloadUrlExpiry); s.DownloadUrl != "" && signed && err == nil {
+		if left := time.Until(expires) - refreshBefore; left > 0 {
+			return left, nil
+		}
+	}
+	url, err := b.PresignGetVersion(ctx, s.Key, s.VersionID, expiry)
+	if err != nil {
+		return 0, err
+	}
+	s.DownloadUrl = url.URL
+	s.DownloadUrlExpiry = url.Expires.UTC().Format(time.RFC3339)
+	s.DownloadUrlKey = s.Key
+	s.DownloadUrlVersionID = s.VersionID
+	return expiry - refreshBefore, nil
+}
+
+// S3Encryption is the encryption of stored objects, see s3util.Encryption
+type S3Encryption struct {
+	// SSE is the server side encryption managed by the store
+	//+kubebuilder:validation:Enum=AES256;aws:kms
+	//+optional
+	SSE string `json:"sse,omitempty"`
+	// KMSKeyID is the KMS key of the aws:kms server side encryption
+	//+optional
+	KMSKeyID string `json:"kmsKeyId,omitempty"`
+	// CustomerKey selects the base64 encoded 256 bit key of the SSE-C server side encryption
+	//+optional
+	CustomerKey *corev1.SecretKeySelector `json:"customerKey,omitempty"`
+	// ClientKey selects the base64 encoded 256 bit key of the client side envelope encryption
+	//+optional
+	ClientKey *corev1.SecretKeySelector `json:"clientKey,omitempty"`
+}
+
+// Get resolves the keys of the encryption from the secrets of namespace, it returns nil if no encryption is configured
+func (e *S3Encryption) Get(ctx context.Context, r client.Client, namespace string) (*s3util.Encryption, error) {
+	if e == nil || (e.SSE == "" && e.CustomerKey == nil && e.ClientKey == nil) {
+		return nil, nil
+	}
+	enc := &s3util.Encryption{SSE: s3types.ServerSideEncryption(e.SSE), KMSKeyID: e.KMSKeyID}
+	for _, k := range []struct {
+		name string
+		from *corev1.SecretKeySelector
+		to   *[]byte
+	}{{"customer key", e.CustomerKey, &enc.CustomerKey}, {"client key", e.ClientKey, &enc.ClientKey}} {
+		if k.from == nil {
+			continue
+		}
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: k.from.Name}, secret); err != nil {
+			return nil, err
+		}
+		value, ok := secret.Data[k.from.Key]
+		if !ok {
+			return nil, fmt.Errorf("%s %s not found in secret %s", k.name, k.from.Key, k.from.Name)
+		}
+		key, err := base64.StdEncoding.DecodeString(string(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k.name, err)
+		}
+		*k.to = key
+	}
+	return enc, nil
+}
@@ -0,0 +1,181 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package commonspec
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRefreshDownloadUrl(t *testing.T) {
+	ctx := context.Background()
+	b, err := s3util.NewManagerWithClient(awss3.New(awss3.Options{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	}), "test", "", 1)
+	require.NoError(t, err)
+
+	s := &S3ObjectRefStatus{Key: "chain/spec.json"}
+	after, err := s.RefreshDownloadUrl(ctx, b, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 50*time.Minute, after)
+	assert.Contains(t, s.DownloadUrl, "chain/spec.json")
+	url := s.DownloadUrl
+
+	// still valid, kept
+	after, err = s.RefreshDownloadUrl(ctx, b, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	assert.InDelta(t, float64(50*time.Minute), float64(after), float64(2*time.Second))
+	assert.Equal(t, url, s.DownloadUrl)
+
+	// about to expire, refreshed
+	s.DownloadUrlExpiry = time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	_, err = s.RefreshDownloadUrl(ctx, b, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	expires, err := time.Parse(time.RFC3339, s.DownloadUrlExpiry)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, 2*time.Second)
+
+	// another object, re-signed even though the URL is still valid
+	url = s.DownloadUrl
+	o := &S3ObjectRef{Key: "chain/genesis.json", VersionID: aws.String("v2")}
+	o.ToStatus(s)
+	_, err = s.RefreshDownloadUrl(ctx, b, time.Hour, 10*time.Minute)
+	require.NoError(t, err)
+	assert.NotEqual(t, url, s.DownloadUrl)
+	assert.Contains(t, s.DownloadUrl, "chain/genesis.json")
+	assert.Contains(t, s.DownloadUrl, "versionId=v2")
+	assert.Equal(t, "chain/genesis.json", s.DownloadUrlKey)
+	assert.Equal(t, "v2", s.DownloadUrlVersionID)
+}
+
+func TestS3ObjectRefUrl(t *testing.T) {
+	o := &S3ObjectRef{Endpoint: "http://minio:9000", Bucket: "b", Key: "chain/spec.json"}
+	assert.Equal(t, "http://minio:9000/b/chain/spec.json", o.Url())
+	o.AddressingStyle = "virtual"
+	assert.Equal(t, "http://b.minio:9000/chain/spec.json", o.Url())
+
+	parsed := &S3ObjectRef{Endpoint: "http://minio:9000"}
+	require.NoError(t, parsed.FromUrl(o.Url()))
+	assert.Equal(t, "b", parsed.Bucket)
+	assert.Equal(t, "chain/spec.json", parsed.Key)
+	assert.Equal(t, "virtual", parsed.AddressingStyle)
+
+	o.PublicBaseUrl = "https://cdn.example.com/artifacts/"
+	assert.Equal(t, "https://cdn.example.com/artifacts/chain/spec.json", o.Url())
+	require.NoError(t, o.FromUrl("https://cdn.example.com/artifacts/chain/keystore.json"))
+	assert.Equal(t, "chain/keystore.json", o.Key)
+	assert.Equal(t, "b", o.Bucket)
+
+	// the key is escaped in the public URL
+	o.Key = "chain/my spec#1?.json"
+	assert.Equal(t, "https://cdn.example.com/artifacts/chain/my%20spec%231%3F.json", o.Url())
+	parsed = &S3ObjectRef{PublicBaseUrl: o.PublicBaseUrl}
+	require.NoError(t, parsed.FromUrl(o.Url()))
+	assert.Equal(t, o.Key, parsed.Key)
+}
+
+func TestS3ObjectRefFromHeadOutput(t *testing.T) {
+	head := s3util.HeadObjectOutput{Bucket: "b", Key: "k"}
+	head.ContentType = aws.String("application/json")
+	head.CacheControl = aws.String("no-cache")
+	head.Metadata = map[string]string{s3util.OwnerNameMetadataKey: "devnet"}
+	o := &S3ObjectRef{}
+	o.FromHeadOutput(head)
+	assert.Equal(t, "application/json", o.ContentType)
+	assert.Equal(t, "no-cache", o.CacheControl)
+	assert.Equal(t, "devnet", o.Metadata[s3util.OwnerNameMetadataKey])
+
+	s := &S3ObjectRefStatus{}
+	o.ToStatus(s)
+	assert.Equal(t, "application/json", s.ContentType)
+	assert.Equal(t, "no-cache", o.UploadOptions().CacheControl)
+}
+
+func TestS3ObjectRefRestoreVersion(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("b")
+	defer srv.Close()
+	b, err := s3util.NewManagerWithClient(srv.Client(), "b", "", 1)
+	require.NoError(t, err)
+	_, err = b.EnsureBucket(ctx, s3util.BucketConfig{Versioning: ptr.Of(true)})
+	require.NoError(t, err)
+
+	o := &S3ObjectRef{Key: "chain/spec.json", CacheControl: "no-cache", Metadata: map[string]string{"owner": "devnet"}}
+	up, err := b.UploadReader(ctx, "spec.json", strings.NewReader(`{"v":1}`), o.Key, o.UploadOptions())
+	require.NoError(t, err)
+	require.NoError(t, o.FromUpload(*up))
+	require.NotNil(t, o.VersionID)
+	_, err = b.UploadReader(ctx, "spec.json", strings.NewReader(`{"v":2}`), o.Key, o.UploadOptions())
+	require.NoError(t, err)
+
+	require.NoError(t, o.RestoreVersion(ctx, b))
+	assert.NotEqual(t, *up.VersionID, aws.ToString(o.VersionID))
+	assert.Equal(t, int64(7), o.Size)
+	assert.Equal(t, "no-cache", o.CacheControl)
+	assert.Equal(t, "devnet", o.Metadata["owner"])
+	data, ok := srv.GetObject("b", o.Key)
+	require.True(t, ok)
+	assert.Equal(t, `{"v":1}`, string(data))
+}
+
+func TestS3EncryptionGet(t *testing.T) {
+	ctx := context.Background()
+	key := bytes.Repeat([]byte{1}, 32)
+	r := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "keys"},
+		Data: map[string][]byte{
+			"client":  []byte(base64.StdEncoding.EncodeToString(key)),
+			"invalid": []byte("not base64!"),
+		},
+	}).Build()
+
+	var e *S3Encryption
+	enc, err := e.Get(ctx, r, "test")
+	require.NoError(t, err)
+	assert.Nil(t, enc)
+	enc, err = (&S3Encryption{}).Get(ctx, r, "test")
+	require.NoError(t, err)
+	assert.Nil(t, enc)
+
+	e = &S3Encryption{SSE: "aws:kms", KMSKeyID: "alias/data"}
+	enc, err = e.Get(ctx, r, "test")
+	require.NoError(t, err)
+	assert.Equal(t, &s3util.Encryption{SSE: s3types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/data"}, enc)
+
+	e = &S3Encryption{ClientKey: &corev1.SecretKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "keys"}, Key: "client"}}
+	enc, err = e.Get(ctx, r, "test")
+	require.NoError(t, err)
+	assert.Equal(t, key, enc.ClientKey)
+	assert.Nil(t, enc.CustomerKey)
+
+	e.ClientKey.Key = "invalid"
+	_, err = e.Get(ctx, r, "test")
+	assert.ErrorContains(t, err, "invalid client key")
+	e.ClientKey.Key = "missing"
+	_, err = e.Get(ctx, r, "test")
+	assert.ErrorContains(t, err, "not found")
+	_, err = e.Get(ctx, r, "other")
+	assert.True(t, apierrors.IsNotFound(err))
+}
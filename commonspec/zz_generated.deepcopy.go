@@ -314,6 +314,31 @@ func (in *PersistenceSpec) DeepCopy() *PersistenceSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *S3Encryption) DeepCopyInto(out *S3Encryption) {
+	*out = *in
+	if in.CustomerKey != nil {
+		in, out := &in.CustomerKey, &out.CustomerKey
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ClientKey != nil {
+		in, out := &in.ClientKey, &out.ClientKey
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3Encryption.
+func (in *S3Encryption) DeepCopy() *S3Encryption {
+	if in == nil {
+		return nil
+	}
+	out := new(S3Encryption)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *S3ObjectRef) DeepCopyInto(out *S3ObjectRef) {
 	*out = *in
@@ -332,6 +357,13 @@ func (in *S3ObjectRef) DeepCopyInto(out *S3ObjectRef) {
 		*out = new(string)
 		**out = **in
 	}
+	if in.Metadata != nil {
+		in, out := &in.Metadata, &out.Metadata
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new S3ObjectRef.
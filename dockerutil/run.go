@@ -42,6 +42,7 @@ type ContainerOpts struct {
 	Cmd           []string
 	Env           []string
 	WorkDir       string
+	ExtraHosts    []string
 	Rm            bool
 	EndingPhrases []string
 	Timeout       time.Duration
@@ -67,7 +68,7 @@ func SimpleRun(ctx context.Context, cli *client.Client, imageRef string, opts Co
 			WorkingDir: opts.WorkDir,
 			User:       "root",
 		},
-		&container.HostConfig{Binds: opts.Binds},
+		&container.HostConfig{Binds: opts.Binds, ExtraHosts: opts.ExtraHosts},
 		&netCfg,
 		&v1.Platform{},
 		opts.Name,
@@ -77,6 +78,9 @@ func SimpleRun(ctx context.Context, cli *client.Client, imageRef string, opts Co
 	}
 	if opts.Rm {
 		defer func() {
+			// removed even when ctx is cancelled, which stops the run
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
 			if err := cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{RemoveVolumes: true, Force: true}); err != nil {
 				log.Error(err, "Error removing container", "containerID", resp.ID)
 			}
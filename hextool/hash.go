@@ -7,6 +7,7 @@ package hextool
 
 import (
 	"crypto/sha256"
+	"io"
 	"os"
 
 	"golang.org/x/crypto/blake2b"
@@ -19,11 +20,20 @@ func SHA256(data []byte) string {
 }
 
 func SHA256OfFile(path string) (string, error) {
-	data, err := os.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
-	return SHA256(data), nil
+	defer f.Close()
+	return SHA256OfReader(f)
+}
+
+func SHA256OfReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return Encode(h.Sum(nil)), nil
 }
 
 func Blake2b256(data []byte) string {
@@ -0,0 +1,133 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	s3mgr "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/pkg/errors"
+)
+
+const (
+	attemptLogSuffix    = ".log"
+	attemptStatusSuffix = ".status"
+)
+
+// Attempt is a single run of the workload whose logs were persisted, see JobBuilder.PersistLogs
+type Attempt struct {
+	// Name is "<workload start time>-<pod name>" with the time in UTC like 20060102T150405Z,
+	// attempts are sorted by name
+	Name         string
+	LogKey       string
+	StatusKey    string
+	LogSize      int64
+	LastModified time.Time
+}
+
+// LogsPrefix is the key prefix where the logs and exit status of every attempt are uploaded
+func (j *JobBuilder) LogsPrefix() string {
+	return j.ObjectKey + ".logs/"
+}
+
+// ListAttempts lists the attempts whose logs were persisted, oldest first
+func (j *JobBuilder) ListAttempts(ctx context.Context) ([]Attempt, error) {
+	j.initDefaults()
+	if err := j.initClient(); err != nil {
+		return nil, err
+	}
+	objs, err := j.BucketManager.List(ctx, j.LogsPrefix(), nil)
+	if err != nil {
+		return nil, err
+	}
+	attempts := map[string]*Attempt{}
+	for _, o := range objs {
+		name := strings.TrimPrefix(o.Key, j.LogsPrefix())
+		var suffix string
+		switch {
+		case strings.HasSuffix(name, attemptLogSuffix):
+			suffix = attemptLogSuffix
+		case strings.HasSuffix(name, attemptStatusSuffix):
+			suffix = attemptStatusSuffix
+		default:
+			continue
+		}
+		name = strings.TrimSuffix(name, suffix)
+		a, ok := attempts[name]
+		if !ok {
+			a = &Attempt{Name: name}
+			attempts[name] = a
+		}
+		if suffix == attemptLogSuffix {
+			a.LogKey = o.Key
+			a.LogSize = o.Size
+		} else {
+			a.StatusKey = o.Key
+		}
+		if o.LastModified.After(a.LastModified) {
+			a.LastModified = o.LastModified
+		}
+	}
+	out := make([]Attempt, 0, len(attempts))
+	for _, a := range attempts {
+		out = append(out, *a)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Name < out[b].Name })
+	return out, nil
+}
+
+// LastAttempt returns the latest attempt whose logs were persisted
+func (j *JobBuilder) LastAttempt(ctx context.Context) (*Attempt, error) {
+	attempts, err := j.ListAttempts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(attempts) == 0 {
+		return nil, errors.New("no attempt found")
+	}
+	return &attempts[len(attempts)-1], nil
+}
+
+// AttemptLogs returns the persisted workload log of the given attempt
+func (j *JobBuilder) AttemptLogs(ctx context.Context, attempt string) (string, error) {
+	b, err := j.getObject(ctx, j.LogsPrefix()+attempt+attemptLogSuffix)
+	return string(b), err
+}
+
+// AttemptExitCode returns the persisted exit code of the workload of the given attempt
+func (j *JobBuilder) AttemptExitCode(ctx context.Context, attempt string) (int, error) {
+	b, err := j.getObject(ctx, j.LogsPrefix()+attempt+attemptStatusSuffix)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// DeleteLogs deletes the persisted logs and exit status of all attempts
+func (j *JobBuilder) DeleteLogs(ctx context.Context) (err error) {
+	j.initDefaults()
+	if err = j.initClient(); err != nil {
+		return
+	}
+	_, err = j.BucketManager.Delete(ctx, j.LogsPrefix())
+	return
+}
+
+func (j *JobBuilder) getObject(ctx context.Context, key string) ([]byte, error) {
+	j.initDefaults()
+	if err := j.initClient(); err != nil {
+		return nil, err
+	}
+	buf := s3mgr.NewWriteAtBuffer(nil)
+	if _, err := j.BucketManager.DownloadWriter(ctx, key, buf); err != nil {
+		return nil, errors.Wrapf(err, "failed to download %s", key)
+	}
+	return buf.Bytes(), nil
+}
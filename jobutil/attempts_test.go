@@ -0,0 +1,60 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttempts(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	j := newTestBuilder(t)
+	var err error
+	j.BucketManager, err = s3util.NewManagerWithClient(srv.Client(), "test", "", 1)
+	require.NoError(t, err)
+	j.initDefaults()
+
+	_, err = j.LastAttempt(ctx)
+	assert.Error(t, err)
+
+	prefix := j.LogsPrefix()
+	assert.Equal(t, "jobutil/test/job.tar.gz.logs/", prefix)
+	// uploaded out of order, the names sort by the start time of the workload
+	srv.PutObject("test", prefix+"20240102T030405Z-job-b.log", []byte("second\n"), nil)
+	srv.PutObject("test", prefix+"20240102T030405Z-job-b.status", []byte("0\n"), nil)
+	srv.PutObject("test", prefix+"20240101T000000Z-job-a.log", []byte("first\n"), nil)
+	srv.PutObject("test", prefix+"20240101T000000Z-job-a.status", []byte("1\n"), nil)
+	srv.PutObject("test", prefix+"ignored.txt", []byte("x"), nil)
+
+	attempts, err := j.ListAttempts(ctx)
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	assert.Equal(t, "20240101T000000Z-job-a", attempts[0].Name)
+	assert.Equal(t, prefix+"20240101T000000Z-job-a.log", attempts[0].LogKey)
+	assert.Equal(t, prefix+"20240101T000000Z-job-a.status", attempts[0].StatusKey)
+	assert.Equal(t, int64(6), attempts[0].LogSize)
+
+	last, err := j.LastAttempt(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "20240102T030405Z-job-b", last.Name)
+	logs, err := j.AttemptLogs(ctx, last.Name)
+	require.NoError(t, err)
+	assert.Equal(t, "second\n", logs)
+	code, err := j.AttemptExitCode(ctx, attempts[0].Name)
+	require.NoError(t, err)
+	assert.Equal(t, 1, code)
+
+	require.NoError(t, j.DeleteLogs(ctx))
+	assert.Empty(t, srv.Keys("test"))
+}
@@ -7,62 +7,182 @@ package jobutil
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/alt-research/operator-kit/array"
+	"github.com/alt-research/operator-kit/commonspec"
 	"github.com/alt-research/operator-kit/envs"
+	"github.com/alt-research/operator-kit/hextool"
 	"github.com/alt-research/operator-kit/k8s"
 	"github.com/alt-research/operator-kit/maputil"
 	"github.com/alt-research/operator-kit/must"
 	"github.com/alt-research/operator-kit/ptr"
 	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/specutil"
 	"github.com/alt-research/operator-kit/targz"
 	"github.com/pkg/errors"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/utils/env"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 var DEFAULT_K8S_TOOL_IMAGE = env.GetString("K8S_TOOL_IMAGE", "alpine/k8s:1.28.4")
 
 const (
 	s3KeyPrefix = "jobutil"
+
+	// LabelName is set on the pods of every job built by JobBuilder, it is used to select
+	// pods of CronJob runs whose job names are generated
+	LabelName = "app.altlayer.io/jobutil-name"
+	// SpecHashAnnotation holds the checksum of the rendered job spec and scripts, see JobBuilder.Drifted
+	SpecHashAnnotation = "app.altlayer.io/jobutil-spec-hash"
+)
+
+// DriftPolicy decides what CreateOrUpdate does when the rendered spec of an existing Job has changed,
+// the pod template of a Job is immutable so it can only be applied by recreating the Job.
+// CronJobs are always updated in place, the changes apply to their next runs.
+type DriftPolicy string
+
+const (
+	// DriftIgnore leaves the existing Job and its scripts untouched, CreateOrUpdate returns nil
+	// and logs the drift so that the Job still running the previous spec is noticed
+	DriftIgnore DriftPolicy = "Ignore"
+	// DriftRecreateWhenNotRunning recreates the Job once it has no active pods,
+	// CreateOrUpdate returns ErrJobRunning until then
+	DriftRecreateWhenNotRunning DriftPolicy = "RecreateWhenNotRunning"
+	// DriftRecreate deletes the Job immediately, killing its running pods, and recreates it
+	// once deleted, CreateOrUpdate returns ErrJobDeleting until then
+	DriftRecreate DriftPolicy = "Recreate"
 )
 
+// ChecksumMetadataKey is the object metadata key holding the SHA256 of data archives uploaded by previous
+// versions, the checksum is now stored in a sidecar object, see ChecksumKey
+const ChecksumMetadataKey = s3util.SHA256MetadataKey
+
+// ChecksumKey returns the key of the sidecar object holding the SHA256 of the data archive at key,
+// the streamed upload of the archive cannot set it as metadata upfront
+func ChecksumKey(key string) string {
+	return key + ".sha256"
+}
+
+// ErrDataCorrupted is returned when downloaded data is truncated or does not match its checksum
+var ErrDataCorrupted = errors.New("job data is corrupted")
+
+// ErrJobRunning is returned by CreateOrUpdate when a drifted Job waits to finish before being recreated
+var ErrJobRunning = errors.New("job has drifted and is still running")
+
+// ErrJobDeleting is returned by CreateOrUpdate while a drifted Job is being deleted before being recreated,
+// CreateOrUpdate must be called again later
+var ErrJobDeleting = errors.New("job has drifted and is being deleted")
+
 type JobBuilder struct {
-	clientset *kubernetes.Clientset
+	// Client manages the job resources, defaults to a client built from the kubeconfig or in-cluster config
+	Client client.Client
+	// Clientset is only used to read pod logs, which Client does not support
+	Clientset kubernetes.Interface
+	// Owner, if set, becomes the controller owner of the Job or CronJob
+	Owner client.Object
+	// DataOwner, defaults to Owner, is recorded in the metadata of the uploaded data, which the
+	// GarbageCollector keeps while DataOwner exists, even after the Job or CronJob is deleted
+	DataOwner client.Object
 
 	// Job is the Job object
-	Job                       *batchv1.Job
+	Job *batchv1.Job
+	// CronJob is the CronJob object, only used when Schedule is set
+	CronJob                   *batchv1.CronJob
 	ScriptCM                  *corev1.ConfigMap
 	ScriptSourceConfigMapName string
 
 	BucketName    string
 	BucketManager *s3util.BucketManager
 	ObjectKey     string
-	K8sToolImage  string
+	// InputObjectKeys are restored in order into the data dir when ObjectKey has no data yet,
+	// it is used to hand the output of upstream jobs over to this job
+	InputObjectKeys []string
+	K8sToolImage    string
 
 	Name      string
 	Namespace string
 	Image     string
 	Script    string
-	WorkDir   string
-	DataDirs  []string
-	Env       []corev1.EnvVar
-	LocalDir  string
+	// ScriptTemplate, if set, is rendered as a text template with Params into Script,
+	// Build fails if a parameter referenced by the template is not provided
+	ScriptTemplate string
+	// Params are the typed parameters of ScriptTemplate, they are also mounted as /scripts/params.json
+	// and exposed to the workload as PARAM_<NAME> env vars
+	Params   any
+	WorkDir  string
+	DataDirs []string
+	Env      []corev1.EnvVar
+	LocalDir string
 
 	MaxRetries     *int32
 	NewDataOnRetry bool
+	// DriftPolicy defaults to DriftIgnore, the data object is kept when a Job is recreated
+	DriftPolicy DriftPolicy
+	// Queue, if set, limits the concurrently running Jobs of the queue, see Admit.
+	// It cannot be used with Schedule.
+	Queue    *Queue
+	Priority int32
+	// PersistLogs uploads the workload log and exit status of every attempt as separate objects
+	// under LogsPrefix instead of keeping workload.log in the data, see ListAttempts
+	PersistLogs bool
+	// Retention controls the cleanup of the data and logs of the job, see ApplyRetention
+	Retention Retention
+
+	// Schedule makes the builder produce a CronJob running the job on the given cron schedule,
+	// every run restores the data uploaded by the previous one
+	Schedule          string
+	ConcurrencyPolicy batchv1.ConcurrencyPolicy
+	// Indexed makes the job an Indexed Job, each completion index restores and uploads
+	// its own data object, see IndexObjectKey
+	Indexed     bool
+	Completions *int32
+	Parallelism *int32
 
 	NodeSelector   map[string]string
 	Resources      corev1.ResourceRequirements
 	ServiceAccount string
+
+	Tolerations       []corev1.Toleration
+	Affinity          *corev1.Affinity
+	PriorityClassName string
+	SecurityContext   *corev1.PodSecurityContext
+	// WorkloadSecurityContext is the security context of the workload container
+	WorkloadSecurityContext *corev1.SecurityContext
+	ImagePullPolicy         corev1.PullPolicy
+	ImagePullSecrets        []corev1.LocalObjectReference
+	// Volumes are added to the pod besides the builtin data, marker and scripts volumes
+	Volumes []corev1.Volume
+	// VolumeMounts are added to the workload, downloaddata and uploaddata containers
+	VolumeMounts            []corev1.VolumeMount
+	ActiveDeadlineSeconds   *int64
+	TTLSecondsAfterFinished *int32
+	PodLabels               map[string]string
+	PodAnnotations          map[string]string
+
+	// specHash is the checksum of the last build, appliedHash the one of the existing Job or CronJob
+	specHash    string
+	appliedHash string
 }
 
 func BuilderSimple(name, image, workdir, script, localDir string, dataDirs []string, bucket string, env []corev1.EnvVar) *JobBuilder {
@@ -77,17 +197,22 @@ func BuilderSimple(name, image, workdir, script, localDir string, dataDirs []str
 	}
 }
 
+// WithImage sets the workload image, its pull policy and pull secrets from the given image ref
+func (j *JobBuilder) WithImage(ref commonspec.ImageRef) *JobBuilder {
+	j.Image = ref.RefDigest()
+	j.ImagePullPolicy = ref.PullPolicy
+	j.ImagePullSecrets = ref.PullSecrets
+	return j
+}
+
 func (j *JobBuilder) Build(ctx context.Context) (err error) {
 	j.initDefaults()
 	return j.build(ctx)
 }
 
 func (j *JobBuilder) initClient() (err error) {
-	if j.clientset == nil {
-		j.clientset, err = k8s.GetClient()
-		if err != nil {
-			return
-		}
+	if err = j.initCtrlClient(); err != nil {
+		return
 	}
 	if j.BucketManager == nil {
 		if j.BucketName == "" {
@@ -101,6 +226,20 @@ func (j *JobBuilder) initClient() (err error) {
 	return
 }
 
+func (j *JobBuilder) initCtrlClient() (err error) {
+	if j.Client == nil {
+		j.Client, err = k8s.GetCtrlClient()
+	}
+	return
+}
+
+func (j *JobBuilder) initClientset() (err error) {
+	if j.Clientset == nil {
+		j.Clientset, err = k8s.GetClient()
+	}
+	return
+}
+
 func (j *JobBuilder) initDefaults() {
 	j.K8sToolImage = must.Default(j.K8sToolImage, DEFAULT_K8S_TOOL_IMAGE)
 	j.Namespace = must.Default(j.Namespace, k8s.NAMESPACE)
@@ -111,7 +250,17 @@ func (j *JobBuilder) initDefaults() {
 }
 
 func (j *JobBuilder) build(ctx context.Context) (err error) {
+	// the runs created by a CronJob are not suspended, so they cannot wait in a queue
+	if j.Queue != nil && j.Schedule != "" {
+		return errors.New("a scheduled job cannot be queued")
+	}
 	_ = j.Get(ctx)
+	j.appliedHash = ""
+	if j.Schedule != "" && j.CronJob != nil {
+		j.appliedHash = j.CronJob.Annotations[SpecHashAnnotation]
+	} else if j.Schedule == "" && j.Job != nil {
+		j.appliedHash = j.Job.Annotations[SpecHashAnnotation]
+	}
 
 	err = j.initClient()
 	if err != nil {
@@ -128,18 +277,25 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 		return errors.Wrapf(err, "failed to get service account %s", j.ServiceAccount)
 	}
 
-	downupEnvVars := []corev1.EnvVar{
-		{Name: "BUCKET", Value: j.BucketManager.Bucket},
-		{Name: "OBJECT_KEY", Value: j.ObjectKey},
-		{Name: "NEW_DATA_ON_RETRY", Value: strconv.FormatBool(j.NewDataOnRetry)},
+	dataEnv, err := j.dataEnvVars()
+	if err != nil {
+		return
 	}
+	downupEnvVars := append(dataEnv, corev1.EnvVar{
+		Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+	})
 	// support env provided aws credentials
 	if _, ok := sa.Annotations["eks.amazonaws.com/role-arn"]; !ok {
-		for k, v := range envs.SliceToMap(os.Environ()) {
-			if strings.HasPrefix(k, "AWS_") && v != "" {
-				downupEnvVars = append(downupEnvVars, corev1.EnvVar{Name: k, Value: v})
-			}
-		}
+		downupEnvVars = append(downupEnvVars, awsEnvVars()...)
+	}
+
+	scripts, err := j.scriptsData()
+	if err != nil {
+		return
+	}
+	workloadEnv, err := j.workloadEnvVars()
+	if err != nil {
+		return
 	}
 
 	if j.ScriptCM == nil {
@@ -150,13 +306,11 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 	if j.ScriptCM.Data == nil {
 		j.ScriptCM.Data = make(map[string]string)
 	}
-	j.ScriptCM.Data["starter.sh"] = j.Script
-	j.ScriptCM.Data["entrypoint.sh"] = string(must.Two(assets.ReadFile("scripts/entrypoint.sh")))
-	j.ScriptCM.Data["download-data.sh"] = string(must.Two(assets.ReadFile("scripts/download-data.sh")))
-	j.ScriptCM.Data["upload-data.sh"] = string(must.Two(assets.ReadFile("scripts/upload-data.sh")))
+	maputil.MergeOverwrite(&j.ScriptCM.Data, scripts)
 
 	if j.ScriptSourceConfigMapName != "" {
-		cm, err := j.clientset.CoreV1().ConfigMaps(j.Namespace).Get(ctx, j.ScriptSourceConfigMapName, metav1.GetOptions{})
+		cm := &corev1.ConfigMap{}
+		err := j.Client.Get(ctx, client.ObjectKey{Namespace: j.Namespace, Name: j.ScriptSourceConfigMapName}, cm)
 		if err != nil {
 			return errors.Wrapf(err, "failed to get configmap %s", j.ScriptSourceConfigMapName)
 		}
@@ -169,9 +323,27 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 	j.Job.Namespace = j.Namespace
 	j.Job.Name = j.Name
 	j.Job.Spec.BackoffLimit = j.MaxRetries
+	if j.Indexed {
+		j.Job.Spec.CompletionMode = ptr.Of(batchv1.IndexedCompletion)
+		j.Job.Spec.Completions = j.Completions
+		j.Job.Spec.Parallelism = j.Parallelism
+	}
+	// the pod labels and annotations are replaced, only the labels generated by the API server are kept
+	podLabels := maputil.Pick(j.Job.Spec.Template.Labels, func(k, _ string) bool { return array.Contains(jobGeneratedLabels, k) })
+	maputil.MergeOverwrite(&podLabels, j.PodLabels)
+	podLabels[LabelName] = j.Name
+	j.Job.Spec.Template.Labels = podLabels
+	maputil.Copy(&j.Job.Spec.Template.Annotations, j.PodAnnotations)
+	j.Job.Spec.ActiveDeadlineSeconds = j.ActiveDeadlineSeconds
+	j.Job.Spec.TTLSecondsAfterFinished = j.TTLSecondsAfterFinished
 	j.Job.Spec.Template.Spec.ServiceAccountName = j.ServiceAccount
 	j.Job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
 	j.Job.Spec.Template.Spec.NodeSelector = j.NodeSelector
+	j.Job.Spec.Template.Spec.Tolerations = j.Tolerations
+	j.Job.Spec.Template.Spec.Affinity = j.Affinity
+	j.Job.Spec.Template.Spec.PriorityClassName = j.PriorityClassName
+	j.Job.Spec.Template.Spec.SecurityContext = j.SecurityContext
+	j.Job.Spec.Template.Spec.ImagePullSecrets = j.ImagePullSecrets
 
 	if len(j.Job.Spec.Template.Spec.Volumes) == 0 {
 		j.Job.Spec.Template.Spec.Volumes = []corev1.Volume{
@@ -200,6 +372,9 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 			}
 		}
 	}
+	for _, v := range j.Volumes {
+		j.Job.Spec.Template.Spec.Volumes = upsertByName(j.Job.Spec.Template.Spec.Volumes, v, func(v corev1.Volume) string { return v.Name })
+	}
 
 	// init dir
 	downloadDataDir := corev1.Container{
@@ -207,11 +382,11 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 		Image:   j.K8sToolImage,
 		Env:     downupEnvVars,
 		Command: []string{"bash", "/scripts/download-data.sh"},
-		VolumeMounts: []corev1.VolumeMount{
+		VolumeMounts: append([]corev1.VolumeMount{
 			{Name: "data", MountPath: "/data-dir"},
 			{Name: "marker", MountPath: "/tmp/marker"},
 			{Name: "scripts", MountPath: "/scripts"},
-		},
+		}, j.VolumeMounts...),
 	}
 	if len(j.Job.Spec.Template.Spec.InitContainers) == 0 {
 		j.Job.Spec.Template.Spec.InitContainers = []corev1.Container{
@@ -235,19 +410,20 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 		Image:   j.K8sToolImage,
 		Env:     downupEnvVars,
 		Command: []string{"bash", "/scripts/upload-data.sh"},
-		VolumeMounts: []corev1.VolumeMount{
+		VolumeMounts: append([]corev1.VolumeMount{
 			{Name: "data", MountPath: "/data-dir"},
 			{Name: "marker", MountPath: "/tmp/marker"},
 			{Name: "scripts", MountPath: "/scripts"},
-		},
+		}, j.VolumeMounts...),
 	}
 	workload := corev1.Container{
 		Name:            "workload",
 		Image:           j.Image,
-		ImagePullPolicy: corev1.PullIfNotPresent,
-		Env:             j.Env,
+		ImagePullPolicy: must.Default(j.ImagePullPolicy, corev1.PullIfNotPresent),
+		Env:             workloadEnv,
 		WorkingDir:      j.WorkDir,
 		Resources:       j.Resources,
+		SecurityContext: j.WorkloadSecurityContext,
 		VolumeMounts: []corev1.VolumeMount{
 			{Name: "data", MountPath: "/data-dir"},
 			{Name: "marker", MountPath: "/tmp/marker"},
@@ -260,6 +436,7 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 			Name: "data", SubPath: strings.TrimLeft(dir, "/"), MountPath: dir,
 		})
 	}
+	workload.VolumeMounts = append(workload.VolumeMounts, j.VolumeMounts...)
 
 	if len(j.Job.Spec.Template.Spec.Containers) == 0 {
 		j.Job.Spec.Template.Spec.Containers = []corev1.Container{
@@ -276,6 +453,7 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 				c.Env = workload.Env
 				c.WorkingDir = workload.WorkingDir
 				c.Resources = workload.Resources
+				c.SecurityContext = workload.SecurityContext
 				c.VolumeMounts = workload.VolumeMounts
 				c.Command = workload.Command
 			case "uploaddata":
@@ -286,34 +464,259 @@ func (j *JobBuilder) build(ctx context.Context) (err error) {
 			}
 		}
 	}
+
+	j.specHash = hextool.JsonChecksum([]any{
+		withoutAWSEnvValues(downloadDataDir), workload, withoutAWSEnvValues(uploadDataDir), j.Volumes, j.ScriptCM.Data,
+		j.ServiceAccount, j.NodeSelector, j.Tolerations, j.Affinity, j.PriorityClassName, j.SecurityContext,
+		j.ImagePullSecrets, j.PodLabels, j.PodAnnotations, j.MaxRetries, j.Indexed, j.Completions, j.Parallelism,
+		j.ActiveDeadlineSeconds, j.TTLSecondsAfterFinished, j.Schedule, j.ConcurrencyPolicy,
+	})
+	if j.Job.Annotations == nil {
+		j.Job.Annotations = make(map[string]string)
+	}
+	j.Job.Annotations[SpecHashAnnotation] = j.specHash
+	j.buildQueue()
+
+	if j.Schedule != "" {
+		j.buildCronJob()
+	}
+	return
+}
+
+// dataEnvVars returns the env vars of the download and upload containers, except POD_NAME and credentials
+func (j *JobBuilder) dataEnvVars() ([]corev1.EnvVar, error) {
+	owner, err := j.dataOwnerMetadata()
+	if err != nil {
+		return nil, err
+	}
+	// in the key=value,... form of the --metadata option of aws s3 cp
+	ownerMetadata := make([]string, 0, len(owner))
+	for k, v := range owner {
+		ownerMetadata = append(ownerMetadata, k+"="+v)
+	}
+	sort.Strings(ownerMetadata)
+	return []corev1.EnvVar{
+		{Name: "BUCKET", Value: j.bucket()},
+		{Name: "OBJECT_KEY", Value: j.ObjectKey},
+		{Name: "NEW_DATA_ON_RETRY", Value: strconv.FormatBool(j.NewDataOnRetry)},
+		{Name: "INDEXED", Value: strconv.FormatBool(j.Indexed)},
+		{Name: "INPUT_OBJECT_KEYS", Value: strings.Join(j.InputObjectKeys, " ")},
+		{Name: "PERSIST_LOGS", Value: strconv.FormatBool(j.PersistLogs)},
+		{Name: "OWNER_METADATA", Value: strings.Join(ownerMetadata, ",")},
+	}, nil
+}
+
+// dataOwnerMetadata returns the object metadata identifying the DataOwner, nil without owner
+func (j *JobBuilder) dataOwnerMetadata() (map[string]string, error) {
+	owner := j.DataOwner
+	if owner == nil {
+		owner = j.Owner
+	}
+	if owner == nil {
+		return nil, nil
+	}
+	s := scheme.Scheme
+	if j.Client != nil {
+		s = j.Client.Scheme()
+	}
+	gvk, err := apiutil.GVKForObject(owner, s)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the kind of the data owner")
+	}
+	metadata := s3util.OwnerMetadata(gvk.Kind, owner)
+	metadata[s3util.OwnerAPIVersionMetadataKey] = gvk.GroupVersion().String()
+	return metadata, nil
+}
+
+// workloadEnvVars returns the env vars of the workload container
+func (j *JobBuilder) workloadEnvVars() ([]corev1.EnvVar, error) {
+	paramsEnv, err := j.paramsEnv()
+	if err != nil {
+		return nil, err
+	}
+	env := append(append([]corev1.EnvVar{}, j.Env...), paramsEnv...)
+	return append(env, corev1.EnvVar{Name: "PERSIST_LOGS", Value: strconv.FormatBool(j.PersistLogs)}), nil
+}
+
+// scriptsData renders the script and returns the files mounted in /scripts
+func (j *JobBuilder) scriptsData() (map[string]string, error) {
+	if err := j.renderScript(); err != nil {
+		return nil, err
+	}
+	data := map[string]string{
+		"starter.sh":       j.Script,
+		"entrypoint.sh":    string(must.Two(assets.ReadFile("scripts/entrypoint.sh"))),
+		"download-data.sh": string(must.Two(assets.ReadFile("scripts/download-data.sh"))),
+		"upload-data.sh":   string(must.Two(assets.ReadFile("scripts/upload-data.sh"))),
+	}
+	if j.Params != nil {
+		params, err := json.MarshalIndent(j.Params, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode script parameters")
+		}
+		data[paramsFile] = string(params)
+	}
+	return data, nil
+}
+
+func (j *JobBuilder) bucket() string {
+	if j.BucketManager != nil {
+		return j.BucketManager.Bucket
+	}
+	return j.BucketName
+}
+
+// awsEnvVars returns the AWS_* env vars of the current process
+func awsEnvVars() (env []corev1.EnvVar) {
+	for k, v := range envs.SliceToMap(os.Environ()) {
+		if strings.HasPrefix(k, "AWS_") && v != "" {
+			env = append(env, corev1.EnvVar{Name: k, Value: v})
+		}
+	}
+	sort.Slice(env, func(a, b int) bool { return env[a].Name < env[b].Name })
 	return
 }
 
+// withoutAWSEnvValues returns a copy of the container without the values of the AWS_* env vars,
+// so that rotated credentials, e.g. AWS_SESSION_TOKEN, are not a spec drift
+func withoutAWSEnvValues(c corev1.Container) corev1.Container {
+	c.Env = append([]corev1.EnvVar{}, c.Env...)
+	for i := range c.Env {
+		if strings.HasPrefix(c.Env[i].Name, "AWS_") {
+			c.Env[i].Value = ""
+		}
+	}
+	return c
+}
+
+// Drifted returns true if the Job or CronJob exists and was created from a different spec than the last build
+func (j *JobBuilder) Drifted() bool {
+	return j.appliedHash != "" && j.appliedHash != j.specHash
+}
+
+func (j *JobBuilder) buildCronJob() {
+	if j.CronJob == nil {
+		j.CronJob = &batchv1.CronJob{}
+	}
+	j.CronJob.Namespace = j.Namespace
+	j.CronJob.Name = j.Name
+	if j.CronJob.Annotations == nil {
+		j.CronJob.Annotations = make(map[string]string)
+	}
+	j.CronJob.Annotations[SpecHashAnnotation] = j.specHash
+	j.CronJob.Spec.Schedule = j.Schedule
+	// runs share the same data object, so they must not overlap by default
+	j.CronJob.Spec.ConcurrencyPolicy = must.Default(j.ConcurrencyPolicy, batchv1.ForbidConcurrent)
+	j.CronJob.Spec.JobTemplate.Labels = j.Job.Labels
+	j.CronJob.Spec.JobTemplate.Annotations = j.Job.Annotations
+	j.CronJob.Spec.JobTemplate.Spec = j.Job.Spec
+	if j.Retention.KeepRuns > 0 {
+		j.CronJob.Spec.SuccessfulJobsHistoryLimit = ptr.Of(j.Retention.KeepRuns)
+		j.CronJob.Spec.FailedJobsHistoryLimit = ptr.Of(j.Retention.KeepRuns)
+	}
+}
+
+func upsertByName[T any](items []T, item T, name func(T) string) []T {
+	for i := range items {
+		if name(items[i]) == name(item) {
+			items[i] = item
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// IndexObjectKey returns the data object key of the given completion index of an Indexed Job
+func (j *JobBuilder) IndexObjectKey(index int) string {
+	return strings.TrimSuffix(j.ObjectKey, ".tar.gz") + "/" + strconv.Itoa(index) + ".tar.gz"
+}
+
+// OutputObjectKeys returns the data objects uploaded by the job, one per completion index of an Indexed Job
+func (j *JobBuilder) OutputObjectKeys() []string {
+	if !j.Indexed {
+		return []string{j.ObjectKey}
+	}
+	completions := 1
+	if j.Completions != nil {
+		completions = int(*j.Completions)
+	}
+	keys := make([]string, completions)
+	for i := range keys {
+		keys[i] = j.IndexObjectKey(i)
+	}
+	return keys
+}
+
+// Succeeded returns true if the Job has completed successfully
+func (j *JobBuilder) Succeeded() bool {
+	return jobHasCondition(j.Job, batchv1.JobComplete)
+}
+
+// Failed returns true if the Job has failed after exhausting its retries
+func (j *JobBuilder) Failed() bool {
+	return jobHasCondition(j.Job, batchv1.JobFailed)
+}
+
+func jobHasCondition(job *batchv1.Job, typ batchv1.JobConditionType) bool {
+	if job == nil {
+		return false
+	}
+	for _, c := range job.Status.Conditions {
+		if c.Type == typ && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JobBuilder) podLabels() map[string]string {
+	if j.Schedule != "" {
+		return map[string]string{LabelName: j.Name}
+	}
+	return map[string]string{batchv1.JobNameLabel: j.Name}
+}
+
+func (j *JobBuilder) podLabelSelector() string {
+	return labels.SelectorFromSet(j.podLabels()).String()
+}
+
+func (j *JobBuilder) objectMeta() metav1.ObjectMeta {
+	return metav1.ObjectMeta{Namespace: j.Namespace, Name: j.Name}
+}
+
 func (j *JobBuilder) getServiceAccount(ctx context.Context) (*corev1.ServiceAccount, error) {
 	err := j.initClient()
 	if err != nil {
 		return nil, err
 	}
-	return j.clientset.CoreV1().ServiceAccounts(j.Namespace).Get(ctx, j.ServiceAccount, metav1.GetOptions{})
+	sa := &corev1.ServiceAccount{}
+	err = j.Client.Get(ctx, client.ObjectKey{Namespace: j.Namespace, Name: j.ServiceAccount}, sa)
+	return sa, err
 }
 
+// Get fetches the Job, CronJob and script ConfigMap, missing objects are left empty
 func (j *JobBuilder) Get(ctx context.Context) (err error) {
 	j.initDefaults()
 	err = j.initClient()
 	if err != nil {
 		return
 	}
-	job, _ := j.clientset.BatchV1().Jobs(j.Namespace).Get(ctx, j.Name, metav1.GetOptions{})
-	// if err != nil && !apierrors.IsNotFound(err) && !strings.Contains(err.Error(), "not found") {
-	// 	return
-	// }
-	j.Job = job
-	cm, _ := j.clientset.CoreV1().ConfigMaps(j.Namespace).Get(ctx, j.Name, metav1.GetOptions{})
-	// if err != nil && !apierrors.IsNotFound(err) && !strings.Contains(err.Error(), "not found") {
-	// 	return
-	// }
-	j.ScriptCM = cm
-	return
+	key := client.ObjectKey{Namespace: j.Namespace, Name: j.Name}
+	j.Job = &batchv1.Job{}
+	if err = j.Client.Get(ctx, key, j.Job); client.IgnoreNotFound(err) != nil {
+		return
+	}
+	j.ScriptCM = &corev1.ConfigMap{}
+	if err = j.Client.Get(ctx, key, j.ScriptCM); client.IgnoreNotFound(err) != nil {
+		return
+	}
+	if j.Schedule != "" {
+		j.CronJob = &batchv1.CronJob{}
+		if err = j.Client.Get(ctx, key, j.CronJob); client.IgnoreNotFound(err) != nil {
+			return
+		}
+	}
+	return nil
 }
 
 func (j *JobBuilder) Destroy(ctx context.Context, delJob bool) (err error) {
@@ -321,18 +724,18 @@ func (j *JobBuilder) Destroy(ctx context.Context, delJob bool) (err error) {
 	if err != nil {
 		return
 	}
-	delOP := metav1.DeleteOptions{PropagationPolicy: ptr.Of(metav1.DeletePropagationForeground)}
-	if delJob {
-		err = j.clientset.BatchV1().Jobs(j.Namespace).Delete(ctx, j.Name, delOP)
+	delOP := client.PropagationPolicy(metav1.DeletePropagationForeground)
+	if delJob && j.Schedule != "" {
+		err = j.Client.Delete(ctx, &batchv1.CronJob{ObjectMeta: j.objectMeta()}, delOP)
+	} else if delJob {
+		err = j.Client.Delete(ctx, &batchv1.Job{ObjectMeta: j.objectMeta()}, delOP)
 	} else {
-		err = j.clientset.CoreV1().Pods(j.Namespace).DeleteCollection(ctx, delOP, metav1.ListOptions{
-			LabelSelector: batchv1.JobNameLabel + "=" + j.Name,
-		})
+		err = j.Client.DeleteAllOf(ctx, &corev1.Pod{}, client.InNamespace(j.Namespace), client.MatchingLabels(j.podLabels()), delOP)
 	}
 	if err != nil && !apierrors.IsNotFound(err) {
 		return
 	}
-	err = j.clientset.CoreV1().ConfigMaps(j.Namespace).Delete(ctx, j.Name, delOP)
+	err = j.Client.Delete(ctx, &corev1.ConfigMap{ObjectMeta: j.objectMeta()}, delOP)
 	if err != nil && !apierrors.IsNotFound(err) {
 		return
 	}
@@ -344,7 +747,22 @@ func (j *JobBuilder) DeleteData(ctx context.Context) (err error) {
 	if err != nil {
 		return
 	}
-	return j.BucketManager.DeleteSingle(ctx, j.ObjectKey)
+	if j.Indexed {
+		_, err = j.BucketManager.Delete(ctx, j.bucketKey(strings.TrimSuffix(j.ObjectKey, ".tar.gz"))+"/")
+		if err != nil {
+			return
+		}
+	}
+	if err = j.BucketManager.DeleteSingle(ctx, j.bucketKey(j.ObjectKey)); err != nil {
+		return
+	}
+	return j.BucketManager.DeleteSingle(ctx, j.bucketKey(ChecksumKey(j.ObjectKey)))
+}
+
+// bucketKey returns the key of the object in the bucket, the uploads of the BucketManager prefix their keys with its Prefix
+// while the other operations take them as is
+func (j *JobBuilder) bucketKey(key string) string {
+	return filepath.Join(j.BucketManager.Prefix, key)
 }
 
 func (j *JobBuilder) CreateOrUpdate(ctx context.Context) (err error) {
@@ -353,38 +771,136 @@ func (j *JobBuilder) CreateOrUpdate(ctx context.Context) (err error) {
 		return
 	}
 
-	_, err = j.clientset.CoreV1().ConfigMaps(j.Namespace).Create(ctx, j.ScriptCM, metav1.CreateOptions{})
-	if err != nil {
-		_, err = j.clientset.CoreV1().ConfigMaps(j.Namespace).Update(ctx, j.ScriptCM, metav1.UpdateOptions{})
+	if j.Schedule == "" && j.Drifted() {
+		switch j.DriftPolicy {
+		case DriftRecreateWhenNotRunning:
+			if j.Job.Status.Active > 0 {
+				return ErrJobRunning
+			}
+		case DriftRecreate:
+		default:
+			log.FromContext(ctx).Info("job spec drifted, keeping the existing job", "job", j.Name, "namespace", j.Namespace)
+			return nil
+		}
+		if err = j.resetJob(ctx); err != nil {
+			return
+		}
 	}
+
+	err = createOrPatch(ctx, j.Client, j.ScriptCM, func(desired *corev1.ConfigMap) {
+		j.ScriptCM.Data = desired.Data
+	})
 	if err != nil {
 		return
 	}
 
-	_, err = j.clientset.BatchV1().Jobs(j.Namespace).Create(ctx, j.Job, metav1.CreateOptions{})
-	if err != nil {
-		_, err = j.clientset.BatchV1().Jobs(j.Namespace).Update(ctx, j.Job, metav1.UpdateOptions{})
+	if j.Schedule != "" {
+		if err = j.setOwner(j.CronJob); err != nil {
+			return
+		}
+		err = createOrPatch(ctx, j.Client, j.CronJob, func(desired *batchv1.CronJob) {
+			maputil.MergeOverwrite(&j.CronJob.Annotations, desired.Annotations)
+			j.CronJob.OwnerReferences = desired.OwnerReferences
+			j.CronJob.Spec = desired.Spec
+		})
+	} else {
+		if err = j.setOwner(j.Job); err != nil {
+			return
+		}
+		err = createOrPatch(ctx, j.Client, j.Job, func(desired *batchv1.Job) {
+			maputil.MergeOverwrite(&j.Job.Annotations, desired.Annotations)
+			j.Job.OwnerReferences = desired.OwnerReferences
+			j.Job.Spec = desired.Spec
+		})
 	}
 	if err != nil {
 		return
 	}
 
-	err = j.Get(ctx)
-	if err != nil {
-		return
-	}
 	// set configmap's owner to job
-	j.ScriptCM.OwnerReferences = []metav1.OwnerReference{{
-		APIVersion: "batch/v1",
-		Kind:       "Job",
-		Name:       j.Name,
-		UID:        j.Job.UID,
-	}}
-	_, err = j.clientset.CoreV1().ConfigMaps(j.Namespace).Update(ctx, j.ScriptCM, metav1.UpdateOptions{})
+	owner := metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: j.Name, UID: j.Job.UID}
+	if j.Schedule != "" {
+		owner.Kind = "CronJob"
+		owner.UID = j.CronJob.UID
+	}
+	_, err = specutil.Patch(ctx, j.Client, j.ScriptCM, func() error {
+		j.ScriptCM.OwnerReferences = []metav1.OwnerReference{owner}
+		return nil
+	})
 	return
 }
 
+// jobGeneratedLabels are the labels the API server adds to a Job and its pod template
+var jobGeneratedLabels = []string{batchv1.ControllerUidLabel, batchv1.JobNameLabel, "controller-uid", "job-name"}
+
+// resetJob deletes the existing Job and its pods but keeps the data object, and strips the fields
+// generated by the API server from the built Job so that it can be created again.
+// The template of a Job is immutable, so ErrJobDeleting is returned until the Job and its pods are gone.
+func (j *JobBuilder) resetJob(ctx context.Context) error {
+	err := j.Client.Delete(ctx, &batchv1.Job{ObjectMeta: j.objectMeta()}, client.PropagationPolicy(metav1.DeletePropagationForeground))
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	err = j.Client.Get(ctx, client.ObjectKey{Namespace: j.Namespace, Name: j.Name}, &batchv1.Job{})
+	if err == nil {
+		return ErrJobDeleting
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	for _, l := range jobGeneratedLabels {
+		delete(j.Job.Labels, l)
+		delete(j.Job.Spec.Template.Labels, l)
+	}
+	j.Job.ObjectMeta = metav1.ObjectMeta{
+		Namespace:   j.Namespace,
+		Name:        j.Name,
+		Labels:      j.Job.Labels,
+		Annotations: j.Job.Annotations,
+	}
+	j.Job.Spec.Selector = nil
+	j.Job.Status = batchv1.JobStatus{}
+	if j.Queue != nil {
+		j.Job.Spec.Suspend = ptr.Of(true)
+	}
+	j.appliedHash = ""
+	return nil
+}
+
+func (j *JobBuilder) setOwner(obj client.Object) error {
+	if j.Owner == nil {
+		return nil
+	}
+	return controllerutil.SetControllerReference(j.Owner, obj, j.Client.Scheme())
+}
+
+// createOrPatch creates obj if it has not been fetched from the cluster, otherwise it patches the
+// existing object with the fields copied by mutate from the desired state
+func createOrPatch[T client.Object](ctx context.Context, c client.Client, obj T, mutate func(desired T)) error {
+	if obj.GetResourceVersion() == "" {
+		err := c.Create(ctx, obj)
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	desired := obj.DeepCopyObject().(T)
+	_, err := specutil.Patch(ctx, c, obj, func() error {
+		mutate(desired)
+		return nil
+	})
+	return err
+}
+
 func (j *JobBuilder) UploadData(ctx context.Context, src ...string) (err error) {
+	return j.uploadData(ctx, j.ObjectKey, src...)
+}
+
+// UploadIndexData uploads the data produced by the given completion index of an Indexed Job
+func (j *JobBuilder) UploadIndexData(ctx context.Context, index int, src ...string) (err error) {
+	return j.uploadData(ctx, j.IndexObjectKey(index), src...)
+}
+
+func (j *JobBuilder) uploadData(ctx context.Context, key string, src ...string) (err error) {
 	if len(src) == 0 {
 		src = []string{j.LocalDir}
 	}
@@ -396,16 +912,29 @@ func (j *JobBuilder) UploadData(ctx context.Context, src ...string) (err error)
 	if err != nil {
 		return
 	}
-	tempfile := must.Two(os.CreateTemp("", "jobutil-*.tar.gz"))
-	_ = tempfile.Close()
-	defer func() {
-		_ = os.Remove(tempfile.Name())
-	}()
-	err = targz.Compress(src[0], tempfile.Name())
+	metadata, err := j.dataOwnerMetadata()
+	if err != nil {
+		return
+	}
+	h := sha256.New()
+	_, err = j.BucketManager.UploadStream(ctx, key, func(w io.Writer) error {
+		return targz.CompressTo(src[0], io.MultiWriter(w, h))
+	}, &s3util.UploadOptions{ContentType: "application/gzip", Metadata: metadata})
 	if err != nil {
 		return
 	}
-	_, err = j.BucketManager.Upload(ctx, tempfile.Name(), j.ObjectKey, nil, nil)
+	sum := hextool.Encode(h.Sum(nil))
+	_, err = j.BucketManager.UploadReader(ctx, ChecksumKey(key), strings.NewReader(sum), ChecksumKey(key), &s3util.UploadOptions{
+		ContentType: "text/plain",
+		Metadata:    metadata,
+	})
+	if err != nil {
+		// the checksum of the previous data would fail the restore of the new one
+		if delErr := j.BucketManager.DeleteSingle(ctx, j.bucketKey(ChecksumKey(key))); delErr != nil {
+			log.FromContext(ctx).Error(delErr, "failed to delete the stale checksum", "key", key)
+		}
+		return errors.Wrapf(err, "failed to upload the checksum of %s", key)
+	}
 	return
 }
 
@@ -418,10 +947,19 @@ func (j *JobBuilder) ObjectInfo(ctx context.Context) (info s3util.HeadObjectOutp
 	if err != nil {
 		return
 	}
-	return j.BucketManager.HeadObject(ctx, j.ObjectKey)
+	return j.BucketManager.HeadObject(ctx, j.bucketKey(j.ObjectKey))
 }
 
 func (j *JobBuilder) DownloadData(ctx context.Context, dest ...string) (err error) {
+	return j.downloadData(ctx, j.ObjectKey, dest...)
+}
+
+// DownloadIndexData downloads the data uploaded by the given completion index of an Indexed Job
+func (j *JobBuilder) DownloadIndexData(ctx context.Context, index int, dest ...string) (err error) {
+	return j.downloadData(ctx, j.IndexObjectKey(index), dest...)
+}
+
+func (j *JobBuilder) downloadData(ctx context.Context, key string, dest ...string) (err error) {
 	err = j.initClient()
 	if err != nil {
 		return
@@ -429,30 +967,110 @@ func (j *JobBuilder) DownloadData(ctx context.Context, dest ...string) (err erro
 	if len(dest) == 0 {
 		dest = []string{j.LocalDir}
 	}
-	tempfile := must.Two(os.CreateTemp("", "jobutil-*.tar.gz"))
-	defer func() {
-		_ = os.Remove(tempfile.Name())
-	}()
-	_, err = j.BucketManager.DownloadWriter(ctx, j.ObjectKey, tempfile)
+	r, err := j.BucketManager.Open(ctx, j.bucketKey(key))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	expected, err := j.dataChecksum(ctx, key, r.Head)
 	if err != nil {
 		return
 	}
-	_ = tempfile.Close()
-	// untar tar.gz to dest dir
+	// untar tar.gz to a staging dir next to dest while downloading it, and move it into dest once verified,
+	// so that corrupted data leaves nothing behind
 	err = os.MkdirAll(dest[0], 0o755)
 	if err != nil {
 		return
 	}
-	return targz.Extract(tempfile.Name(), dest[0])
+	staging, err := os.MkdirTemp(filepath.Dir(filepath.Clean(dest[0])), "."+filepath.Base(dest[0])+"-restore-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(staging)
+	h := sha256.New()
+	var size byteCounter
+	data := io.TeeReader(r, io.MultiWriter(h, &size))
+	if err = targz.ExtractFrom(data, staging); err != nil {
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = errors.Wrap(ErrDataCorrupted, err.Error())
+		}
+		return errors.Wrapf(err, "failed to extract %s", key)
+	}
+	if _, err = io.Copy(io.Discard, data); err != nil {
+		return
+	}
+	if err = verifyData(int64(size), hextool.Encode(h.Sum(nil)), expected, r); err != nil {
+		return errors.Wrapf(err, "failed to verify %s", key)
+	}
+	return mergeDir(staging, dest[0])
+}
+
+// dataChecksum returns the SHA256 of the data archive at key from its sidecar object,
+// or from its metadata if it was uploaded by a previous version
+func (j *JobBuilder) dataChecksum(ctx context.Context, key string, head s3util.HeadObjectOutput) (string, error) {
+	r, err := j.BucketManager.Open(ctx, j.bucketKey(ChecksumKey(key)))
+	if s3util.IsNotFound(err) {
+		return head.Metadata[ChecksumMetadataKey], nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	sum, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(sum)), nil
+}
+
+// mergeDir moves the content of src into dst, replacing the existing files
+func mergeDir(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if !d.IsDir() {
+			return os.Rename(p, target)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.MkdirAll(target, info.Mode().Perm())
+	})
+}
+
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// verifyData checks the downloaded archive against the size and checksum of the object,
+// objects uploaded without checksum are only checked for truncation and by the gzip checksum
+func verifyData(size int64, sum, expected string, r *s3util.ObjectReader) error {
+	if size != r.Size() {
+		return errors.Wrapf(ErrDataCorrupted, "truncated, got %d of %d bytes", size, r.Size())
+	}
+	if expected != "" && sum != expected {
+		return errors.Wrapf(ErrDataCorrupted, "sha256 mismatch, expected %s, got %s", expected, sum)
+	}
+	return nil
 }
 
 func (j *JobBuilder) GetLogs(ctx context.Context) (string, error) {
-	err := j.initClient()
+	err := j.initClientset()
 	if err != nil {
 		return "", err
 	}
-	pods, err := j.clientset.CoreV1().Pods(j.Namespace).List(ctx, metav1.ListOptions{
-		LabelSelector: batchv1.JobNameLabel + "=" + j.Name,
+	pods, err := j.Clientset.CoreV1().Pods(j.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: j.podLabelSelector(),
 	})
 	if err != nil {
 		return "", err
@@ -460,7 +1078,7 @@ func (j *JobBuilder) GetLogs(ctx context.Context) (string, error) {
 	if len(pods.Items) == 0 {
 		return "", nil
 	}
-	req := j.clientset.CoreV1().Pods(j.Namespace).GetLogs(pods.Items[0].Name, &corev1.PodLogOptions{
+	req := j.Clientset.CoreV1().Pods(j.Namespace).GetLogs(pods.Items[0].Name, &corev1.PodLogOptions{
 		Container:  "workload",
 		TailLines:  ptr.Of(int64(1024)),
 		LimitBytes: ptr.Of(int64(1024 * 1024)),
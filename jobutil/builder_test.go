@@ -0,0 +1,294 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/alt-research/operator-kit/targz"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func newTestBuilder(t *testing.T, objs ...client.Object) *JobBuilder {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "runner"}}
+	c := fake.NewClientBuilder().WithObjects(append(objs, sa)...).Build()
+	bm, err := s3util.NewManagerWithClient(awss3.New(awss3.Options{Region: "us-east-1"}), "test", "", 1)
+	require.NoError(t, err)
+	return &JobBuilder{
+		Client:         c,
+		BucketManager:  bm,
+		Name:           "job",
+		Namespace:      "test",
+		Image:          "busybox",
+		Script:         "echo hello",
+		ServiceAccount: "runner",
+	}
+}
+
+func TestBuilderCreateOrUpdate(t *testing.T) {
+	ctx := context.Background()
+	owner := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "owner", UID: "owner-uid"}}
+	j := newTestBuilder(t, owner)
+	j.Owner = owner
+
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+
+	job := &batchv1.Job{}
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	assert.Equal(t, "runner", job.Spec.Template.Spec.ServiceAccountName)
+	assert.Equal(t, "job", job.Spec.Template.Labels[LabelName])
+	require.Len(t, job.OwnerReferences, 1)
+	assert.Equal(t, "owner", job.OwnerReferences[0].Name)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, cm))
+	assert.Equal(t, "echo hello", cm.Data["starter.sh"])
+	require.Len(t, cm.OwnerReferences, 1)
+	assert.Equal(t, "Job", cm.OwnerReferences[0].Kind)
+
+	// unchanged spec does not drift
+	require.NoError(t, j.Build(ctx))
+	assert.False(t, j.Drifted())
+
+	// drifted job is left untouched by default
+	j.Script = "echo world"
+	j.Image = "alpine"
+	require.NoError(t, j.Build(ctx))
+	assert.True(t, j.Drifted())
+	require.NoError(t, j.CreateOrUpdate(ctx))
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	assert.Equal(t, "busybox", job.Spec.Template.Spec.Containers[0].Image)
+
+	j.DriftPolicy = DriftRecreate
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	assert.Equal(t, "alpine", job.Spec.Template.Spec.Containers[0].Image)
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, cm))
+	assert.Equal(t, "echo world", cm.Data["starter.sh"])
+	require.NoError(t, j.Build(ctx))
+	assert.False(t, j.Drifted())
+
+	require.NoError(t, j.Destroy(ctx, true))
+	assert.True(t, apierrors.IsNotFound(j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job)))
+}
+
+func TestBuilderDriftRecreate(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("AWS_SESSION_TOKEN", "token-1")
+	j := newTestBuilder(t)
+	j.DriftPolicy = DriftRecreate
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+
+	// rotated credentials are not a drift
+	t.Setenv("AWS_SESSION_TOKEN", "token-2")
+	require.NoError(t, j.Build(ctx))
+	assert.False(t, j.Drifted())
+
+	// the job is recreated only once its deletion has completed
+	job := &batchv1.Job{}
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	job.Finalizers = []string{"test/block"}
+	require.NoError(t, j.Client.Update(ctx, job))
+	j.Image = "alpine"
+	require.NoError(t, j.Build(ctx))
+	assert.ErrorIs(t, j.CreateOrUpdate(ctx), ErrJobDeleting)
+
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	job.Finalizers = nil
+	require.NoError(t, j.Client.Update(ctx, job))
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, job))
+	assert.Equal(t, "alpine", job.Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestBuilderCronJobAndIndexed(t *testing.T) {
+	ctx := context.Background()
+	j := newTestBuilder(t)
+	j.Schedule = "*/5 * * * *"
+	j.Indexed = true
+	j.Completions = ptr.Of(int32(3))
+
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+
+	cronJob := &batchv1.CronJob{}
+	require.NoError(t, j.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "job"}, cronJob))
+	assert.Equal(t, batchv1.ForbidConcurrent, cronJob.Spec.ConcurrencyPolicy)
+	assert.Equal(t, batchv1.IndexedCompletion, *cronJob.Spec.JobTemplate.Spec.CompletionMode)
+	assert.Equal(t, "jobutil/test/job/2.tar.gz", j.IndexObjectKey(2))
+}
+
+func TestBuilderPodCustomization(t *testing.T) {
+	ctx := context.Background()
+	j := newTestBuilder(t)
+	j.PodLabels = map[string]string{"team": "a"}
+	j.PodAnnotations = map[string]string{"note": "a"}
+	j.Volumes = []corev1.Volume{{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+	j.VolumeMounts = []corev1.VolumeMount{{Name: "cache", MountPath: "/cache"}}
+	require.NoError(t, j.Build(ctx))
+
+	spec := j.Job.Spec.Template.Spec
+	assert.Contains(t, spec.Volumes, j.Volumes[0])
+	for _, c := range append(spec.InitContainers, spec.Containers...) {
+		assert.Contains(t, c.VolumeMounts, j.VolumeMounts[0], c.Name)
+	}
+
+	// removed entries are dropped, the labels generated by the API server are kept
+	require.NoError(t, j.CreateOrUpdate(ctx))
+	j.Job.Spec.Template.Labels[batchv1.JobNameLabel] = "job"
+	require.NoError(t, j.Client.Update(ctx, j.Job))
+	j.PodLabels = map[string]string{"tier": "b"}
+	j.PodAnnotations = nil
+	require.NoError(t, j.Build(ctx))
+	assert.Equal(t, map[string]string{batchv1.JobNameLabel: "job", LabelName: "job", "tier": "b"}, j.Job.Spec.Template.Labels)
+	assert.Empty(t, j.Job.Spec.Template.Annotations)
+}
+
+func TestBuilderGet(t *testing.T) {
+	ctx := context.Background()
+	j := newTestBuilder(t)
+	j.Schedule = "*/5 * * * *"
+
+	// missing objects are left empty
+	require.NoError(t, j.Get(ctx))
+	assert.Empty(t, j.CronJob.ResourceVersion)
+	assert.Empty(t, j.Job.ResourceVersion)
+
+	getErr := errors.New("apiserver unavailable")
+	j.Client = interceptor.NewClient(j.Client.(client.WithWatch), interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if _, ok := obj.(*batchv1.CronJob); ok {
+				return getErr
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+	assert.ErrorIs(t, j.Get(ctx), getErr)
+}
+
+func TestBuilderDataRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	j := newTestBuilder(t)
+	var err error
+	j.BucketManager, err = s3util.NewManagerWithClient(srv.Client(), "test", "", 1)
+	require.NoError(t, err)
+	j.initDefaults()
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "db"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "db", "state"), []byte("block 42"), 0o644))
+	require.NoError(t, j.UploadData(ctx, src))
+	info, err := j.ObjectInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "application/gzip", *info.ContentType)
+	sum, ok := srv.GetObject("test", ChecksumKey(j.ObjectKey))
+	require.True(t, ok)
+	assert.Len(t, string(sum), 66)
+
+	dst := t.TempDir()
+	require.NoError(t, j.DownloadData(ctx, dst))
+	data, err := os.ReadFile(filepath.Join(dst, filepath.Base(src), "db", "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "block 42", string(data))
+
+	// replaced by a corrupted archive keeping the checksum of the original
+	srv.PutObject("test", j.ObjectKey, []byte("not a gzip archive"), info.Metadata)
+	err = j.DownloadData(ctx, t.TempDir())
+	assert.ErrorIs(t, err, ErrDataCorrupted)
+
+	// replaced by a valid archive of other data keeping the checksum of the original,
+	// nothing is extracted into the destination
+	require.NoError(t, os.WriteFile(filepath.Join(src, "db", "state"), []byte("block 43"), 0o644))
+	archive := &bytes.Buffer{}
+	require.NoError(t, targz.CompressTo(src, archive))
+	srv.PutObject("test", j.ObjectKey, archive.Bytes(), info.Metadata)
+	parent := t.TempDir()
+	dst = filepath.Join(parent, "data")
+	err = j.DownloadData(ctx, dst)
+	assert.ErrorIs(t, err, ErrDataCorrupted)
+	entries, err := os.ReadDir(dst)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// uploaded by a previous version with the checksum in its metadata
+	require.NoError(t, j.BucketManager.DeleteSingle(ctx, ChecksumKey(j.ObjectKey)))
+	srv.PutObject("test", j.ObjectKey, archive.Bytes(), map[string]string{ChecksumMetadataKey: string(sum)})
+	assert.ErrorIs(t, j.DownloadData(ctx, t.TempDir()), ErrDataCorrupted)
+
+	// the restored data is merged into the existing one
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "kept"), []byte("kept"), 0o644))
+	require.NoError(t, j.UploadData(ctx, src))
+	require.NoError(t, j.DownloadData(ctx, dst))
+	data, err = os.ReadFile(filepath.Join(dst, filepath.Base(src), "db", "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "block 43", string(data))
+	assert.FileExists(t, filepath.Join(dst, "kept"))
+
+	// client side encrypted, the object is larger than the archive
+	j.BucketManager.Encryption = &s3util.Encryption{ClientKey: bytes.Repeat([]byte{1}, 32)}
+	require.NoError(t, j.UploadData(ctx, src))
+	sealed, ok := srv.GetObject("test", j.ObjectKey)
+	require.True(t, ok)
+	assert.NotContains(t, string(sealed), "block 43")
+	dst = t.TempDir()
+	require.NoError(t, j.DownloadData(ctx, dst))
+	data, err = os.ReadFile(filepath.Join(dst, filepath.Base(src), "db", "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "block 43", string(data))
+}
+
+func TestBuilderDataPrefix(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	j := newTestBuilder(t)
+	var err error
+	j.BucketManager, err = s3util.NewManagerWithClient(srv.Client(), "test", "pre", 1)
+	require.NoError(t, err)
+	j.initDefaults()
+
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "state"), []byte("block 42"), 0o644))
+	require.NoError(t, j.UploadData(ctx, src))
+	assert.ElementsMatch(t, []string{"pre/" + j.ObjectKey, "pre/" + ChecksumKey(j.ObjectKey)}, srv.Keys("test"))
+	_, err = j.ObjectInfo(ctx)
+	require.NoError(t, err)
+
+	dst := t.TempDir()
+	require.NoError(t, j.DownloadData(ctx, dst))
+	data, err := os.ReadFile(filepath.Join(dst, filepath.Base(src), "state"))
+	require.NoError(t, err)
+	assert.Equal(t, "block 42", string(data))
+
+	require.NoError(t, j.DeleteData(ctx))
+	assert.Empty(t, srv.Keys("test"))
+}
@@ -0,0 +1,322 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/alt-research/operator-kit/must"
+	"github.com/alt-research/operator-kit/s3util"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Retention controls the cleanup done by JobBuilder.ApplyRetention
+type Retention struct {
+	// DataTTL deletes the data once it has not been updated for this duration and the Job has finished,
+	// or the CronJob has no running job. 0 keeps it
+	DataTTL time.Duration
+	// KeepRuns keeps the last N runs, that is the job history of a CronJob and the persisted logs
+	// of the last N attempts, 0 keeps all of them
+	KeepRuns int32
+	// DeleteDataOnSuccess deletes the data once the Job has succeeded, it is ignored for CronJobs
+	DeleteDataOnSuccess bool
+}
+
+// LifecycleRule returns a bucket lifecycle rule expiring the data and logs of all jobs days after their upload,
+// to be given to s3util.BucketManager.EnsureBucket as a safety net for the jobs never garbage collected
+func LifecycleRule(expireDays int32) s3util.LifecycleRule {
+	return s3util.LifecycleRule{
+		ID:                        "operator-kit-jobutil",
+		Prefix:                    s3KeyPrefix + "/",
+		ExpireDays:                expireDays,
+		NoncurrentExpireDays:      1,
+		AbortIncompleteUploadDays: 1,
+	}
+}
+
+// ApplyRetention deletes the data and persisted logs of the job according to Retention,
+// it should be called on every reconcile after CreateOrUpdate
+func (j *JobBuilder) ApplyRetention(ctx context.Context) (err error) {
+	if err = j.Get(ctx); err != nil {
+		return
+	}
+	if j.Retention.KeepRuns > 0 && j.PersistLogs {
+		if err = j.pruneAttempts(ctx, int(j.Retention.KeepRuns)); err != nil {
+			return
+		}
+	}
+	if j.Retention.DeleteDataOnSuccess && j.Schedule == "" && j.Succeeded() {
+		return j.DeleteData(ctx)
+	}
+	if j.Retention.DataTTL <= 0 || j.inUse() {
+		return nil
+	}
+	objs, err := j.dataObjects(ctx)
+	if err != nil || len(objs) == 0 {
+		return
+	}
+	if time.Since(lastModified(objs)) > j.Retention.DataTTL {
+		log.FromContext(ctx).Info("deleting expired job data", "job", j.Name, "key", j.ObjectKey)
+		return j.DeleteData(ctx)
+	}
+	return nil
+}
+
+// inUse returns true while the Job has not finished, including while it is suspended in a queue,
+// or while the CronJob has a running job
+func (j *JobBuilder) inUse() bool {
+	if j.Schedule != "" {
+		return j.CronJob != nil && len(j.CronJob.Status.Active) > 0
+	}
+	return j.Job != nil && j.Job.ResourceVersion != "" && !jobDone(j.Job)
+}
+
+// pruneAttempts deletes the persisted logs of all attempts but the last keep ones
+func (j *JobBuilder) pruneAttempts(ctx context.Context, keep int) error {
+	attempts, err := j.ListAttempts(ctx)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(attempts)-keep; i++ {
+		for _, key := range []string{attempts[i].LogKey, attempts[i].StatusKey} {
+			if key == "" {
+				continue
+			}
+			if err = j.BucketManager.DeleteSingle(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dataObjects lists the data object of the job and those of its completion indexes, with their checksums
+func (j *JobBuilder) dataObjects(ctx context.Context) ([]s3util.ObjectInfo, error) {
+	dir := strings.TrimSuffix(j.ObjectKey, ".tar.gz")
+	objs, err := j.BucketManager.List(ctx, dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	var data []s3util.ObjectInfo
+	for _, o := range objs {
+		if o.Key == j.ObjectKey || o.Key == ChecksumKey(j.ObjectKey) || strings.HasPrefix(o.Key, dir+"/") {
+			data = append(data, o)
+		}
+	}
+	return data, nil
+}
+
+func lastModified(objs []s3util.ObjectInfo) (last time.Time) {
+	for _, o := range objs {
+		if o.LastModified.After(last) {
+			last = o.LastModified
+		}
+	}
+	return
+}
+
+// GarbageCollector deletes the finished jobs built by JobBuilder once they are past FinishedJobTTL,
+// and the data and persisted logs stored under the jobutil prefix whose Job or CronJob no longer exists,
+// unless the data owner recorded in their metadata still exists, see JobBuilder.DataOwner
+type GarbageCollector struct {
+	Client        client.Client
+	BucketManager *s3util.BucketManager
+	// Namespace restricts the collection to a namespace, all namespaces are collected by default
+	Namespace string
+	// MinAge protects the data uploaded before its job is created, defaults to 1 hour
+	MinAge time.Duration
+	// FinishedJobTTL deletes the Jobs finished for longer than this duration, their data is deleted
+	// along with the orphaned data, Jobs owned by a CronJob are left to its history limits. 0 keeps them
+	FinishedJobTTL time.Duration
+	// DryRun only reports what would be deleted
+	DryRun bool
+}
+
+// GCResult lists what a garbage collection deleted, as "<namespace>/<name>" Jobs and object keys
+type GCResult struct {
+	Jobs    []string
+	Objects []string
+}
+
+// Run collects the garbage once, it is meant to be called periodically
+func (gc *GarbageCollector) Run(ctx context.Context) (*GCResult, error) {
+	logger := log.FromContext(ctx)
+	rst := &GCResult{}
+	owners, expired, err := gc.collectJobs(ctx)
+	if err != nil {
+		return rst, err
+	}
+	for _, job := range expired {
+		rst.Jobs = append(rst.Jobs, job.Namespace+"/"+job.Name)
+		if gc.DryRun {
+			continue
+		}
+		logger.Info("deleting finished job", "namespace", job.Namespace, "job", job.Name)
+		err = gc.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationForeground))
+		if client.IgnoreNotFound(err) != nil {
+			return rst, err
+		}
+	}
+
+	prefix := s3KeyPrefix + "/"
+	if gc.Namespace != "" {
+		prefix += gc.Namespace + "/"
+	}
+	objs, err := gc.BucketManager.List(ctx, prefix, nil)
+	if err != nil {
+		return rst, err
+	}
+	orphans := map[string][]s3util.ObjectInfo{}
+	for _, o := range objs {
+		ns, name, ok := parseObjectKey(o.Key)
+		if !ok || owners[ns+"/"+name] {
+			continue
+		}
+		orphans[ns+"/"+name] = append(orphans[ns+"/"+name], o)
+	}
+	minAge := must.Default(gc.MinAge, time.Hour)
+	for owner, objs := range orphans {
+		// the data of a job is deleted as a whole, once none of its objects is recent
+		if time.Since(lastModified(objs)) < minAge {
+			continue
+		}
+		owned, err := gc.hasDataOwner(ctx, objs)
+		if err != nil {
+			return rst, err
+		}
+		if owned {
+			continue
+		}
+		for _, o := range objs {
+			rst.Objects = append(rst.Objects, o.Key)
+			if gc.DryRun {
+				continue
+			}
+			logger.Info("deleting orphaned job data", "job", owner, "key", o.Key)
+			if err = gc.BucketManager.DeleteSingle(ctx, o.Key); err != nil {
+				return rst, err
+			}
+		}
+	}
+	return rst, nil
+}
+
+// hasDataOwner returns true if the data owner recorded in the metadata of the data objects exists.
+// Owners whose kind is unknown to the client are assumed to exist.
+func (gc *GarbageCollector) hasDataOwner(ctx context.Context, objs []s3util.ObjectInfo) (bool, error) {
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Key, ".tar.gz") {
+			continue
+		}
+		head, err := gc.BucketManager.HeadObject(ctx, o.Key)
+		if err != nil {
+			if s3util.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		md := head.Metadata
+		if md[s3util.OwnerKindMetadataKey] == "" || md[s3util.OwnerNameMetadataKey] == "" {
+			continue
+		}
+		owner := &unstructured.Unstructured{}
+		owner.SetAPIVersion(md[s3util.OwnerAPIVersionMetadataKey])
+		owner.SetKind(md[s3util.OwnerKindMetadataKey])
+		key := client.ObjectKey{Namespace: md[s3util.OwnerNamespaceMetadataKey], Name: md[s3util.OwnerNameMetadataKey]}
+		err = gc.Client.Get(ctx, key, owner)
+		switch {
+		case apierrors.IsNotFound(err):
+			continue
+		case meta.IsNoMatchError(err) || runtime.IsNotRegisteredError(err):
+			return true, nil
+		case err != nil:
+			return false, err
+		}
+		// an owner recreated with the same name does not own the data of the previous one
+		if uid := md[s3util.OwnerUIDMetadataKey]; uid == "" || uid == string(owner.GetUID()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// collectJobs returns the "<namespace>/<name>" of the existing JobBuilder jobs and the Jobs past FinishedJobTTL
+func (gc *GarbageCollector) collectJobs(ctx context.Context) (owners map[string]bool, expired []*batchv1.Job, err error) {
+	owners = map[string]bool{}
+	cronJobs := &batchv1.CronJobList{}
+	if err = gc.Client.List(ctx, cronJobs, client.InNamespace(gc.Namespace)); err != nil {
+		return
+	}
+	for _, cj := range cronJobs.Items {
+		if name := cj.Spec.JobTemplate.Spec.Template.Labels[LabelName]; name != "" {
+			owners[cj.Namespace+"/"+name] = true
+		}
+	}
+	jobs := &batchv1.JobList{}
+	if err = gc.Client.List(ctx, jobs, client.InNamespace(gc.Namespace)); err != nil {
+		return
+	}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		name := job.Spec.Template.Labels[LabelName]
+		if name == "" {
+			continue
+		}
+		if owner := metav1.GetControllerOf(job); gc.FinishedJobTTL > 0 && (owner == nil || owner.Kind != "CronJob") {
+			if finished := jobFinishedAt(job); !finished.IsZero() && time.Since(finished) > gc.FinishedJobTTL {
+				expired = append(expired, job)
+				continue
+			}
+		}
+		owners[job.Namespace+"/"+name] = true
+	}
+	return
+}
+
+// jobFinishedAt returns the time the Job completed or failed, or zero if it is not finished
+func jobFinishedAt(job *batchv1.Job) time.Time {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return c.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// parseObjectKey returns the namespace and job name of a key stored by JobBuilder, that is
+// jobutil/<namespace>/<name>.tar.gz and its checksum jobutil/<namespace>/<name>.tar.gz.sha256, its completion
+// indexes jobutil/<namespace>/<name>/<index>.tar.gz and its persisted logs jobutil/<namespace>/<name>.tar.gz.logs/<attempt>
+func parseObjectKey(key string) (namespace, name string, ok bool) {
+	rel, ok := strings.CutPrefix(key, s3KeyPrefix+"/")
+	if !ok {
+		return
+	}
+	namespace, rel, ok = strings.Cut(rel, "/")
+	if !ok || namespace == "" {
+		return "", "", false
+	}
+	if before, _, found := strings.Cut(rel, ".tar.gz.logs/"); found {
+		name = before
+	} else if before, _, found := strings.Cut(rel, "/"); found {
+		name = before
+	} else {
+		name, ok = strings.CutSuffix(strings.TrimSuffix(rel, ".sha256"), ".tar.gz")
+	}
+	if !ok || name == "" {
+		return "", "", false
+	}
+	return namespace, name, true
+}
@@ -0,0 +1,149 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseObjectKey(t *testing.T) {
+	for key, want := range map[string][2]string{
+		"jobutil/test/job.tar.gz":                   {"test", "job"},
+		"jobutil/test/job/2.tar.gz":                 {"test", "job"},
+		"jobutil/test/job.tar.gz.sha256":            {"test", "job"},
+		"jobutil/test/job.sha256":                   {},
+		"jobutil/test/job.v2.tar.gz.logs/1-pod.log": {"test", "job.v2"},
+		"jobutil/test/job.txt":                      {},
+		"jobutil/job.tar.gz":                        {},
+		"other/test/job.tar.gz":                     {},
+	} {
+		ns, name, ok := parseObjectKey(key)
+		assert.Equal(t, want[0] != "", ok, key)
+		assert.Equal(t, want, [2]string{ns, name}, key)
+	}
+}
+
+func TestGarbageCollectorCollectJobs(t *testing.T) {
+	newJob := func(name string, finished time.Duration, cronJob bool) *batchv1.Job {
+		job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: name}}
+		job.Spec.Template.Labels = map[string]string{LabelName: name}
+		if finished > 0 {
+			job.Status.Conditions = []batchv1.JobCondition{{
+				Type: batchv1.JobComplete, Status: corev1.ConditionTrue,
+				LastTransitionTime: metav1.NewTime(time.Now().Add(-finished)),
+			}}
+		}
+		if cronJob {
+			job.OwnerReferences = []metav1.OwnerReference{{Kind: "CronJob", Name: name, Controller: ptr.Of(true)}}
+		}
+		return job
+	}
+	c := fake.NewClientBuilder().WithObjects(
+		newJob("running", 0, false),
+		newJob("recent", time.Minute, false),
+		newJob("expired", 48*time.Hour, false),
+		newJob("scheduled", 48*time.Hour, true),
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "foreign"}},
+	).Build()
+	gc := &GarbageCollector{Client: c, Namespace: "test", FinishedJobTTL: 24 * time.Hour}
+
+	owners, expired, err := gc.collectJobs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"test/running": true, "test/recent": true, "test/scheduled": true}, owners)
+	require.Len(t, expired, 1)
+	assert.Equal(t, "expired", expired[0].Name)
+}
+
+func TestGarbageCollectorRun(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	bm, err := s3util.NewManagerWithClient(srv.Client(), "test", "", 1)
+	require.NoError(t, err)
+
+	expired := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "expired"}}
+	expired.Spec.Template.Labels = map[string]string{LabelName: "expired"}
+	expired.Status.Conditions = []batchv1.JobCondition{{
+		Type: batchv1.JobComplete, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(time.Now().Add(-48 * time.Hour)),
+	}}
+	live := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "live"}}
+	live.Spec.Template.Labels = map[string]string{LabelName: "live"}
+	state := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "pipe-pipeline", UID: "uid-1"}}
+	c := fake.NewClientBuilder().WithObjects(expired, live, state).Build()
+
+	owner := func(uid string) map[string]string {
+		md := s3util.OwnerMetadata("ConfigMap", &metav1.ObjectMeta{Namespace: "test", Name: "pipe-pipeline", UID: types.UID(uid)})
+		md[s3util.OwnerAPIVersionMetadataKey] = "v1"
+		return md
+	}
+	srv.PutObject("test", "jobutil/test/expired.tar.gz", []byte("data"), nil)
+	srv.PutObject("test", "jobutil/test/live.tar.gz", []byte("data"), nil)
+	srv.PutObject("test", "jobutil/test/gone.tar.gz", []byte("data"), nil)
+	srv.PutObject("test", "jobutil/test/gone.tar.gz.logs/1-pod.log", []byte("log"), nil)
+	// stages of a pipeline whose Jobs are gone, the data stays while the pipeline exists
+	srv.PutObject("test", "jobutil/test/pipe-fetch/0.tar.gz", []byte("data"), owner("uid-1"))
+	srv.PutObject("test", "jobutil/test/pipe-build.tar.gz", []byte("data"), owner(""))
+	srv.PutObject("test", "jobutil/test/old-pipe.tar.gz", []byte("data"), owner("uid-0"))
+	srv.PutObject("test", "other/test/gone.tar.gz", []byte("data"), nil)
+	// the fake server orders the modification times of quick puts ahead of the clock
+	time.Sleep(20 * time.Millisecond)
+
+	gc := &GarbageCollector{Client: c, BucketManager: bm, Namespace: "test", MinAge: time.Nanosecond, FinishedJobTTL: 24 * time.Hour, DryRun: true}
+	rst, err := gc.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test/expired"}, rst.Jobs)
+	assert.ElementsMatch(t, []string{
+		"jobutil/test/expired.tar.gz", "jobutil/test/gone.tar.gz", "jobutil/test/gone.tar.gz.logs/1-pod.log", "jobutil/test/old-pipe.tar.gz",
+	}, rst.Objects)
+	assert.Len(t, srv.Keys("test"), 8)
+
+	gc.DryRun = false
+	_, err = gc.Run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"jobutil/test/live.tar.gz", "jobutil/test/pipe-build.tar.gz", "jobutil/test/pipe-fetch/0.tar.gz", "other/test/gone.tar.gz",
+	}, srv.Keys("test"))
+	assert.True(t, apierrors.IsNotFound(c.Get(ctx, client.ObjectKeyFromObject(expired), &batchv1.Job{})))
+}
+
+func TestApplyRetentionQueued(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	j := newTestBuilder(t)
+	var err error
+	j.BucketManager, err = s3util.NewManagerWithClient(srv.Client(), "test", "", 1)
+	require.NoError(t, err)
+	j.Queue = &Queue{Name: "exports", MaxRunning: 1}
+	j.Retention.DataTTL = time.Nanosecond
+	require.NoError(t, j.Build(ctx))
+	require.NoError(t, j.CreateOrUpdate(ctx))
+	srv.PutObject("test", j.ObjectKey, []byte("data"), nil)
+
+	// the data of a job waiting in its queue is kept
+	require.NoError(t, j.ApplyRetention(ctx))
+	assert.Equal(t, []string{j.ObjectKey}, srv.Keys("test"))
+
+	j.Job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	require.NoError(t, j.Client.Status().Update(ctx, j.Job))
+	require.NoError(t, j.ApplyRetention(ctx))
+	assert.Empty(t, srv.Keys("test"))
+}
@@ -0,0 +1,268 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alt-research/operator-kit/dockerutil"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// LocalRunOptions configures JobBuilder.RunLocal
+type LocalRunOptions struct {
+	// Docker is the docker client, defaults to a client configured from the environment
+	Docker *client.Client
+	// Index is the completion index to run when the job is Indexed
+	Index int
+	// Dir holds the data, marker and scripts dirs of the run, defaults to a temporary dir removed after the run
+	Dir string
+	// SkipPull uses the local images instead of pulling them
+	SkipPull bool
+	// Timeout applies to every container, defaults to the dockerutil default
+	Timeout time.Duration
+}
+
+// localContainer is a container of a local run, the local counterpart of a pod container
+type localContainer struct {
+	Name  string
+	Image string
+	Opts  dockerutil.ContainerOpts
+}
+
+// RunLocal runs the job with docker instead of Kubernetes, for development and integration tests.
+// The data is restored, the workload run and the data uploaded by the same scripts and storage backend
+// as in the cluster, the data dir being a local dir bind mounted in the containers.
+// The credentials are taken from the AWS_* env vars of the current process, an AWS_ENDPOINT on localhost
+// is reached through host.docker.internal.
+// Volumes, VolumeMounts, resources and scheduling settings are not supported and ignored.
+// It returns the output of the workload container, which is an error if the workload failed.
+func (j *JobBuilder) RunLocal(ctx context.Context, opts LocalRunOptions) (out *dockerutil.ContainerOutput, err error) {
+	j.initDefaults()
+	if j.bucket() == "" {
+		return nil, errors.New("bucket name is required")
+	}
+	if opts.Docker == nil {
+		opts.Docker, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return
+		}
+		defer opts.Docker.Close()
+	}
+	if opts.Dir == "" {
+		opts.Dir, err = os.MkdirTemp("", "jobutil-"+j.Name+"-*")
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(opts.Dir)
+	}
+	containers, err := j.localContainers(opts)
+	if err != nil {
+		return
+	}
+	// the containers run as root, the files they created are handed back to the current user
+	defer func() {
+		if err := j.chownLocalDir(opts); err != nil {
+			log.FromContext(ctx).Error(err, "failed to change the owner of the local run dir", "dir", opts.Dir)
+		}
+	}()
+	if !opts.SkipPull {
+		pulled := map[string]bool{}
+		for _, c := range containers {
+			if pulled[c.Image] {
+				continue
+			}
+			if err = dockerutil.PullImage(ctx, opts.Docker, c.Image, nil, nil); err != nil {
+				return nil, errors.Wrapf(err, "failed to pull image %s", c.Image)
+			}
+			pulled[c.Image] = true
+		}
+	}
+
+	download, workload, upload := containers[0], containers[1], containers[2]
+	if _, err = dockerutil.SimpleRun(ctx, opts.Docker, download.Image, download.Opts); err != nil {
+		return nil, errors.Wrap(err, "failed to download data")
+	}
+	// the workload waits for the uploader, which waits for the workload to finish, so when one
+	// of them fails without writing its marker the other one is stopped instead of waiting forever
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	markerDir := filepath.Join(opts.Dir, "marker")
+	var uploadErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, uploadErr = dockerutil.SimpleRun(runCtx, opts.Docker, upload.Image, upload.Opts)
+		if uploadErr != nil && !fileExists(filepath.Join(markerDir, "uploaded")) {
+			cancel()
+		}
+	}()
+	out, err = dockerutil.SimpleRun(runCtx, opts.Docker, workload.Image, workload.Opts)
+	if err != nil && !fileExists(filepath.Join(markerDir, "done")) {
+		cancel()
+	}
+	wg.Wait()
+	if uploadErr != nil && (err == nil || errors.Is(err, context.Canceled)) {
+		err = errors.Wrap(uploadErr, "failed to upload data")
+	}
+	return
+}
+
+// chownLocalDir gives the files of the local run dir to the current user
+func (j *JobBuilder) chownLocalDir(opts LocalRunOptions) error {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid <= 0 {
+		return nil
+	}
+	// the run may have been stopped by the cancellation of its context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := dockerutil.SimpleRun(ctx, opts.Docker, j.K8sToolImage, dockerutil.ContainerOpts{
+		Entrypoint: []string{"chown", "-R", fmt.Sprintf("%d:%d", uid, gid), "/local"},
+		Binds:      []string{opts.Dir + ":/local"},
+		Rm:         true,
+	})
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// localContainers prepares the dirs of a local run and returns its download, workload and upload containers
+func (j *JobBuilder) localContainers(opts LocalRunOptions) ([]localContainer, error) {
+	dataDir := filepath.Join(opts.Dir, "data")
+	markerDir := filepath.Join(opts.Dir, "marker")
+	scriptsDir := filepath.Join(opts.Dir, "scripts")
+	for _, dir := range []string{dataDir, markerDir, scriptsDir} {
+		if err := os.MkdirAll(dir, 0o777); err != nil {
+			return nil, err
+		}
+	}
+	scripts, err := j.scriptsData()
+	if err != nil {
+		return nil, err
+	}
+	for name, content := range scripts {
+		if err = os.WriteFile(filepath.Join(scriptsDir, name), []byte(content), 0o644); err != nil {
+			return nil, err
+		}
+	}
+
+	podName := j.Name + "-local"
+	if j.Indexed {
+		podName += "-" + strconv.Itoa(opts.Index)
+	}
+	common := []corev1.EnvVar{{Name: "POD_NAME", Value: podName}}
+	if j.Indexed {
+		common = append(common, corev1.EnvVar{Name: "JOB_COMPLETION_INDEX", Value: strconv.Itoa(opts.Index)})
+	}
+	dataVars, err := j.dataEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	dataEnv, err := localEnv(append(append(dataVars, common...), localAWSEnvVars()...))
+	if err != nil {
+		return nil, err
+	}
+	workloadVars, err := j.workloadEnvVars()
+	if err != nil {
+		return nil, err
+	}
+	workloadEnv, err := localEnv(append(workloadVars, common...))
+	if err != nil {
+		return nil, err
+	}
+
+	binds := []string{dataDir + ":/data-dir", markerDir + ":/tmp/marker", scriptsDir + ":/scripts"}
+	workloadBinds := append([]string{}, binds...)
+	for _, dir := range j.DataDirs {
+		sub := filepath.Join(dataDir, strings.TrimLeft(dir, "/"))
+		if err = os.MkdirAll(sub, 0o777); err != nil {
+			return nil, err
+		}
+		workloadBinds = append(workloadBinds, sub+":"+dir)
+	}
+	return []localContainer{
+		{Name: "downloaddata", Image: j.K8sToolImage, Opts: dockerutil.ContainerOpts{
+			Entrypoint: []string{"bash", "/scripts/download-data.sh"},
+			Env:        dataEnv,
+			Binds:      binds,
+			ExtraHosts: []string{dockerHostGateway},
+			Rm:         true,
+			Timeout:    opts.Timeout,
+		}},
+		{Name: "workload", Image: j.Image, Opts: dockerutil.ContainerOpts{
+			Entrypoint: []string{"bash", "/scripts/entrypoint.sh"},
+			Env:        workloadEnv,
+			Binds:      workloadBinds,
+			WorkDir:    j.WorkDir,
+			Rm:         true,
+			Timeout:    opts.Timeout,
+		}},
+		{Name: "uploaddata", Image: j.K8sToolImage, Opts: dockerutil.ContainerOpts{
+			Entrypoint: []string{"bash", "/scripts/upload-data.sh"},
+			Env:        dataEnv,
+			Binds:      binds,
+			ExtraHosts: []string{dockerHostGateway},
+			Rm:         true,
+			Timeout:    opts.Timeout,
+		}},
+	}, nil
+}
+
+// dockerHostGateway resolves host.docker.internal to the host on Linux, Docker Desktop resolves it already
+const dockerHostGateway = "host.docker.internal:host-gateway"
+
+// localAWSEnvVars returns the AWS_* env vars of the current process, with a loopback AWS_ENDPOINT,
+// e.g. a local minio, replaced by the address of the host as seen from the containers
+func localAWSEnvVars() []corev1.EnvVar {
+	env := awsEnvVars()
+	for i, e := range env {
+		if e.Name != "AWS_ENDPOINT" {
+			continue
+		}
+		u, err := url.Parse(e.Value)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || (ip != nil && ip.IsLoopback()) {
+			port := u.Port()
+			u.Host = "host.docker.internal"
+			if port != "" {
+				u.Host += ":" + port
+			}
+			env[i].Value = u.String()
+		}
+	}
+	return env
+}
+
+// localEnv converts env vars to the docker KEY=VALUE form, only literal values are supported
+func localEnv(env []corev1.EnvVar) ([]string, error) {
+	out := make([]string, 0, len(env))
+	for _, e := range env {
+		if e.ValueFrom != nil {
+			return nil, errors.Errorf("env var %s: valueFrom is not supported in local runs", e.Name)
+		}
+		out = append(out, e.Name+"="+e.Value)
+	}
+	return out, nil
+}
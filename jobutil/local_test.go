@@ -0,0 +1,48 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestLocalContainers(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AWS_ENDPOINT", "http://127.0.0.1:9000")
+	j := BuilderSimple("job", "busybox", "/work", "echo hello", "", []string{"/root/.cache"}, "test", nil)
+	j.Indexed = true
+	j.initDefaults()
+
+	containers, err := j.localContainers(LocalRunOptions{Dir: dir, Index: 1})
+	require.NoError(t, err)
+	require.Len(t, containers, 3)
+	assert.Equal(t, []string{"downloaddata", "workload", "uploaddata"},
+		[]string{containers[0].Name, containers[1].Name, containers[2].Name})
+
+	workload := containers[1]
+	assert.Equal(t, "busybox", workload.Image)
+	assert.Contains(t, workload.Opts.Binds, filepath.Join(dir, "data", "root/.cache")+":/root/.cache")
+	assert.Contains(t, workload.Opts.Env, "JOB_COMPLETION_INDEX=1")
+	assert.Contains(t, containers[2].Opts.Env, "BUCKET=test")
+	assert.Contains(t, containers[2].Opts.Env, "POD_NAME=job-local-1")
+	// a local endpoint is reached through the host gateway
+	assert.Contains(t, containers[0].Opts.Env, "AWS_ENDPOINT=http://host.docker.internal:9000")
+	assert.Contains(t, containers[2].Opts.ExtraHosts, "host.docker.internal:host-gateway")
+
+	starter, err := os.ReadFile(filepath.Join(dir, "scripts", "starter.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello", string(starter))
+
+	j.Env = []corev1.EnvVar{{Name: "SECRET", ValueFrom: &corev1.EnvVarSource{}}}
+	_, err = j.localContainers(LocalRunOptions{Dir: dir})
+	assert.EqualError(t, err, "env var SECRET: valueFrom is not supported in local runs")
+}
@@ -0,0 +1,307 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alt-research/operator-kit/array"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// logsPollInterval is how often a followed job is checked for completion while no container is streamed
+var logsPollInterval = 10 * time.Second
+
+type LogOptions struct {
+	// Containers to stream logs of, defaults to all init containers and containers of the pods,
+	// e.g. downloaddata, workload and uploaddata
+	Containers []string
+	// Follow keeps streaming the logs of running containers and of pods created later,
+	// until the job has finished or the context is cancelled
+	Follow bool
+	// SinceTime only returns the logs after the given time
+	SinceTime *metav1.Time
+	// Prefix prepends "[pod/container] " to every line returned by StreamLogs
+	Prefix bool
+}
+
+type LogLine struct {
+	Pod       string
+	Container string
+	// Previous is true if the line comes from a previous attempt of a restarted container
+	Previous bool
+	Line     string
+	// Err is set if reading the logs of the container failed, Line is empty in that case.
+	// Pod and Container are empty if following the job failed, it is the last line of the stream.
+	Err error
+}
+
+func (l LogLine) String() string {
+	if l.Err != nil && l.Pod == "" {
+		return fmt.Sprintf("error: %s", l.Err)
+	}
+	if l.Err != nil {
+		return fmt.Sprintf("[%s/%s] error: %s", l.Pod, l.Container, l.Err)
+	}
+	return fmt.Sprintf("[%s/%s] %s", l.Pod, l.Container, l.Line)
+}
+
+// LogLines streams the logs of all pods and attempts of the job line by line.
+// The channel is closed once all logs are read, or in follow mode once the job has finished or is deleted.
+func (j *JobBuilder) LogLines(ctx context.Context, opts LogOptions) (<-chan LogLine, error) {
+	err := j.initClientset()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan LogLine, 128)
+	// the builder may be changed by the caller while streaming, the goroutines only use copies
+	pods := j.Clientset.CoreV1().Pods(j.Namespace)
+	if !opts.Follow {
+		list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: j.podLabelSelector()})
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(list.Items, func(a, b int) bool {
+			return list.Items[a].CreationTimestamp.Before(&list.Items[b].CreationTimestamp)
+		})
+		go func() {
+			defer close(ch)
+			for i := range list.Items {
+				pod := &list.Items[i]
+				for _, c := range podContainerStatuses(pod) {
+					if !logContainerSelected(opts, c.Name) {
+						continue
+					}
+					if c.RestartCount > 0 {
+						streamContainerLogs(ctx, pods, pod.Name, c.Name, true, opts, ch)
+					}
+					if c.State.Running != nil || c.State.Terminated != nil {
+						streamContainerLogs(ctx, pods, pod.Name, c.Name, false, opts, ch)
+					}
+				}
+			}
+		}()
+		return ch, nil
+	}
+
+	if err = j.initCtrlClient(); err != nil {
+		return nil, err
+	}
+	c, key, scheduled := j.Client, client.ObjectKey{Namespace: j.Namespace, Name: j.Name}, j.Schedule != ""
+	listOpts := metav1.ListOptions{LabelSelector: j.podLabelSelector()}
+	w, err := pods.Watch(ctx, listOpts)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(ch)
+		defer func() { w.Stop() }()
+		wg := &sync.WaitGroup{}
+		defer wg.Wait()
+		streaming := map[string]bool{}
+		// containers already seen, the previous attempt of a restarted one is only streamed the first time
+		seen := map[string]bool{}
+		mu := &sync.Mutex{}
+		active := 0
+		doneCh := make(chan struct{}, 1)
+		// jobs finishing without a container left to stream, e.g. whose pods were deleted, are polled
+		ticker := time.NewTicker(logsPollInterval)
+		defer ticker.Stop()
+		stop := func() bool {
+			mu.Lock()
+			idle := active == 0
+			mu.Unlock()
+			if !idle {
+				return false
+			}
+			done, err := jobFinished(ctx, c, key, scheduled)
+			if err != nil {
+				if ctx.Err() == nil {
+					sendLogLine(ctx, ch, LogLine{Err: errors.Wrapf(err, "failed to get job %s", key)})
+				}
+				return true
+			}
+			return done
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-doneCh:
+				if stop() {
+					return
+				}
+			case <-ticker.C:
+				if stop() {
+					return
+				}
+			case ev, ok := <-w.ResultChan():
+				if !ok {
+					// the apiserver ends watches after a while, the pods already streamed are skipped
+					rewatch, err := pods.Watch(ctx, listOpts)
+					if err != nil {
+						if ctx.Err() == nil {
+							sendLogLine(ctx, ch, LogLine{Err: errors.Wrap(err, "failed to watch job pods")})
+						}
+						return
+					}
+					w.Stop()
+					w = rewatch
+					continue
+				}
+				pod, ok := ev.Object.(*corev1.Pod)
+				if !ok || ev.Type == watch.Deleted {
+					continue
+				}
+				for _, c := range podContainerStatuses(pod) {
+					if !logContainerSelected(opts, c.Name) {
+						continue
+					}
+					if c.State.Running == nil && c.State.Terminated == nil {
+						continue
+					}
+					// a new stream is opened for every restart of the container
+					id := fmt.Sprintf("%s/%s/%d", pod.Name, c.Name, c.RestartCount)
+					if streaming[id] {
+						continue
+					}
+					streaming[id] = true
+					previous := c.RestartCount > 0 && !seen[pod.Name+"/"+c.Name]
+					seen[pod.Name+"/"+c.Name] = true
+					mu.Lock()
+					active++
+					mu.Unlock()
+					wg.Add(1)
+					go func(pod, container string, previous bool) {
+						defer wg.Done()
+						if previous {
+							streamContainerLogs(ctx, pods, pod, container, true, opts, ch)
+						}
+						streamContainerLogs(ctx, pods, pod, container, false, opts, ch)
+						mu.Lock()
+						active--
+						mu.Unlock()
+						select {
+						case doneCh <- struct{}{}:
+						default:
+						}
+					}(pod.Name, c.Name, previous)
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// StreamLogs returns the logs of all pods and attempts of the job as a single stream, see LogLines
+func (j *JobBuilder) StreamLogs(ctx context.Context, opts LogOptions) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	lines, err := j.LogLines(ctx, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer cancel()
+		for l := range lines {
+			if l.Err != nil {
+				_ = w.CloseWithError(l.Err)
+				return
+			}
+			line := l.Line
+			if opts.Prefix {
+				line = l.String()
+			}
+			if _, err := io.WriteString(w, line+"\n"); err != nil {
+				return
+			}
+		}
+		_ = w.Close()
+	}()
+	return &logReadCloser{PipeReader: r, cancel: cancel}, nil
+}
+
+type logReadCloser struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (r *logReadCloser) Close() error {
+	r.cancel()
+	return r.PipeReader.Close()
+}
+
+func streamContainerLogs(ctx context.Context, pods corev1client.PodInterface, pod, container string, previous bool, opts LogOptions, ch chan<- LogLine) {
+	req := pods.GetLogs(pod, &corev1.PodLogOptions{
+		Container: container,
+		Follow:    opts.Follow && !previous,
+		Previous:  previous,
+		SinceTime: opts.SinceTime,
+	})
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		sendLogLine(ctx, ch, LogLine{Pod: pod, Container: container, Previous: previous, Err: err})
+		return
+	}
+	defer stream.Close()
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !sendLogLine(ctx, ch, LogLine{Pod: pod, Container: container, Previous: previous, Line: scanner.Text()}) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		sendLogLine(ctx, ch, LogLine{Pod: pod, Container: container, Previous: previous, Err: err})
+	}
+}
+
+func sendLogLine(ctx context.Context, ch chan<- LogLine, l LogLine) bool {
+	select {
+	case ch <- l:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// jobFinished returns true if the job is completed, failed or deleted, jobs of a CronJob never finish.
+// It reads into its own Job so that it can run concurrently with the use of the builder.
+func jobFinished(ctx context.Context, c client.Client, key client.ObjectKey, scheduled bool) (bool, error) {
+	if scheduled {
+		return false, nil
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, key, job); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return jobDone(job), nil
+}
+
+func podContainerStatuses(pod *corev1.Pod) []corev1.ContainerStatus {
+	return append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+}
+
+func logContainerSelected(opts LogOptions, container string) bool {
+	return len(opts.Containers) == 0 || array.Contains(opts.Containers, container)
+}
@@ -0,0 +1,182 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func testJobPod(status corev1.PodStatus) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "job-abc", Labels: map[string]string{batchv1.JobNameLabel: "job"}},
+		Status:     status,
+	}
+}
+
+// collectLogLines reads the stream until it is closed
+func collectLogLines(t *testing.T, ch <-chan LogLine) []LogLine {
+	var lines []LogLine
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case l, ok := <-ch:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, l)
+		case <-timeout:
+			t.Fatalf("log stream not closed, got %v", lines)
+		}
+	}
+}
+
+func TestLogLines(t *testing.T) {
+	ctx := context.Background()
+	j := newTestBuilder(t)
+	j.Clientset = k8sfake.NewSimpleClientset(testJobPod(corev1.PodStatus{
+		InitContainerStatuses: []corev1.ContainerStatus{
+			{Name: "downloaddata", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+		},
+		ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "workload", RestartCount: 1, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			{Name: "uploaddata", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}},
+		},
+	}))
+
+	ch, err := j.LogLines(ctx, LogOptions{})
+	require.NoError(t, err)
+	lines := collectLogLines(t, ch)
+	require.Len(t, lines, 3)
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "downloaddata", Line: "fake logs"}, lines[0])
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Previous: true, Line: "fake logs"}, lines[1])
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Line: "fake logs"}, lines[2])
+
+	ch, err = j.LogLines(ctx, LogOptions{Containers: []string{"downloaddata"}})
+	require.NoError(t, err)
+	assert.Len(t, collectLogLines(t, ch), 1)
+}
+
+func TestLogLinesFollow(t *testing.T) {
+	defer func(interval time.Duration) { logsPollInterval = interval }(logsPollInterval)
+	logsPollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+
+	// the first watch is closed by the apiserver, the pod shows up on the next one
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "job"}}
+	j := newTestBuilder(t, job)
+	clientset := k8sfake.NewSimpleClientset()
+	watchers := make(chan *watch.FakeWatcher, 2)
+	clientset.PrependWatchReactor("pods", func(k8stesting.Action) (bool, watch.Interface, error) {
+		w := watch.NewFakeWithChanSize(1, false)
+		watchers <- w
+		return true, w, nil
+	})
+	j.Clientset = clientset
+	ch, err := j.LogLines(ctx, LogOptions{Follow: true})
+	require.NoError(t, err)
+	(<-watchers).Stop()
+	(<-watchers).Add(testJobPod(corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+		{Name: "workload", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+	}}))
+	select {
+	case l := <-ch:
+		assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Line: "fake logs"}, l)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no log line after the watch was re-established")
+	}
+
+	// the stream ends once the job has finished
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	require.NoError(t, j.Client.Status().Update(ctx, job))
+	assert.Empty(t, collectLogLines(t, ch))
+}
+
+func TestLogLinesFollowWithoutPods(t *testing.T) {
+	defer func(interval time.Duration) { logsPollInterval = interval }(logsPollInterval)
+	logsPollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+
+	// a finished job whose pods were deleted
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "job"},
+		Status:     batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}},
+	}
+	j := newTestBuilder(t, job)
+	j.Clientset = k8sfake.NewSimpleClientset()
+	ch, err := j.LogLines(ctx, LogOptions{Follow: true})
+	require.NoError(t, err)
+	assert.Empty(t, collectLogLines(t, ch))
+
+	// failing to read the job ends the stream with the error
+	getErr := errors.New("apiserver unavailable")
+	j.Client = fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			return getErr
+		},
+	}).Build()
+	ch, err = j.LogLines(ctx, LogOptions{Follow: true})
+	require.NoError(t, err)
+	lines := collectLogLines(t, ch)
+	require.Len(t, lines, 1)
+	assert.ErrorIs(t, lines[0].Err, getErr)
+	assert.Empty(t, lines[0].Pod)
+}
+
+func TestLogLinesFollowPrevious(t *testing.T) {
+	defer func(interval time.Duration) { logsPollInterval = interval }(logsPollInterval)
+	logsPollInterval = 10 * time.Millisecond
+	ctx := context.Background()
+
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "job"}}
+	j := newTestBuilder(t, job)
+	clientset := k8sfake.NewSimpleClientset()
+	watcher := watch.NewFakeWithChanSize(2, false)
+	clientset.PrependWatchReactor("pods", k8stesting.DefaultWatchReactor(watcher, nil))
+	j.Clientset = clientset
+	ch, err := j.LogLines(ctx, LogOptions{Follow: true})
+	require.NoError(t, err)
+
+	next := func() LogLine {
+		select {
+		case l := <-ch:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatal("no log line")
+			return LogLine{}
+		}
+	}
+	// first seen after a restart, the logs of the previous attempt come first
+	restarted := func(count int32) *corev1.Pod {
+		return testJobPod(corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{
+			{Name: "workload", RestartCount: count, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+		}})
+	}
+	watcher.Add(restarted(1))
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Previous: true, Line: "fake logs"}, next())
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Line: "fake logs"}, next())
+	// the previous attempt of a later restart was already followed
+	watcher.Modify(restarted(2))
+	assert.Equal(t, LogLine{Pod: "job-abc", Container: "workload", Line: "fake logs"}, next())
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	require.NoError(t, j.Client.Status().Update(ctx, job))
+	assert.Empty(t, collectLogLines(t, ch))
+}
@@ -0,0 +1,246 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/alt-research/operator-kit/array"
+	"github.com/alt-research/operator-kit/tplutil"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	paramsFile      = "params.json"
+	paramsEnvPrefix = "PARAM_"
+)
+
+// optionalFuncs are the template functions that accept missing values
+var optionalFuncs = []string{"default", "empty", "coalesce", "hasKey", "ternary"}
+
+// renderScript renders ScriptTemplate with Params into Script
+func (j *JobBuilder) renderScript() error {
+	if j.ScriptTemplate == "" {
+		return nil
+	}
+	tpl, err := j.parseScriptTemplate()
+	if err != nil {
+		return err
+	}
+	if err = j.validateParams(tpl); err != nil {
+		return err
+	}
+	j.Script, err = tplutil.RenderText(tpl, j.Params)
+	return errors.Wrap(err, "failed to render script template")
+}
+
+func (j *JobBuilder) parseScriptTemplate() (*template.Template, error) {
+	tpl, err := tplutil.NewText(j.Name).Parse(j.ScriptTemplate)
+	return tpl, errors.Wrap(err, "failed to parse script template")
+}
+
+// ValidateParams checks that every parameter referenced by ScriptTemplate is provided by Params,
+// a parameter is missing if Params has no such field, method or map key, or if it is a nil pointer
+func (j *JobBuilder) ValidateParams() error {
+	tpl, err := j.parseScriptTemplate()
+	if err != nil {
+		return err
+	}
+	return j.validateParams(tpl)
+}
+
+func (j *JobBuilder) validateParams(tpl *template.Template) error {
+	params := reflect.ValueOf(j.Params)
+	var missing []string
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		// the dot of the {{define}} templates is the argument of their {{template}} call, not Params
+		for _, field := range referencedFields(t.Tree.Root, t.Name() == tpl.Name()) {
+			if !hasParam(params, field) {
+				missing = append(missing, "."+strings.Join(field, "."))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Errorf("missing script parameters: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (j *JobBuilder) paramsMap() (map[string]any, error) {
+	params := map[string]any{}
+	if j.Params == nil {
+		return params, nil
+	}
+	b, err := json.Marshal(j.Params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode script parameters")
+	}
+	if err = json.Unmarshal(b, &params); err != nil {
+		return nil, errors.Wrap(err, "script parameters must be a struct or a map")
+	}
+	return params, nil
+}
+
+// paramsEnv returns the top level parameters as PARAM_<NAME> env vars, non string values are JSON encoded
+func (j *JobBuilder) paramsEnv() ([]corev1.EnvVar, error) {
+	if j.Params == nil {
+		return nil, nil
+	}
+	params, err := j.paramsMap()
+	if err != nil {
+		return nil, err
+	}
+	env := make([]corev1.EnvVar, 0, len(params)+1)
+	env = append(env, corev1.EnvVar{Name: "JOB_PARAMS_FILE", Value: "/scripts/" + paramsFile})
+	for k, v := range params {
+		value, ok := v.(string)
+		if !ok {
+			b, _ := json.Marshal(v)
+			value = string(b)
+		}
+		env = append(env, corev1.EnvVar{Name: paramEnvName(k), Value: value})
+	}
+	sort.Slice(env, func(a, b int) bool { return env[a].Name < env[b].Name })
+	return env, nil
+}
+
+// paramEnvName converts a parameter name to an env var name, e.g. accountIndex to PARAM_ACCOUNT_INDEX
+func paramEnvName(key string) string {
+	var b strings.Builder
+	b.WriteString(paramsEnvPrefix)
+	var prev rune
+	for _, r := range key {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if (prev >= 'a' && prev <= 'z') || (prev >= '0' && prev <= '9') {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		case r >= 'a' && r <= 'z':
+			b.WriteRune(r - 'a' + 'A')
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+func hasParam(v reflect.Value, field []string) bool {
+	for _, f := range field {
+		if !v.IsValid() {
+			return false
+		}
+		if m := v.MethodByName(f); m.IsValid() {
+			return true
+		}
+		for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return false
+			}
+			v = v.Elem()
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			v = v.FieldByName(f)
+		case reflect.Map:
+			// the key type may be a named string type
+			if v.Type().Key().Kind() != reflect.String {
+				return false
+			}
+			v = v.MapIndex(reflect.ValueOf(f).Convert(v.Type().Key()))
+		default:
+			return false
+		}
+	}
+	if !v.IsValid() {
+		return false
+	}
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		return !v.IsNil()
+	}
+	return true
+}
+
+func hasFieldPrefix(field []string, prefixes [][]string) bool {
+	for _, p := range prefixes {
+		if len(p) <= len(field) && strings.Join(field[:len(p)], ".") == strings.Join(p, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedFields collects the field chains required from the root context of a template,
+// both .Field and $.Field references. Fields tested by if, with and range or passed to optionalFuncs
+// are optional and not collected. Inside range and with blocks the dot is another context, root is
+// false there and only the $ references are collected.
+func referencedFields(node parse.Node, root bool) (fields [][]string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			fields = append(fields, referencedFields(c, root)...)
+		}
+	case *parse.ActionNode:
+		fields = append(fields, referencedFields(n.Pipe, root)...)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			if id, ok := c.Args[0].(*parse.IdentifierNode); ok && array.Contains(optionalFuncs, id.Ident) {
+				return nil
+			}
+		}
+		for _, c := range n.Cmds {
+			fields = append(fields, referencedFields(c, root)...)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			fields = append(fields, referencedFields(a, root)...)
+		}
+	case *parse.FieldNode:
+		if root {
+			fields = append(fields, n.Ident)
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			fields = append(fields, n.Ident[1:])
+		}
+	case *parse.IfNode:
+		// fields tested by an if are optional, so are the fields below them in its body
+		optional := referencedFields(n.Pipe, root)
+		for _, f := range append(referencedFields(n.List, root), referencedFields(n.ElseList, root)...) {
+			if !hasFieldPrefix(f, optional) {
+				fields = append(fields, f)
+			}
+		}
+	case *parse.RangeNode:
+		fields = append(fields, referencedFields(n.List, false)...)
+		fields = append(fields, referencedFields(n.ElseList, root)...)
+	case *parse.WithNode:
+		fields = append(fields, referencedFields(n.List, false)...)
+		fields = append(fields, referencedFields(n.ElseList, root)...)
+	case *parse.TemplateNode:
+		fields = append(fields, referencedFields(n.Pipe, root)...)
+	}
+	return
+}
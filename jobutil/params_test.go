@@ -0,0 +1,77 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testParams struct {
+	Chain        string  `json:"chain"`
+	AccountIndex int     `json:"accountIndex"`
+	Debug        bool    `json:"debug,omitempty"`
+	Output       *string `json:"output"`
+}
+
+func TestRenderScript(t *testing.T) {
+	j := &JobBuilder{
+		Name:           "test",
+		ScriptTemplate: `gen --chain {{ .Chain }} --index {{ .AccountIndex }}{{ if .Debug }} -v{{ end }} --out {{ .Output | default "/data" }}`,
+		Params:         testParams{Chain: "dev", AccountIndex: 0},
+	}
+	require.NoError(t, j.renderScript())
+	assert.Equal(t, "gen --chain dev --index 0 --out /data", j.Script)
+
+	env, err := j.paramsEnv()
+	require.NoError(t, err)
+	names := make([]string, len(env))
+	for i, e := range env {
+		names[i] = e.Name
+	}
+	assert.Equal(t, []string{"JOB_PARAMS_FILE", "PARAM_ACCOUNT_INDEX", "PARAM_CHAIN", "PARAM_OUTPUT"}, names)
+}
+
+func TestValidateParams(t *testing.T) {
+	j := &JobBuilder{
+		Name:           "test",
+		ScriptTemplate: `gen --chain {{ .Chain }} --out {{ .Output }} --seed {{ .Seed }}{{ range .Accounts }}{{ .Name }}{{ end }}`,
+		Params:         testParams{Chain: "dev"},
+	}
+	assert.EqualError(t, j.ValidateParams(), "missing script parameters: .Output, .Seed")
+}
+
+type testParamName string
+
+func TestValidateParamsReferences(t *testing.T) {
+	// $ refers to the root context inside range and with blocks
+	j := &JobBuilder{
+		Name:           "test",
+		ScriptTemplate: `{{ range .Accounts }}{{ .Name }} {{ $.Chain }} {{ $.Seed }}{{ end }}{{ with .Output }}{{ $.Network }}{{ end }}`,
+		Params:         testParams{Chain: "dev"},
+	}
+	assert.EqualError(t, j.ValidateParams(), "missing script parameters: .Network, .Seed")
+
+	// maps with a named string key type
+	j.ScriptTemplate = `{{ .chain }} {{ $.seed }}`
+	j.Params = map[testParamName]string{"chain": "dev"}
+	assert.EqualError(t, j.ValidateParams(), "missing script parameters: .seed")
+
+	// the dot of a defined template is the argument of its call
+	j.ScriptTemplate = `{{ define "x" }}{{ .Name }}{{ end }}{{ template "x" .Item }}`
+	j.Params = map[string]any{"Item": map[string]string{"Name": "dev"}}
+	assert.NoError(t, j.ValidateParams())
+	j.Params = map[string]any{}
+	assert.EqualError(t, j.ValidateParams(), "missing script parameters: .Item")
+}
+
+func TestScriptsDataInvalidParams(t *testing.T) {
+	j := &JobBuilder{Name: "test", Script: "echo", Params: map[string]any{"callback": func() {}}}
+	_, err := j.scriptsData()
+	assert.ErrorContains(t, err, "failed to encode script parameters")
+}
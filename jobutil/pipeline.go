@@ -0,0 +1,338 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+
+	"github.com/alt-research/operator-kit/k8s"
+	"github.com/alt-research/operator-kit/must"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+type StagePhase string
+
+const (
+	StagePending   StagePhase = "Pending"
+	StageRunning   StagePhase = "Running"
+	StageSucceeded StagePhase = "Succeeded"
+	StageFailed    StagePhase = "Failed"
+	// StageResetting is a resumed stage whose failed Job is being deleted, it becomes pending once the Job is gone
+	StageResetting StagePhase = "Resetting"
+)
+
+var ErrStageFailed = errors.New("pipeline stage failed")
+
+// Stage is a single job of a Pipeline
+type Stage struct {
+	Name    string
+	Builder *JobBuilder
+	// DependsOn lists the stages whose output data is restored before this stage runs,
+	// only used when Pipeline.DAG is true, otherwise a stage depends on the previous one
+	DependsOn []string
+}
+
+// Pipeline runs a set of jobs in order, the output data object of a stage becomes the input of the
+// stages depending on it. The phase of every stage is tracked in a ConfigMap, so a pipeline can be
+// reconciled repeatedly and resumed from its failed stages. A running stage whose Job disappears is failed,
+// the TTLSecondsAfterFinished of the stages must leave time for a reconcile to record their result.
+type Pipeline struct {
+	// Client manages the state ConfigMap, it is also used by the stages without a client
+	Client client.Client
+	// Owner, if set, becomes the controller owner of the state ConfigMap and of the stage jobs
+	Owner client.Object
+
+	Name      string
+	Namespace string
+	Stages    []*Stage
+	DAG       bool
+
+	// StateCM is the ConfigMap holding the phase of every stage
+	StateCM *corev1.ConfigMap
+}
+
+func (p *Pipeline) initClient() (err error) {
+	if p.Client == nil {
+		p.Client, err = k8s.GetCtrlClient()
+		if err != nil {
+			return
+		}
+	}
+	for _, s := range p.Stages {
+		if s.Builder.Client == nil {
+			s.Builder.Client = p.Client
+		}
+		if s.Builder.Owner == nil {
+			s.Builder.Owner = p.Owner
+		}
+		// the data of a stage is needed by the stages depending on it after its Job is gone
+		if s.Builder.DataOwner == nil && p.Owner == nil {
+			s.Builder.DataOwner = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: p.Namespace, Name: p.stateName()}}
+		}
+	}
+	return
+}
+
+func (p *Pipeline) stateName() string {
+	return p.Name + "-pipeline"
+}
+
+func (p *Pipeline) initDefaults() {
+	p.Namespace = must.Default(p.Namespace, k8s.NAMESPACE)
+	for _, s := range p.Stages {
+		s.Builder.Name = must.Default(s.Builder.Name, p.Name+"-"+s.Name)
+		s.Builder.Namespace = must.Default(s.Builder.Namespace, p.Namespace)
+		s.Builder.initDefaults()
+	}
+}
+
+// dependencies returns the stages the given stage depends on
+func (p *Pipeline) dependencies(i int) ([]*Stage, error) {
+	if !p.DAG {
+		if i == 0 {
+			return nil, nil
+		}
+		return []*Stage{p.Stages[i-1]}, nil
+	}
+	deps := make([]*Stage, 0, len(p.Stages[i].DependsOn))
+	for _, name := range p.Stages[i].DependsOn {
+		dep := p.Stage(name)
+		if dep == nil {
+			return nil, errors.Errorf("stage %s depends on unknown stage %s", p.Stages[i].Name, name)
+		}
+		deps = append(deps, dep)
+	}
+	return deps, nil
+}
+
+// Validate checks stage names are unique and the dependencies form a DAG
+func (p *Pipeline) Validate() error {
+	index := make(map[string]int, len(p.Stages))
+	for i, s := range p.Stages {
+		if s.Builder == nil {
+			return errors.Errorf("stage %s has no job builder", s.Name)
+		}
+		// the runs of a CronJob never finish, so the stages depending on it could never start
+		if s.Builder.Schedule != "" {
+			return errors.Errorf("stage %s is scheduled, pipeline stages must be Jobs", s.Name)
+		}
+		if _, ok := index[s.Name]; ok {
+			return errors.Errorf("duplicated stage %s", s.Name)
+		}
+		index[s.Name] = i
+	}
+	// 0: unvisited, 1: visiting, 2: visited
+	marks := make([]int, len(p.Stages))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch marks[i] {
+		case 1:
+			return errors.Errorf("dependency cycle detected at stage %s", p.Stages[i].Name)
+		case 2:
+			return nil
+		}
+		marks[i] = 1
+		deps, err := p.dependencies(i)
+		if err != nil {
+			return err
+		}
+		for _, d := range deps {
+			if err := visit(index[d.Name]); err != nil {
+				return err
+			}
+		}
+		marks[i] = 2
+		return nil
+	}
+	for i := range p.Stages {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) Stage(name string) *Stage {
+	for _, s := range p.Stages {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// Phase returns the phase of the given stage
+func (p *Pipeline) Phase(name string) StagePhase {
+	if p.StateCM == nil {
+		return StagePending
+	}
+	return must.Default(StagePhase(p.StateCM.Data[name]), StagePending)
+}
+
+func (p *Pipeline) setPhase(name string, phase StagePhase) {
+	if p.StateCM.Data == nil {
+		p.StateCM.Data = make(map[string]string)
+	}
+	p.StateCM.Data[name] = string(phase)
+}
+
+// Done returns true if all stages have succeeded
+func (p *Pipeline) Done() bool {
+	for _, s := range p.Stages {
+		if p.Phase(s.Name) != StageSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// Get loads the stage phases from the state ConfigMap
+func (p *Pipeline) Get(ctx context.Context) (err error) {
+	p.initDefaults()
+	err = p.initClient()
+	if err != nil {
+		return
+	}
+	p.StateCM = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: p.Namespace, Name: p.stateName()}}
+	err = p.Client.Get(ctx, client.ObjectKeyFromObject(p.StateCM), p.StateCM)
+	return client.IgnoreNotFound(err)
+}
+
+func (p *Pipeline) save(ctx context.Context) (err error) {
+	if p.StateCM.ResourceVersion != "" {
+		return p.Client.Update(ctx, p.StateCM)
+	}
+	if p.Owner != nil {
+		if err = controllerutil.SetControllerReference(p.Owner, p.StateCM, p.Client.Scheme()); err != nil {
+			return
+		}
+	}
+	return p.Client.Create(ctx, p.StateCM)
+}
+
+// Reconcile starts every stage whose dependencies have succeeded and records the phases of the
+// running stages. It returns true when all stages have succeeded, and ErrStageFailed if any stage
+// has failed, in which case Resume must be called to retry the failed stages.
+func (p *Pipeline) Reconcile(ctx context.Context) (done bool, err error) {
+	if err = p.Validate(); err != nil {
+		return
+	}
+	if err = p.Get(ctx); err != nil {
+		return
+	}
+	var failed []string
+	for i, s := range p.Stages {
+		switch p.Phase(s.Name) {
+		case StageSucceeded:
+			continue
+		case StageFailed:
+			failed = append(failed, s.Name)
+			continue
+		case StageResetting:
+			if err = s.Builder.Get(ctx); err != nil {
+				return
+			}
+			if s.Builder.Job.ResourceVersion != "" {
+				continue
+			}
+			p.setPhase(s.Name, StagePending)
+		case StageRunning:
+			if err = s.Builder.Get(ctx); err != nil {
+				return
+			}
+			// a Job deleted before its result was recorded, e.g. by its TTL, cannot be trusted to have succeeded
+			if s.Builder.Succeeded() {
+				p.setPhase(s.Name, StageSucceeded)
+			} else if s.Builder.Failed() || s.Builder.Job.ResourceVersion == "" {
+				p.setPhase(s.Name, StageFailed)
+				failed = append(failed, s.Name)
+			}
+			continue
+		}
+		deps, _ := p.dependencies(i)
+		ready := true
+		s.Builder.InputObjectKeys = nil
+		for _, d := range deps {
+			if p.Phase(d.Name) != StageSucceeded {
+				ready = false
+				break
+			}
+			s.Builder.InputObjectKeys = append(s.Builder.InputObjectKeys, d.Builder.OutputObjectKeys()...)
+		}
+		if !ready {
+			continue
+		}
+		if err = s.Builder.Build(ctx); err != nil {
+			return false, errors.Wrapf(err, "failed to build stage %s", s.Name)
+		}
+		// a Job still being deleted would be patched and then disappear, wait until it is gone
+		if s.Builder.Job != nil && s.Builder.Job.DeletionTimestamp != nil {
+			continue
+		}
+		if err = s.Builder.CreateOrUpdate(ctx); err != nil {
+			return false, errors.Wrapf(err, "failed to create stage %s", s.Name)
+		}
+		p.setPhase(s.Name, StageRunning)
+	}
+	if err = p.save(ctx); err != nil {
+		return
+	}
+	if len(failed) > 0 {
+		return false, errors.Wrapf(ErrStageFailed, "failed stages: %v", failed)
+	}
+	return p.Done(), nil
+}
+
+// Resume deletes the jobs and data of the failed stages and resets them, so that Reconcile reruns them
+// with the outputs of the succeeded stages once their jobs are gone
+func (p *Pipeline) Resume(ctx context.Context) (err error) {
+	if err = p.Validate(); err != nil {
+		return
+	}
+	if err = p.Get(ctx); err != nil {
+		return
+	}
+	for _, s := range p.Stages {
+		if p.Phase(s.Name) != StageFailed {
+			continue
+		}
+		if err = s.Builder.Destroy(ctx, true); err != nil {
+			return errors.Wrapf(err, "failed to destroy stage %s", s.Name)
+		}
+		if err = s.Builder.DeleteData(ctx); err != nil {
+			return errors.Wrapf(err, "failed to delete data of stage %s", s.Name)
+		}
+		p.setPhase(s.Name, StageResetting)
+	}
+	return p.save(ctx)
+}
+
+// Destroy deletes the jobs of all stages and the state ConfigMap, the data objects are kept
+// until the GarbageCollector collects them
+func (p *Pipeline) Destroy(ctx context.Context) (err error) {
+	if err = p.Validate(); err != nil {
+		return
+	}
+	p.initDefaults()
+	if err = p.initClient(); err != nil {
+		return
+	}
+	for _, s := range p.Stages {
+		if err = s.Builder.Destroy(ctx, true); err != nil {
+			return
+		}
+	}
+	err = p.Client.Delete(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: p.Namespace, Name: p.stateName()}})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return
+	}
+	return nil
+}
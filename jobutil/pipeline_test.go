@@ -0,0 +1,138 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/s3util"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestPipeline(t *testing.T, stages ...string) *Pipeline {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "runner"}}
+	c := fake.NewClientBuilder().WithObjects(sa).Build()
+	bm, err := s3util.NewManagerWithClient(awss3.New(awss3.Options{Region: "us-east-1"}), "test", "", 1)
+	require.NoError(t, err)
+	p := &Pipeline{Client: c, Name: "pipe", Namespace: "test"}
+	for _, name := range stages {
+		p.Stages = append(p.Stages, &Stage{Name: name, Builder: &JobBuilder{
+			BucketManager:  bm,
+			Image:          "busybox",
+			Script:         "echo " + name,
+			ServiceAccount: "runner",
+		}})
+	}
+	return p
+}
+
+// setJobCondition sets the final condition of the Job of the given stage
+func setJobCondition(t *testing.T, p *Pipeline, stage string, typ batchv1.JobConditionType) {
+	ctx := context.Background()
+	job := &batchv1.Job{}
+	require.NoError(t, p.Client.Get(ctx, client.ObjectKey{Namespace: "test", Name: "pipe-" + stage}, job))
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: typ, Status: corev1.ConditionTrue})
+	require.NoError(t, p.Client.Status().Update(ctx, job))
+}
+
+func TestPipelineReconcile(t *testing.T) {
+	ctx := context.Background()
+	p := newTestPipeline(t, "fetch", "build", "publish")
+	p.Stages[0].Builder.Indexed = true
+	p.Stages[0].Builder.Completions = ptr.Of(int32(2))
+
+	done, err := p.Reconcile(ctx)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, StageRunning, p.Phase("fetch"))
+	assert.Equal(t, StagePending, p.Phase("build"))
+
+	setJobCondition(t, p, "fetch", batchv1.JobComplete)
+	_, err = p.Reconcile(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, StageSucceeded, p.Phase("fetch"))
+	assert.Equal(t, StageRunning, p.Phase("build"))
+	// every completion index of the indexed upstream is handed over
+	assert.Equal(t, []string{"jobutil/test/pipe-fetch/0.tar.gz", "jobutil/test/pipe-fetch/1.tar.gz"}, p.Stages[1].Builder.InputObjectKeys)
+
+	// the Job of a running stage is gone before its result was recorded
+	require.NoError(t, p.Client.Delete(ctx, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "pipe-build"}}))
+	_, err = p.Reconcile(ctx)
+	assert.ErrorIs(t, err, ErrStageFailed)
+	assert.Equal(t, StageFailed, p.Phase("build"))
+	assert.Equal(t, StagePending, p.Phase("publish"))
+}
+
+func TestPipelineValidate(t *testing.T) {
+	p := newTestPipeline(t, "a", "b")
+	p.DAG = true
+	p.Stages[0].DependsOn = []string{"b"}
+	p.Stages[1].DependsOn = []string{"a"}
+	assert.ErrorContains(t, p.Validate(), "cycle")
+
+	p = newTestPipeline(t, "a")
+	p.Stages[0].Builder.Schedule = "@daily"
+	assert.ErrorContains(t, p.Validate(), "scheduled")
+
+	// a stage without builder is rejected instead of panicking
+	p = newTestPipeline(t, "a")
+	p.Stages[0].Builder = nil
+	assert.ErrorContains(t, p.Resume(context.Background()), "no job builder")
+	assert.ErrorContains(t, p.Destroy(context.Background()), "no job builder")
+}
+
+func TestPipelineResume(t *testing.T) {
+	ctx := context.Background()
+	srv := s3fake.NewServer("test")
+	defer srv.Close()
+	p := newTestPipeline(t, "fetch")
+	bm, err := s3util.NewManagerWithClient(srv.Client(), "test", "", 1)
+	require.NoError(t, err)
+	p.Stages[0].Builder.BucketManager = bm
+	_, err = p.Reconcile(ctx)
+	require.NoError(t, err)
+	setJobCondition(t, p, "fetch", batchv1.JobFailed)
+	srv.PutObject("test", "jobutil/test/pipe-fetch.tar.gz", []byte("partial"), nil)
+	_, err = p.Reconcile(ctx)
+	assert.ErrorIs(t, err, ErrStageFailed)
+
+	// a finalizer keeps the failed Job deleting
+	key := client.ObjectKey{Namespace: "test", Name: "pipe-fetch"}
+	job := &batchv1.Job{}
+	require.NoError(t, p.Client.Get(ctx, key, job))
+	job.Finalizers = []string{"test/block"}
+	require.NoError(t, p.Client.Update(ctx, job))
+	require.NoError(t, p.Resume(ctx))
+	assert.Equal(t, StageResetting, p.Phase("fetch"))
+	assert.Empty(t, srv.Keys("test"))
+
+	done, err := p.Reconcile(ctx)
+	require.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, StageResetting, p.Phase("fetch"))
+	require.NoError(t, p.Client.Get(ctx, key, job))
+	assert.NotNil(t, job.DeletionTimestamp)
+
+	// rerun once the Job is gone
+	job.Finalizers = nil
+	require.NoError(t, p.Client.Update(ctx, job))
+	_, err = p.Reconcile(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, StageRunning, p.Phase("fetch"))
+	require.NoError(t, p.Client.Get(ctx, key, job))
+	assert.Nil(t, job.DeletionTimestamp)
+	assert.Empty(t, job.Status.Conditions)
+}
@@ -0,0 +1,190 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/specutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// QueueLabel is set on the Jobs admitted through a Queue, its value is the queue name
+	QueueLabel = "app.altlayer.io/jobutil-queue"
+	// PriorityAnnotation holds the priority of a queued Job, higher priorities are admitted first
+	PriorityAnnotation = "app.altlayer.io/jobutil-priority"
+)
+
+// Queue limits the number of concurrently running Jobs sharing the same queue name in a namespace.
+// Jobs of a queue are created suspended and unsuspended by JobBuilder.Admit once a slot is free,
+// waiting Jobs are admitted by priority, then by creation time. The admitted Jobs are recorded in
+// the ConfigMap jobutil-queue-<name>, whose updates are checked for conflicts, so that concurrent
+// reconciles, possibly reading from a stale cache, cannot admit more than MaxRunning Jobs.
+// Queues only apply to Jobs, a JobBuilder with both a Queue and a Schedule fails to build.
+type Queue struct {
+	Name       string
+	MaxRunning int
+}
+
+// queueAdmissionGrace is how long an admitted Job missing from the listed Jobs keeps its slot,
+// it may not be listed yet by a cached client
+const queueAdmissionGrace = time.Minute
+
+func (q *Queue) configMapName() string {
+	return "jobutil-queue-" + q.Name
+}
+
+// Admit unsuspends the Job if its queue has a free slot. It returns the position of the Job among the
+// Jobs waiting for a slot, starting at 1, or 0 if the Job has been admitted. Admit should be called
+// on every reconcile after CreateOrUpdate, as slots are only handed over when queued Jobs are reconciled.
+func (j *JobBuilder) Admit(ctx context.Context) (position int, err error) {
+	if j.Queue == nil || j.Schedule != "" {
+		return 0, nil
+	}
+	if err = j.Get(ctx); err != nil {
+		return
+	}
+	if j.Job.ResourceVersion == "" || j.Job.Spec.Suspend == nil || !*j.Job.Spec.Suspend {
+		return 0, nil
+	}
+	admitted := false
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() (err error) {
+		position, admitted, err = j.reserveSlot(ctx)
+		return
+	})
+	if err != nil || !admitted {
+		return
+	}
+	_, err = specutil.Patch(ctx, j.Client, j.Job, func() error {
+		j.Job.Spec.Suspend = ptr.Of(false)
+		return nil
+	})
+	return 0, err
+}
+
+// reserveSlot records the Job in the queue ConfigMap if a slot is free, otherwise it returns its position.
+// Recording fails with a conflict if the queue was changed since it was read.
+func (j *JobBuilder) reserveSlot(ctx context.Context) (position int, admitted bool, err error) {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: j.Namespace, Name: j.Queue.configMapName()}}
+	if err = j.Client.Get(ctx, client.ObjectKeyFromObject(cm), cm); client.IgnoreNotFound(err) != nil {
+		return
+	}
+	// admitted before, but not unsuspended yet
+	if _, ok := cm.Data[j.Name]; ok {
+		return 0, true, nil
+	}
+	jobs := &batchv1.JobList{}
+	err = j.Client.List(ctx, jobs, client.InNamespace(j.Namespace), client.MatchingLabels{QueueLabel: j.Queue.Name})
+	if err != nil {
+		return
+	}
+	listed := map[string]*batchv1.Job{}
+	var waiting []*batchv1.Job
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		listed[job.Name] = job
+		if _, ok := cm.Data[job.Name]; !ok && job.Spec.Suspend != nil && *job.Spec.Suspend && !jobDone(job) {
+			waiting = append(waiting, job)
+		}
+	}
+	if _, ok := listed[j.Name]; !ok {
+		waiting = append(waiting, j.Job)
+	}
+	// the slots of finished and deleted Jobs are released
+	running := 0
+	for name, at := range cm.Data {
+		job, ok := listed[name]
+		admittedAt, _ := time.Parse(time.RFC3339, at)
+		switch {
+		case ok && jobDone(job):
+			delete(cm.Data, name)
+		case !ok && time.Since(admittedAt) > queueAdmissionGrace:
+			delete(cm.Data, name)
+		default:
+			running++
+		}
+	}
+	sort.SliceStable(waiting, func(a, b int) bool {
+		pa, pb := jobPriority(waiting[a]), jobPriority(waiting[b])
+		if pa != pb {
+			return pa > pb
+		}
+		if !waiting[a].CreationTimestamp.Equal(&waiting[b].CreationTimestamp) {
+			return waiting[a].CreationTimestamp.Before(&waiting[b].CreationTimestamp)
+		}
+		return waiting[a].Name < waiting[b].Name
+	})
+	free := j.Queue.MaxRunning - running
+	if free < 0 {
+		free = 0
+	}
+	for i, job := range waiting {
+		if job.Name != j.Name {
+			continue
+		}
+		if i >= free {
+			return i - free + 1, false, nil
+		}
+		break
+	}
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[j.Name] = time.Now().UTC().Format(time.RFC3339)
+	if cm.ResourceVersion != "" {
+		err = j.Client.Update(ctx, cm)
+	} else if err = j.Client.Create(ctx, cm); apierrors.IsAlreadyExists(err) {
+		// created concurrently by another Admit
+		err = apierrors.NewConflict(corev1.Resource("configmaps"), cm.Name, err)
+	}
+	return 0, err == nil, err
+}
+
+// QueuedResult reports the queue position returned by Admit from a ConditionManager step,
+// e.g. "Queued (position 4)", the step exits and is retried after requeueAfter.
+// It returns nil if the Job has been admitted.
+func QueuedResult(position int, requeueAfter time.Duration) *specutil.ConditionResult {
+	if position == 0 {
+		return nil
+	}
+	return specutil.ConditionUnknown("Queued", "Queued (position %d)", position).
+		WithExit(reconcile.Result{RequeueAfter: requeueAfter})
+}
+
+func (j *JobBuilder) buildQueue() {
+	if j.Queue == nil {
+		return
+	}
+	if j.Job.Labels == nil {
+		j.Job.Labels = make(map[string]string)
+	}
+	j.Job.Labels[QueueLabel] = j.Queue.Name
+	j.Job.Annotations[PriorityAnnotation] = strconv.Itoa(int(j.Priority))
+	// new jobs wait for Admit, existing ones keep their admission
+	if j.Job.ResourceVersion == "" {
+		j.Job.Spec.Suspend = ptr.Of(true)
+	}
+}
+
+func jobDone(job *batchv1.Job) bool {
+	return jobHasCondition(job, batchv1.JobComplete) || jobHasCondition(job, batchv1.JobFailed)
+}
+
+func jobPriority(job *batchv1.Job) int {
+	p, _ := strconv.Atoi(job.Annotations[PriorityAnnotation])
+	return p
+}
@@ -0,0 +1,124 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package jobutil
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestQueueAdmit(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBuilder(t)
+	queue := &Queue{Name: "exports", MaxRunning: 1}
+	builders := map[string]*JobBuilder{}
+	for name, priority := range map[string]int32{"low": 0, "high": 10, "mid": 5} {
+		j := newTestBuilder(t)
+		j.Client = base.Client
+		j.Name = name
+		j.Queue = queue
+		j.Priority = priority
+		require.NoError(t, j.Build(ctx))
+		require.NoError(t, j.CreateOrUpdate(ctx))
+		assert.True(t, *j.Job.Spec.Suspend)
+		builders[name] = j
+	}
+
+	positions := map[string]int{}
+	for _, name := range []string{"low", "mid", "high"} {
+		pos, err := builders[name].Admit(ctx)
+		require.NoError(t, err)
+		positions[name] = pos
+	}
+	assert.Equal(t, map[string]int{"high": 0, "mid": 1, "low": 2}, positions)
+	assert.False(t, *builders["high"].Job.Spec.Suspend)
+
+	// a finished job frees its slot
+	high := builders["high"].Job
+	high.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	require.NoError(t, base.Client.Status().Update(ctx, high))
+	pos, err := builders["mid"].Admit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pos)
+	pos, err = builders["low"].Admit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pos)
+}
+
+func TestQueueAdmitConcurrent(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBuilder(t)
+	queue := &Queue{Name: "exports", MaxRunning: 1}
+	// the first update of the queue loses a race against another reconcile
+	conflicted := false
+	staleList := false
+	c := interceptor.NewClient(base.Client.(client.WithWatch), interceptor.Funcs{
+		Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if _, ok := obj.(*corev1.ConfigMap); ok && obj.GetName() == "jobutil-queue-exports" && !conflicted {
+				conflicted = true
+				return apierrors.NewConflict(corev1.Resource("configmaps"), obj.GetName(), errors.New("changed"))
+			}
+			return c.Update(ctx, obj, opts...)
+		},
+		// a cache that has not seen the admission of the other jobs yet
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			if err := c.List(ctx, list, opts...); err != nil {
+				return err
+			}
+			if jobs, ok := list.(*batchv1.JobList); ok && staleList {
+				for i := range jobs.Items {
+					jobs.Items[i].Spec.Suspend = ptr.Of(true)
+				}
+			}
+			return nil
+		},
+	})
+	builders := map[string]*JobBuilder{}
+	for _, name := range []string{"a", "b", "c"} {
+		j := newTestBuilder(t)
+		j.Client = c
+		j.Name = name
+		j.Queue = queue
+		require.NoError(t, j.Build(ctx))
+		require.NoError(t, j.CreateOrUpdate(ctx))
+		builders[name] = j
+	}
+	pos, err := builders["a"].Admit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pos)
+
+	// a failed job frees its slot
+	a := builders["a"].Job
+	a.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}}
+	require.NoError(t, c.Status().Update(ctx, a))
+	pos, err = builders["b"].Admit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pos)
+	assert.True(t, conflicted)
+	// an admitted job keeps its slot while a stale cache still lists it as suspended
+	staleList = true
+	pos, err = builders["c"].Admit(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, pos)
+	assert.True(t, *builders["c"].Job.Spec.Suspend)
+}
+
+func TestQueueScheduled(t *testing.T) {
+	j := newTestBuilder(t)
+	j.Queue = &Queue{Name: "exports", MaxRunning: 1}
+	j.Schedule = "@daily"
+	assert.ErrorContains(t, j.Build(context.Background()), "cannot be queued")
+}
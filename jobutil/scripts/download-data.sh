@@ -7,9 +7,15 @@ set -ex
 DATADIR=${DATADIR:-/data-dir}
 BUCKET=${BUCKET:-operator-private}
 OBJECT_KEY=${OBJECT_KEY:-$POD_NAME}
+INDEXED=${INDEXED:-false}
+# each completion index of an Indexed Job has its own data object
+if [[ "$INDEXED" == "true" ]]; then
+    OBJECT_KEY=${OBJECT_KEY%.tar.gz}/${JOB_COMPLETION_INDEX}.tar.gz
+fi
 DATA_S3_URI=s3://$BUCKET/$OBJECT_KEY
 AWS_ENDPOINT=${AWS_ENDPOINT:-}
 NEW_DATA_ON_RETRY=${NEW_DATA_ON_RETRY:-false}
+INPUT_OBJECT_KEYS=${INPUT_OBJECT_KEYS:-}
 
 if [[ "$(which aws)" == "" ]]; then
     apt update && apt install -y unzip
@@ -25,18 +31,65 @@ if [[ "$AWS_ENDPOINT" != "" ]]; then
     AWS="aws --endpoint-url=$AWS_ENDPOINT"
 fi
 
+# exists returns whether the object exists, s3 ls would also match the keys it prefixes, e.g. its logs
+exists() {
+    $AWS s3api head-object --bucket $BUCKET --key $1 >/dev/null 2>&1
+}
+
 # skip when data exists on s3 and NEW_DATA_ON_RETRY is true
 if [[ "$NEW_DATA_ON_RETRY" == "true" ]]; then
     if [[ "$DATA_S3_URI" != "" ]]; then
-        if $AWS s3 ls $DATA_S3_URI; then
+        if exists $OBJECT_KEY; then
             echo "[jobutil] skip downloading data, cause NEW_DATA_ON_RETRY is true"
             exit 0
         fi
     fi
 fi
 
+# extract an object into a staging dir and move it into the data dir once verified against its sha256,
+# so that a corrupted object leaves nothing behind for the next attempt. The sha256 is read from the
+# sidecar object, or from the metadata of the objects uploaded by previous versions.
+restore() {
+    local key=$1
+    local expected actual
+    local staging=$DATADIR/.jobutil-restore
+    if exists $key.sha256; then
+        expected=$($AWS s3 cp s3://$BUCKET/$key.sha256 -)
+    else
+        expected=$($AWS s3api head-object --bucket $BUCKET --key $key --query 'Metadata.sha256' --output text)
+    fi
+    rm -rf $staging /tmp/marker/restore.fifo /tmp/marker/restore.sha256
+    mkdir -p $staging
+    mkfifo /tmp/marker/restore.fifo
+    sha256sum </tmp/marker/restore.fifo | cut -d' ' -f1 >/tmp/marker/restore.sha256 &
+    local hash_pid=$!
+    # drain the stream after tar so that the whole object is hashed
+    set +e
+    $AWS s3 cp s3://$BUCKET/$key - | tee /tmp/marker/restore.fifo | { tar -xvzf - -C $staging/ && cat >/dev/null; }
+    local extracted=${PIPESTATUS[0]}${PIPESTATUS[2]}
+    set -e
+    wait $hash_pid
+    actual=0x$(cat /tmp/marker/restore.sha256)
+    if [[ "$extracted" != "00" ]] || [[ "$expected" != "None" && "$expected" != "" && "$expected" != "$actual" ]]; then
+        echo "[jobutil] data s3://$BUCKET/$key is corrupted, expected sha256 $expected, got $actual"
+        rm -rf $staging
+        exit 1
+    fi
+    # hard links move the files without copying them, merging with the data of previous objects
+    cp -alf $staging/. $DATADIR/
+    rm -rf $staging
+}
+
 set -x
-$AWS s3 ls $DATA_S3_URI && $AWS s3 cp $DATA_S3_URI - | tar -xvzf - -C $DATADIR/
+# restore the outputs of upstream jobs when this job has no data yet
+if [[ "$INPUT_OBJECT_KEYS" != "" ]] && ! exists $OBJECT_KEY; then
+    for key in $INPUT_OBJECT_KEYS; do
+        restore $key
+    done
+fi
+if exists $OBJECT_KEY; then
+    restore $OBJECT_KEY
+fi
 chmod -vR 777 $DATADIR
 chmod -vR 777 /tmp/marker
 rm -rf /tmp/marker/*
@@ -7,10 +7,18 @@ DATADIR=${DATADIR:-/data-dir}
 DONE_MARKER=/tmp/marker/done
 UPLOADED_MARKER=/tmp/marker/uploaded
 STARTER_SCRIPT=${STARTER_SCRIPT:-/scripts/starter.sh}
+PERSIST_LOGS=${PERSIST_LOGS:-false}
+# persisted logs are uploaded by the uploader as separate objects instead of being part of the data
+LOG_FILE=${DATADIR}/workload.log
+if [[ "$PERSIST_LOGS" == "true" ]]; then
+    LOG_FILE=/tmp/marker/workload.log
+fi
 set +e
 # set -x
 cp $STARTER_SCRIPT ${DATADIR}/starter.sh
-{ bash ${DATADIR}/starter.sh ; echo $? > $DONE_MARKER ; } | tee ${DATADIR}/workload.log
+# the uploader names the persisted attempt after the start time of the workload
+date -u +%Y%m%dT%H%M%SZ > /tmp/marker/started
+{ bash ${DATADIR}/starter.sh ; echo $? > $DONE_MARKER ; } | tee $LOG_FILE
 return_code=$(cat $DONE_MARKER)
 echo $return_code > ${DATADIR}/workload-status
 echo $return_code > ${DATADIR}/workload-status-$(date +%s)
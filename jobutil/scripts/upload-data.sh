@@ -9,11 +9,22 @@ UPLOADED_MARKER=/tmp/marker/uploaded
 
 BUCKET=${BUCKET:-operator-private}
 OBJECT_KEY=${OBJECT_KEY:-$POD_NAME}
+INDEXED=${INDEXED:-false}
+# each completion index of an Indexed Job has its own data object
+if [[ "$INDEXED" == "true" ]]; then
+    OBJECT_KEY=${OBJECT_KEY%.tar.gz}/${JOB_COMPLETION_INDEX}.tar.gz
+fi
 DATA_S3_URI=s3://$BUCKET/$OBJECT_KEY
+# the sha256 of the data is stored in a sidecar object, the streamed upload cannot set it as metadata upfront
+CHECKSUM_S3_URI=$DATA_S3_URI.sha256
 # https://docs.aws.amazon.com/AmazonS3/latest/userguide/acl-overview.html#canned-acl
 OBJECT_ACL=${OBJECT_ACL:-private}
 STORAGE_CLASS=${STORAGE_CLASS:-STANDARD}
 DATADIR=${DATADIR:-/data-dir}
+PERSIST_LOGS=${PERSIST_LOGS:-false}
+# key=value,... metadata identifying the owner of the data
+OWNER_METADATA=${OWNER_METADATA:-}
+LOGS_S3_URI=$DATA_S3_URI.logs
 
 if [[ "$DATA_S3_URI" == "" ]]; then
     exit "[jobutil] DATA_S3_URI is not set"
@@ -41,11 +52,33 @@ while [[ ! -f $DONE_MARKER ]]; do
 done
 return_code=$(cat $DONE_MARKER)
 
+if [[ "$PERSIST_LOGS" == "true" ]]; then
+    echo "[jobutil] uploading logs and exit status to s3"
+    ATTEMPT=$(cat /tmp/marker/started 2>/dev/null || date -u +%Y%m%dT%H%M%SZ)-${POD_NAME}
+    $AWS s3 cp /tmp/marker/workload.log "$LOGS_S3_URI/$ATTEMPT.log" || true
+    echo $return_code | $AWS s3 cp - "$LOGS_S3_URI/$ATTEMPT.status" || true
+fi
+
 echo "[jobutil] compressing and upload to s3"
 set +e
 set -x
-tar -cz --directory=$DATADIR . | $AWS s3 cp - "$DATA_S3_URI" --storage-class $STORAGE_CLASS --acl $OBJECT_ACL
+rm -f /tmp/marker/upload.fifo /tmp/marker/upload.sha256
+mkfifo /tmp/marker/upload.fifo
+sha256sum </tmp/marker/upload.fifo | cut -d' ' -f1 >/tmp/marker/upload.sha256 &
+hash_pid=$!
+tar -cz --directory=$DATADIR . | tee /tmp/marker/upload.fifo | $AWS s3 cp - "$DATA_S3_URI" --storage-class $STORAGE_CLASS --acl $OBJECT_ACL \
+    ${OWNER_METADATA:+--metadata $OWNER_METADATA}
 return_code=$?
+wait $hash_pid
+if [[ $return_code == 0 ]]; then
+    echo 0x$(cat /tmp/marker/upload.sha256) | $AWS s3 cp - "$CHECKSUM_S3_URI" --content-type text/plain \
+        --storage-class $STORAGE_CLASS --acl $OBJECT_ACL ${OWNER_METADATA:+--metadata $OWNER_METADATA}
+    return_code=$?
+    if [[ $return_code != 0 ]]; then
+        # the checksum of the previous data would fail the restore of the new one
+        $AWS s3 rm "$CHECKSUM_S3_URI"
+    fi
+fi
 echo $return_code >$UPLOADED_MARKER
 echo $return_code >$DATADIR/workload-status
 ls /tmp/marker
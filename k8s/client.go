@@ -20,10 +20,12 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"k8s.io/utils/env"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var (
 	clientset       *kubernetes.Clientset
+	ctrlClient      client.Client
 	config          *rest.Config
 	home            = homedir.HomeDir()
 	KUBECONFIG      = must.Default(os.Getenv("KUBECONFIG"), filepath.Join(home, ".kube", "config"))
@@ -35,26 +37,55 @@ var (
 	SERVICE_ACCOUNT = env.GetString("SERVICE_ACCOUNT", env.GetString("OPERATOR_SERVICEACCOUNT", "alt-operator"))
 )
 
-func GetClient() (cli *kubernetes.Clientset, err error) {
-	if clientset != nil {
-		return clientset, nil
+func GetConfig() (cfg *rest.Config, err error) {
+	if config != nil {
+		return config, nil
 	}
 	if _, err = os.Stat(KUBECONFIG); err == nil {
-		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		cfg, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
 			&clientcmd.ClientConfigLoadingRules{ExplicitPath: KUBECONFIG},
 			&clientcmd.ConfigOverrides{
 				CurrentContext: KUBECONTEXT,
 			}).ClientConfig()
 	} else {
-		config, err = rest.InClusterConfig()
+		cfg, err = rest.InClusterConfig()
 	}
 	if err != nil {
 		return nil, err
 	}
-	clientset, err := kubernetes.NewForConfig(config)
+	config = cfg
+	return cfg, nil
+}
+
+func GetClient() (cli *kubernetes.Clientset, err error) {
+	if clientset != nil {
+		return clientset, nil
+	}
+	cfg, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err = kubernetes.NewForConfig(cfg)
 	return clientset, err
 }
 
+// GetCtrlClient returns a controller-runtime client using the same config as GetClient
+func GetCtrlClient() (cli client.Client, err error) {
+	if ctrlClient != nil {
+		return ctrlClient, nil
+	}
+	cfg, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	cli, err = client.New(cfg, client.Options{})
+	if err != nil {
+		return nil, err
+	}
+	ctrlClient = cli
+	return cli, nil
+}
+
 func Logs(ctx context.Context, namespace, pod, container string) (string, error) {
 	clientset, err := GetClient()
 	if err != nil {
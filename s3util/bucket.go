@@ -0,0 +1,310 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	"github.com/alt-research/operator-kit/must"
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// BucketConfig is the desired configuration of a bucket, the settings left empty are not changed
+type BucketConfig struct {
+	// Region of the bucket when it is created, defaults to the region of the manager
+	Region string
+	// Versioning enables the versioning of the bucket if true, or suspends it if false and it was enabled,
+	// nil keeps the current state
+	Versioning *bool
+	// SSE is the default server side encryption of the objects, AES256 (SSE-S3) or aws:kms (SSE-KMS)
+	SSE types.ServerSideEncryption
+	// KMSKeyID is the KMS key of the default SSE-KMS, defaults to the AWS managed key
+	KMSKeyID string
+	// BlockPublicAccess blocks the public ACLs and policies of the bucket and its objects
+	BlockPublicAccess bool
+	// Lifecycle replaces all the lifecycle rules of the bucket, nil keeps the current ones and
+	// an empty slice removes them
+	Lifecycle []LifecycleRule
+}
+
+// LifecycleRule expires or transitions the objects under a prefix, the zero days are not set
+type LifecycleRule struct {
+	ID     string
+	Prefix string
+	// ExpireDays deletes the objects, or adds a delete marker in versioned buckets, days after their creation
+	ExpireDays int32
+	// TransitionDays moves the objects to TransitionStorageClass days after their creation
+	TransitionDays         int32
+	TransitionStorageClass types.TransitionStorageClass
+	// NoncurrentExpireDays deletes the versions days after they stopped being the latest one
+	NoncurrentExpireDays int32
+	// AbortIncompleteUploadDays aborts the multipart uploads days after they were initiated
+	AbortIncompleteUploadDays int32
+}
+
+// validate rejects the rules which S3 would reject, or which would do nothing
+func (r LifecycleRule) validate() error {
+	if r.ExpireDays == 0 && r.TransitionDays == 0 && r.NoncurrentExpireDays == 0 && r.AbortIncompleteUploadDays == 0 {
+		return errors.Errorf("lifecycle rule %q has no action, at least one of its days must be set", r.ID)
+	}
+	if r.ExpireDays < 0 || r.TransitionDays < 0 || r.NoncurrentExpireDays < 0 || r.AbortIncompleteUploadDays < 0 {
+		return errors.Errorf("lifecycle rule %q has negative days", r.ID)
+	}
+	if r.TransitionDays > 0 && r.TransitionStorageClass == "" {
+		return errors.Errorf("lifecycle rule %q has no transition storage class", r.ID)
+	}
+	return nil
+}
+
+func (r LifecycleRule) toSDK() types.LifecycleRule {
+	rule := types.LifecycleRule{
+		ID:     ptr.Of(r.ID),
+		Status: types.ExpirationStatusEnabled,
+		Filter: &types.LifecycleRuleFilterMemberPrefix{Value: r.Prefix},
+	}
+	if r.ExpireDays > 0 {
+		rule.Expiration = &types.LifecycleExpiration{Days: ptr.Of(r.ExpireDays)}
+	}
+	if r.TransitionDays > 0 {
+		rule.Transitions = []types.Transition{{Days: ptr.Of(r.TransitionDays), StorageClass: r.TransitionStorageClass}}
+	}
+	if r.NoncurrentExpireDays > 0 {
+		rule.NoncurrentVersionExpiration = &types.NoncurrentVersionExpiration{NoncurrentDays: ptr.Of(r.NoncurrentExpireDays)}
+	}
+	if r.AbortIncompleteUploadDays > 0 {
+		rule.AbortIncompleteMultipartUpload = &types.AbortIncompleteMultipartUpload{DaysAfterInitiation: ptr.Of(r.AbortIncompleteUploadDays)}
+	}
+	return rule
+}
+
+// lifecycleRuleFromSDK converts a rule of the bucket, ok is false for the rules which cannot be expressed
+// by LifecycleRule and must be replaced
+func lifecycleRuleFromSDK(rule types.LifecycleRule) (r LifecycleRule, ok bool) {
+	if rule.Status != types.ExpirationStatusEnabled || len(rule.Transitions) > 1 || len(rule.NoncurrentVersionTransitions) > 0 {
+		return r, false
+	}
+	r.ID = aws.ToString(rule.ID)
+	switch filter := rule.Filter.(type) {
+	case *types.LifecycleRuleFilterMemberPrefix:
+		r.Prefix = filter.Value
+	case nil:
+		r.Prefix = aws.ToString(rule.Prefix)
+	default:
+		return r, false
+	}
+	if e := rule.Expiration; e != nil {
+		if e.Date != nil || aws.ToBool(e.ExpiredObjectDeleteMarker) {
+			return r, false
+		}
+		r.ExpireDays = aws.ToInt32(e.Days)
+	}
+	if len(rule.Transitions) == 1 {
+		if rule.Transitions[0].Date != nil {
+			return r, false
+		}
+		r.TransitionDays = aws.ToInt32(rule.Transitions[0].Days)
+		r.TransitionStorageClass = rule.Transitions[0].StorageClass
+	}
+	if e := rule.NoncurrentVersionExpiration; e != nil {
+		if e.NewerNoncurrentVersions != nil {
+			return r, false
+		}
+		r.NoncurrentExpireDays = aws.ToInt32(e.NoncurrentDays)
+	}
+	if a := rule.AbortIncompleteMultipartUpload; a != nil {
+		r.AbortIncompleteUploadDays = aws.ToInt32(a.DaysAfterInitiation)
+	}
+	return r, true
+}
+
+// EnsureBucket creates the bucket if it does not exist and applies the configuration, only the settings
+// which differ from the current ones are updated so that it can be called on every reconcile.
+// It returns the names of the updated settings: created, versioning, encryption, publicAccessBlock and lifecycle.
+func (b *BucketManager) EnsureBucket(ctx context.Context, cfg BucketConfig) ([]string, error) {
+	log := log.FromContext(ctx).WithValues("bucket", b.Bucket)
+	// the configuration is checked before anything is changed
+	for _, r := range cfg.Lifecycle {
+		if err := r.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid lifecycle of bucket %s", b.Bucket)
+		}
+	}
+	var changed []string
+	created, err := b.createBucket(ctx, must.Default(cfg.Region, b.Region))
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		changed = append(changed, "created")
+	}
+	steps := []struct {
+		name  string
+		apply func(context.Context, BucketConfig) (bool, error)
+	}{
+		{"versioning", b.ensureVersioning},
+		{"encryption", b.ensureEncryption},
+		{"publicAccessBlock", b.ensurePublicAccessBlock},
+		{"lifecycle", b.ensureLifecycle},
+	}
+	for _, step := range steps {
+		updated, err := step.apply(ctx, cfg)
+		if err != nil {
+			return changed, errors.Wrapf(err, "failed to ensure %s of bucket %s", step.name, b.Bucket)
+		}
+		if updated {
+			changed = append(changed, step.name)
+		}
+	}
+	if len(changed) > 0 {
+		log.Info("Updated bucket", "changed", changed)
+	}
+	return changed, nil
+}
+
+func (b *BucketManager) createBucket(ctx context.Context, region string) (bool, error) {
+	_, err := b.client.HeadBucket(ctx, &awss3.HeadBucketInput{Bucket: &b.Bucket})
+	if err == nil {
+		return false, nil
+	}
+	if !IsNotFound(err) {
+		return false, errors.Wrapf(err, "failed to get bucket %s", b.Bucket)
+	}
+	input := &awss3.CreateBucketInput{Bucket: &b.Bucket}
+	// us-east-1 is the default location and cannot be given as constraint
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{LocationConstraint: types.BucketLocationConstraint(region)}
+	}
+	if _, err = b.client.CreateBucket(ctx, input); err != nil {
+		if ErrorCode(err) == "BucketAlreadyOwnedByYou" {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to create bucket %s", b.Bucket)
+	}
+	return true, nil
+}
+
+func (b *BucketManager) ensureVersioning(ctx context.Context, cfg BucketConfig) (bool, error) {
+	if cfg.Versioning == nil {
+		return false, nil
+	}
+	out, err := b.client.GetBucketVersioning(ctx, &awss3.GetBucketVersioningInput{Bucket: &b.Bucket})
+	if err != nil {
+		return false, err
+	}
+	status := types.BucketVersioningStatusEnabled
+	if !*cfg.Versioning {
+		// versioning cannot be disabled once enabled, only suspended
+		if out.Status != types.BucketVersioningStatusEnabled {
+			return false, nil
+		}
+		status = types.BucketVersioningStatusSuspended
+	} else if out.Status == types.BucketVersioningStatusEnabled {
+		return false, nil
+	}
+	_, err = b.client.PutBucketVersioning(ctx, &awss3.PutBucketVersioningInput{
+		Bucket:                  &b.Bucket,
+		VersioningConfiguration: &types.VersioningConfiguration{Status: status},
+	})
+	return err == nil, err
+}
+
+func (b *BucketManager) ensureEncryption(ctx context.Context, cfg BucketConfig) (bool, error) {
+	if cfg.SSE == "" {
+		return false, nil
+	}
+	want := types.ServerSideEncryptionByDefault{SSEAlgorithm: cfg.SSE, KMSMasterKeyID: optional(cfg.KMSKeyID)}
+	out, err := b.client.GetBucketEncryption(ctx, &awss3.GetBucketEncryptionInput{Bucket: &b.Bucket})
+	if err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	if err == nil && out.ServerSideEncryptionConfiguration != nil {
+		for _, rule := range out.ServerSideEncryptionConfiguration.Rules {
+			if d := rule.ApplyServerSideEncryptionByDefault; d != nil && d.SSEAlgorithm == want.SSEAlgorithm &&
+				aws.ToString(d.KMSMasterKeyID) == cfg.KMSKeyID {
+				return false, nil
+			}
+		}
+	}
+	_, err = b.client.PutBucketEncryption(ctx, &awss3.PutBucketEncryptionInput{
+		Bucket: &b.Bucket,
+		ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+			Rules: []types.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: &want}},
+		},
+	})
+	return err == nil, err
+}
+
+func (b *BucketManager) ensurePublicAccessBlock(ctx context.Context, cfg BucketConfig) (bool, error) {
+	if !cfg.BlockPublicAccess {
+		return false, nil
+	}
+	out, err := b.client.GetPublicAccessBlock(ctx, &awss3.GetPublicAccessBlockInput{Bucket: &b.Bucket})
+	if err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	if err == nil && out.PublicAccessBlockConfiguration != nil {
+		c := out.PublicAccessBlockConfiguration
+		if aws.ToBool(c.BlockPublicAcls) && aws.ToBool(c.IgnorePublicAcls) && aws.ToBool(c.BlockPublicPolicy) && aws.ToBool(c.RestrictPublicBuckets) {
+			return false, nil
+		}
+	}
+	_, err = b.client.PutPublicAccessBlock(ctx, &awss3.PutPublicAccessBlockInput{
+		Bucket: &b.Bucket,
+		PublicAccessBlockConfiguration: &types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	return err == nil, err
+}
+
+func (b *BucketManager) ensureLifecycle(ctx context.Context, cfg BucketConfig) (bool, error) {
+	if cfg.Lifecycle == nil {
+		return false, nil
+	}
+	want := append([]LifecycleRule{}, cfg.Lifecycle...)
+	sort.Slice(want, func(i, j int) bool { return want[i].ID < want[j].ID })
+	out, err := b.client.GetBucketLifecycleConfiguration(ctx, &awss3.GetBucketLifecycleConfigurationInput{Bucket: &b.Bucket})
+	if err != nil && !IsNotFound(err) {
+		return false, err
+	}
+	current := []LifecycleRule{}
+	if err == nil {
+		for _, rule := range out.Rules {
+			r, ok := lifecycleRuleFromSDK(rule)
+			if !ok {
+				current = nil
+				break
+			}
+			current = append(current, r)
+		}
+		sort.Slice(current, func(i, j int) bool { return current[i].ID < current[j].ID })
+	}
+	if current != nil && reflect.DeepEqual(current, want) {
+		return false, nil
+	}
+	if len(want) == 0 {
+		_, err = b.client.DeleteBucketLifecycle(ctx, &awss3.DeleteBucketLifecycleInput{Bucket: &b.Bucket})
+		return err == nil, err
+	}
+	rules := make([]types.LifecycleRule, 0, len(want))
+	for _, r := range want {
+		rules = append(rules, r.toSDK())
+	}
+	_, err = b.client.PutBucketLifecycleConfiguration(ctx, &awss3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 &b.Bucket,
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return err == nil, err
+}
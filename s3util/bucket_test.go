@@ -0,0 +1,77 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleRuleRoundTrip(t *testing.T) {
+	rule := LifecycleRule{
+		ID:                     "jobutil",
+		Prefix:                 "jobutil/",
+		ExpireDays:             30,
+		TransitionDays:         7,
+		TransitionStorageClass: types.TransitionStorageClassGlacier,
+	}
+	r, ok := lifecycleRuleFromSDK(rule.toSDK())
+	assert.True(t, ok)
+	assert.Equal(t, rule, r)
+
+	tagged := rule.toSDK()
+	tagged.Filter = &types.LifecycleRuleFilterMemberTag{Value: types.Tag{Key: aws.String("k"), Value: aws.String("v")}}
+	_, ok = lifecycleRuleFromSDK(tagged)
+	assert.False(t, ok)
+}
+
+func TestIsNotFound(t *testing.T) {
+	err := errors.Wrap(&smithy.GenericAPIError{Code: "NoSuchLifecycleConfiguration"}, "get lifecycle")
+	assert.Equal(t, "NoSuchLifecycleConfiguration", ErrorCode(err))
+	assert.True(t, IsNotFound(err))
+	assert.False(t, IsNotFound(&smithy.GenericAPIError{Code: "AccessDenied"}))
+	assert.False(t, IsNotFound(errors.New("timeout")))
+}
+
+func TestEnsureBucket(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newFakeManager(t, "")
+	versioning := func() types.BucketVersioningStatus {
+		out, err := b.client.GetBucketVersioning(ctx, &awss3.GetBucketVersioningInput{Bucket: &b.Bucket})
+		require.NoError(t, err)
+		return out.Status
+	}
+	changed, err := b.EnsureBucket(ctx, BucketConfig{Versioning: ptr.Of(true)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"versioning"}, changed)
+
+	// an unset versioning keeps the bucket versioned
+	changed, err = b.EnsureBucket(ctx, BucketConfig{})
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+	assert.Equal(t, types.BucketVersioningStatusEnabled, versioning())
+
+	changed, err = b.EnsureBucket(ctx, BucketConfig{Versioning: ptr.Of(false)})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"versioning"}, changed)
+	assert.Equal(t, types.BucketVersioningStatusSuspended, versioning())
+
+	// invalid rules are rejected before the bucket is changed
+	_, err = b.EnsureBucket(ctx, BucketConfig{Versioning: ptr.Of(true), Lifecycle: []LifecycleRule{{ID: "noop", Prefix: "tmp/"}}})
+	assert.ErrorContains(t, err, `lifecycle rule "noop" has no action`)
+	assert.Equal(t, types.BucketVersioningStatusSuspended, versioning())
+	_, err = b.EnsureBucket(ctx, BucketConfig{Lifecycle: []LifecycleRule{{ID: "archive", TransitionDays: 7}}})
+	assert.ErrorContains(t, err, "no transition storage class")
+}
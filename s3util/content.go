@@ -0,0 +1,105 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Metadata keys set by OwnerMetadata
+const (
+	OwnerKindMetadataKey      = "owner-kind"
+	OwnerNamespaceMetadataKey = "owner-namespace"
+	OwnerNameMetadataKey      = "owner-name"
+	OwnerUIDMetadataKey       = "owner-uid"
+	// OwnerAPIVersionMetadataKey is the API version of the owner kind, to be set along with OwnerMetadata
+	// when the owner has to be looked up, e.g. by the jobutil garbage collector
+	OwnerAPIVersionMetadataKey = "owner-api-version"
+)
+
+// OwnerMetadata returns the object metadata identifying the resource which produced an object,
+// to be merged into UploadOptions.Metadata
+func OwnerMetadata(kind string, owner metav1.Object) map[string]string {
+	return map[string]string{
+		OwnerKindMetadataKey:      kind,
+		OwnerNamespaceMetadataKey: owner.GetNamespace(),
+		OwnerNameMetadataKey:      owner.GetName(),
+		OwnerUIDMetadataKey:       string(owner.GetUID()),
+	}
+}
+
+// applyContent sets the content headers of the upload, the content type is detected from the key
+// extension or else from the content when not set
+func (opts *UploadOptions) applyContent(input *awss3.PutObjectInput) {
+	if opts != nil {
+		input.ContentType = optional(opts.ContentType)
+		input.ContentEncoding = optional(opts.ContentEncoding)
+		input.CacheControl = optional(opts.CacheControl)
+		input.ContentDisposition = optional(opts.ContentDisposition)
+	}
+	if input.ContentType == nil {
+		var contentType string
+		contentType, input.Body = detectContentType(*input.Key, input.Body)
+		input.ContentType = &contentType
+	}
+}
+
+// contentTypes pins the content type of common extensions, which vary with the mime tables of the host,
+// e.g. .gz is application/x-gzip on some distributions and unknown to the Go builtin table
+var contentTypes = map[string]string{
+	".json": "application/json",
+	".gz":   "application/gzip",
+	".tgz":  "application/gzip",
+	".tar":  "application/x-tar",
+	".txt":  "text/plain; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+}
+
+// detectContentType returns the content type of the key extension, or sniffs it from the first bytes
+// of body, in which case the returned reader must be read instead of body. Seekable bodies are returned
+// as is so that the uploader can still size them, other bodies are buffered.
+func detectContentType(key string, body io.Reader) (string, io.Reader) {
+	ext := strings.ToLower(path.Ext(key))
+	if contentType, ok := contentTypes[ext]; ok {
+		return contentType, body
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType, body
+	}
+	head := make([]byte, 512)
+	if seeker, ok := body.(io.ReadSeeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			var n int
+			if r, ok := body.(io.ReaderAt); ok {
+				n, _ = r.ReadAt(head, offset)
+			} else {
+				n, _ = io.ReadFull(seeker, head)
+				// a body which cannot seek back fails the upload, which seeks it too
+				_, _ = seeker.Seek(offset, io.SeekStart)
+			}
+			return http.DetectContentType(head[:n]), body
+		}
+	}
+	buf := bufio.NewReaderSize(body, len(head))
+	head, _ = buf.Peek(len(head))
+	return http.DetectContentType(head), buf
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,59 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyContent(t *testing.T) {
+	key := "chain/spec.json"
+	input := &awss3.PutObjectInput{Key: &key, Body: strings.NewReader("{}")}
+	(&UploadOptions{CacheControl: "max-age=60"}).applyContent(input)
+	assert.Equal(t, "application/json", *input.ContentType)
+	assert.Equal(t, "max-age=60", *input.CacheControl)
+	assert.Nil(t, input.ContentDisposition)
+
+	// sniffed from the content, which is still fully readable
+	key = "chain/genesis"
+	input = &awss3.PutObjectInput{Key: &key, Body: strings.NewReader("<html><body>genesis</body></html>")}
+	(*UploadOptions)(nil).applyContent(input)
+	assert.Equal(t, "text/html; charset=utf-8", *input.ContentType)
+	body, err := io.ReadAll(input.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<html><body>genesis</body></html>", string(body))
+
+	// a seekable body is sniffed in place from its current offset
+	seekable := strings.NewReader("..<html></html>")
+	_, err = seekable.Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	input = &awss3.PutObjectInput{Key: &key, Body: seekable}
+	(*UploadOptions)(nil).applyContent(input)
+	assert.Equal(t, "text/html; charset=utf-8", *input.ContentType)
+	assert.Same(t, seekable, input.Body)
+	body, err = io.ReadAll(input.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "<html></html>", string(body))
+
+	// pinned whatever the mime tables of the host
+	for key, contentType := range map[string]string{"data.tar.gz": "application/gzip", "a/SPEC.JSON": "application/json"} {
+		input = &awss3.PutObjectInput{Key: &key, Body: strings.NewReader("")}
+		(*UploadOptions)(nil).applyContent(input)
+		assert.Equal(t, contentType, *input.ContentType, key)
+	}
+
+	key = "chain/genesis"
+	input = &awss3.PutObjectInput{Key: &key, Body: strings.NewReader("")}
+	(&UploadOptions{ContentType: "application/x-tar", ContentEncoding: "gzip"}).applyContent(input)
+	assert.Equal(t, "application/x-tar", *input.ContentType)
+	assert.Equal(t, "gzip", *input.ContentEncoding)
+}
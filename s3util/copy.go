@@ -0,0 +1,371 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alt-research/operator-kit/maputil"
+	"github.com/alt-research/operator-kit/must"
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultCopyPartSize is the size of the parts of a multipart copy, the objects up to this size are copied
+	// by a single CopyObject request
+	DefaultCopyPartSize = 512 << 20
+	// maxCopyObjectSize is the largest object CopyObject can copy
+	maxCopyObjectSize = 5 << 30
+	maxParts          = 10000
+)
+
+type CopyOptions struct {
+	// Upload replaces the metadata, content headers, ACL, storage class and tagging of the copies,
+	// by default the metadata and content headers of the source are kept
+	Upload *UploadOptions
+	// PartSize is the size of the parts of a multipart copy, defaults to DefaultCopyPartSize
+	PartSize int64
+	// StreamThrough downloads and uploads the objects instead of copying them on the server, it is the default
+	// when the source and the destination are on different endpoints or use different client side encryption
+	// keys, and the fallback when the destination is not allowed to read the source, e.g. in another account
+	StreamThrough bool
+}
+
+type CopyOutput struct {
+	SrcKey    string
+	Key       string
+	VersionID string
+	ETag      string
+	Size      int64
+	// ServerSide is false when the object was streamed through the client
+	ServerSide bool
+}
+
+// Copy copies an object to dstKey of the dst bucket, or of the same bucket if dst is nil.
+// The object is copied on the server when possible, by parts when larger than the part size,
+// otherwise it is streamed through the client and reencrypted with the encryption of dst.
+func (b *BucketManager) Copy(ctx context.Context, srcKey string, dst *BucketManager, dstKey string, opts *CopyOptions) (*CopyOutput, error) {
+	if dst == nil {
+		dst = b
+	}
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	head, err := b.HeadObject(ctx, srcKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", srcKey)
+	}
+	size := aws.ToInt64(head.ContentLength)
+	if !opts.StreamThrough && b.Opts.Endpoint == dst.Opts.Endpoint && bytes.Equal(clientKey(b.Encryption), clientKey(dst.Encryption)) {
+		out, err := b.copyServerSide(ctx, head, dst, dstKey, opts)
+		if err == nil {
+			out.Size = size
+			return out, nil
+		}
+		if ErrorCode(err) != "AccessDenied" {
+			return nil, errors.Wrapf(err, "failed to copy %s to %s", srcKey, dstKey)
+		}
+		log.FromContext(ctx).Info("Server side copy denied, streaming through", "srcBucket", b.Bucket, "key", srcKey, "dstBucket", dst.Bucket)
+	}
+	out, err := b.copyStream(ctx, head, dst, dstKey, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to copy %s to %s", srcKey, dstKey)
+	}
+	out.Size = size
+	return out, nil
+}
+
+// CopyPrefix copies the objects under srcPrefix to dstPrefix, replacing srcPrefix in their keys,
+// up to the configured concurrency of objects at a time
+func (b *BucketManager) CopyPrefix(ctx context.Context, srcPrefix string, dst *BucketManager, dstPrefix string, opts *CopyOptions) ([]CopyOutput, error) {
+	keys, err := b.List(ctx, srcPrefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		outs []CopyOutput
+		mu   sync.Mutex
+	)
+	errG, ctx := errgroup.WithContext(ctx)
+	for _, obj := range keys {
+		key := obj.Key
+		errG.Go(func() error {
+			if err := b.sem.Acquire(ctx, 1); err != nil {
+				return errors.Wrap(err, "Failed to acquire semaphore")
+			}
+			defer b.sem.Release(1)
+			out, err := b.Copy(ctx, key, dst, dstPrefix+strings.TrimPrefix(key, srcPrefix), opts)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			outs = append(outs, *out)
+			return nil
+		})
+	}
+	err = errG.Wait()
+	sort.Slice(outs, func(i, j int) bool { return outs[i].Key < outs[j].Key })
+	return outs, err
+}
+
+// Move copies an object like Copy then deletes the source
+func (b *BucketManager) Move(ctx context.Context, srcKey string, dst *BucketManager, dstKey string, opts *CopyOptions) (*CopyOutput, error) {
+	if dst == nil {
+		dst = b
+	}
+	if b.sameBucket(dst) && srcKey == dstKey {
+		return nil, errors.Errorf("cannot move %s onto itself", srcKey)
+	}
+	out, err := b.Copy(ctx, srcKey, dst, dstKey, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, b.DeleteSingle(ctx, srcKey)
+}
+
+// MovePrefix copies the objects under srcPrefix like CopyPrefix then deletes the copied sources,
+// the sources are kept if any copy fails
+func (b *BucketManager) MovePrefix(ctx context.Context, srcPrefix string, dst *BucketManager, dstPrefix string, opts *CopyOptions) ([]CopyOutput, error) {
+	if dst == nil {
+		dst = b
+	}
+	if b.sameBucket(dst) && (strings.HasPrefix(srcPrefix, dstPrefix) || strings.HasPrefix(dstPrefix, srcPrefix)) {
+		return nil, errors.Errorf("cannot move %s to the overlapping prefix %s", srcPrefix, dstPrefix)
+	}
+	outs, err := b.CopyPrefix(ctx, srcPrefix, dst, dstPrefix, opts)
+	if err != nil {
+		return outs, err
+	}
+	keys := make([]types.ObjectIdentifier, 0, len(outs))
+	for _, out := range outs {
+		keys = append(keys, types.ObjectIdentifier{Key: ptr.Of(out.SrcKey)})
+	}
+	_, err = b.deleteKeys(ctx, keys)
+	return outs, err
+}
+
+func (b *BucketManager) sameBucket(other *BucketManager) bool {
+	return b.Bucket == other.Bucket && b.Opts.Endpoint == other.Opts.Endpoint
+}
+
+func clientKey(e *Encryption) []byte {
+	if e == nil {
+		return nil
+	}
+	return e.ClientKey
+}
+
+// copySource is the x-amz-copy-source of an object, or of a version of it
+func copySource(bucket, key, versionID string) *string {
+	source := bucket + "/" + EscapeKey(key)
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+	return &source
+}
+
+// copyUploadOptions returns the attributes of the copy, those of opts or else those of the source.
+// The client side encryption metadata is removed, it is kept by server side copies and recreated by uploads.
+func copyUploadOptions(head HeadObjectOutput, opts *CopyOptions) *UploadOptions {
+	up := &UploadOptions{
+		Metadata:           head.Metadata,
+		ContentType:        aws.ToString(head.ContentType),
+		ContentEncoding:    aws.ToString(head.ContentEncoding),
+		CacheControl:       aws.ToString(head.CacheControl),
+		ContentDisposition: aws.ToString(head.ContentDisposition),
+	}
+	if opts.Upload != nil {
+		*up = *opts.Upload
+	}
+	maputil.Copy(&up.Metadata, up.Metadata)
+	for _, k := range []string{cseAlgMetadataKey, cseKeyMetadataKey, cseNonceMetadataKey} {
+		delete(up.Metadata, k)
+	}
+	return up
+}
+
+// cseMetadata returns the client side encryption metadata of an object
+func cseMetadata(metadata map[string]string) map[string]string {
+	cse := map[string]string{}
+	for _, k := range []string{cseAlgMetadataKey, cseKeyMetadataKey, cseNonceMetadataKey} {
+		if v, ok := metadata[k]; ok {
+			cse[k] = v
+		}
+	}
+	return cse
+}
+
+func (b *BucketManager) copyServerSide(ctx context.Context, head HeadObjectOutput, dst *BucketManager, dstKey string, opts *CopyOptions) (*CopyOutput, error) {
+	up := copyUploadOptions(head, opts)
+	maputil.MergeOverwrite(&up.Metadata, cseMetadata(head.Metadata))
+	if err := dst.Encryption.validate(); err != nil {
+		return nil, err
+	}
+	size := aws.ToInt64(head.ContentLength)
+	partSize := must.Default(opts.PartSize, DefaultCopyPartSize)
+	if size > partSize || size > maxCopyObjectSize {
+		return b.copyMultipart(ctx, head, dst, dstKey, up, partSize)
+	}
+	input := &awss3.CopyObjectInput{
+		Bucket:             &dst.Bucket,
+		Key:                &dstKey,
+		CopySource:         copySource(b.Bucket, head.Key, aws.ToString(head.VersionId)),
+		MetadataDirective:  types.MetadataDirectiveReplace,
+		Metadata:           up.Metadata,
+		ContentType:        optional(up.ContentType),
+		ContentEncoding:    optional(up.ContentEncoding),
+		CacheControl:       optional(up.CacheControl),
+		ContentDisposition: optional(up.ContentDisposition),
+		ACL:                up.ACL,
+		StorageClass:       up.StorageClass,
+	}
+	if up.Tagging != nil {
+		input.Tagging, input.TaggingDirective = up.Tagging, types.TaggingDirectiveReplace
+	}
+	if e := dst.Encryption; e != nil {
+		input.ServerSideEncryption, input.SSEKMSKeyId = e.SSE, optional(e.KMSKeyID)
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = e.customerKey()
+	}
+	input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = b.Encryption.customerKey()
+	out, err := dst.client.CopyObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	rst := &CopyOutput{SrcKey: head.Key, Key: dstKey, VersionID: aws.ToString(out.VersionId), ServerSide: true}
+	if out.CopyObjectResult != nil {
+		rst.ETag = aws.ToString(out.CopyObjectResult.ETag)
+	}
+	return rst, nil
+}
+
+func (b *BucketManager) copyMultipart(ctx context.Context, head HeadObjectOutput, dst *BucketManager, dstKey string, up *UploadOptions, partSize int64) (*CopyOutput, error) {
+	size := aws.ToInt64(head.ContentLength)
+	for size > partSize*maxParts {
+		partSize *= 2
+	}
+	create := &awss3.CreateMultipartUploadInput{
+		Bucket:             &dst.Bucket,
+		Key:                &dstKey,
+		Metadata:           up.Metadata,
+		ContentType:        optional(up.ContentType),
+		ContentEncoding:    optional(up.ContentEncoding),
+		CacheControl:       optional(up.CacheControl),
+		ContentDisposition: optional(up.ContentDisposition),
+		ACL:                up.ACL,
+		StorageClass:       up.StorageClass,
+		Tagging:            up.Tagging,
+	}
+	if e := dst.Encryption; e != nil {
+		create.ServerSideEncryption, create.SSEKMSKeyId = e.SSE, optional(e.KMSKeyID)
+		create.SSECustomerAlgorithm, create.SSECustomerKey, create.SSECustomerKeyMD5 = e.customerKey()
+	}
+	mp, err := dst.client.CreateMultipartUpload(ctx, create)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]types.CompletedPart, (size+partSize-1)/partSize)
+	errG, partCtx := errgroup.WithContext(ctx)
+	errG.SetLimit(5)
+	for i := range parts {
+		i := i
+		errG.Go(func() error {
+			start := int64(i) * partSize
+			end := start + partSize
+			if end > size {
+				end = size
+			}
+			input := &awss3.UploadPartCopyInput{
+				Bucket:          &dst.Bucket,
+				Key:             &dstKey,
+				UploadId:        mp.UploadId,
+				PartNumber:      ptr.Of(int32(i + 1)),
+				CopySource:      copySource(b.Bucket, head.Key, aws.ToString(head.VersionId)),
+				CopySourceRange: ptr.Of(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+			}
+			input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = dst.Encryption.customerKey()
+			input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = b.Encryption.customerKey()
+			out, err := dst.client.UploadPartCopy(partCtx, input)
+			if err != nil {
+				return errors.Wrapf(err, "failed to copy part %d", i+1)
+			}
+			parts[i] = types.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: input.PartNumber}
+			return nil
+		})
+	}
+	if err = errG.Wait(); err == nil {
+		var out *awss3.CompleteMultipartUploadOutput
+		out, err = dst.client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+			Bucket:          &dst.Bucket,
+			Key:             &dstKey,
+			UploadId:        mp.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err == nil {
+			return &CopyOutput{SrcKey: head.Key, Key: dstKey, VersionID: aws.ToString(out.VersionId), ETag: aws.ToString(out.ETag), ServerSide: true}, nil
+		}
+	}
+	if _, abortErr := dst.client.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{
+		Bucket:   &dst.Bucket,
+		Key:      &dstKey,
+		UploadId: mp.UploadId,
+	}); abortErr != nil {
+		log.FromContext(ctx).Error(abortErr, "Failed to abort multipart copy", "bucket", dst.Bucket, "key", dstKey)
+	}
+	return nil, err
+}
+
+func (b *BucketManager) copyStream(ctx context.Context, head HeadObjectOutput, dst *BucketManager, dstKey string, opts *CopyOptions) (*CopyOutput, error) {
+	body, err := b.openObject(ctx, head.Key, aws.ToString(head.VersionId))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	up, err := dst.putObject(ctx, dstKey, body, copyUploadOptions(head, opts))
+	if err != nil {
+		return nil, err
+	}
+	return &CopyOutput{SrcKey: head.Key, Key: dstKey, VersionID: aws.ToString(up.VersionID), ETag: aws.ToString(up.ETag)}, nil
+}
+
+// openObject returns the content of an object, decrypted if client side encrypted
+func (b *BucketManager) openObject(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	input := &awss3.GetObjectInput{
+		Bucket:    &b.Bucket,
+		Key:       &key,
+		VersionId: optional(versionID),
+	}
+	b.Encryption.applyGet(input)
+	out, err := b.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	if b.Encryption == nil || b.Encryption.ClientKey == nil {
+		return out.Body, nil
+	}
+	plain, err := b.Encryption.decryptReader(out.Body, out.Metadata)
+	if err != nil {
+		out.Body.Close()
+		return nil, errors.Wrapf(err, "failed to open %s", key)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, out.Body}, nil
+}
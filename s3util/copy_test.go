@@ -0,0 +1,80 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyServerSide(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu     sync.Mutex
+		copies = map[string]http.Header{}
+		ranges []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Amz-Meta-Owner-Name", "devnet")
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && q.Has("partNumber"):
+			ranges = append(ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"p%s"</ETag></CopyPartResult>`, q.Get("partNumber"))
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><ETag>"m-3"</ETag></CompleteMultipartUploadResult>`)
+		case r.Method == http.MethodPut:
+			copies[r.URL.Path] = r.Header
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"e"</ETag></CopyObjectResult>`)
+		}
+	}))
+	defer srv.Close()
+	client := awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 2)
+	require.NoError(t, err)
+
+	out, err := b.Copy(ctx, "staging/spec.json", nil, "release/spec.json", nil)
+	require.NoError(t, err)
+	assert.True(t, out.ServerSide)
+	assert.Equal(t, int64(10), out.Size)
+	header := copies["/test/release/spec.json"]
+	require.NotNil(t, header)
+	assert.Equal(t, "test/staging/spec.json", header.Get("X-Amz-Copy-Source"))
+	assert.Equal(t, "REPLACE", header.Get("X-Amz-Metadata-Directive"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+	assert.Equal(t, "devnet", header.Get("X-Amz-Meta-Owner-Name"))
+
+	out, err = b.Copy(ctx, "staging/snapshot", nil, "release/snapshot", &CopyOptions{PartSize: 4})
+	require.NoError(t, err)
+	assert.Equal(t, `"m-3"`, out.ETag)
+	sort.Strings(ranges)
+	assert.Equal(t, []string{"bytes=0-3", "bytes=4-7", "bytes=8-9"}, ranges)
+
+	_, err = b.MovePrefix(ctx, "staging/", nil, "staging/old/", nil)
+	assert.ErrorContains(t, err, "overlapping")
+}
@@ -0,0 +1,293 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CSEAlgorithm is the client side encryption algorithm, the content is split in chunks
+	// of CSEChunkSize bytes sealed with AES-256-GCM by a random data key
+	CSEAlgorithm = "AES256-GCM-64K"
+	CSEChunkSize = 64 << 10
+
+	cseAlgMetadataKey   = "cse-alg"
+	cseKeyMetadataKey   = "cse-key"
+	cseNonceMetadataKey = "cse-nonce"
+)
+
+var (
+	// ErrNotEncrypted is returned when downloading an object which is not client side encrypted with a client key
+	ErrNotEncrypted = errors.New("object is not client side encrypted")
+	// ErrDecrypt is returned when a client side encrypted object cannot be decrypted, because of a wrong key,
+	// a corrupted or truncated content
+	ErrDecrypt = errors.New("failed to decrypt object")
+)
+
+// Encryption configures the encryption of objects, the server side modes are exclusive
+// and can be combined with the client side encryption
+type Encryption struct {
+	// SSE is the server side encryption managed by the store, AES256 (SSE-S3) or aws:kms (SSE-KMS)
+	SSE types.ServerSideEncryption
+	// KMSKeyID is the KMS key of SSE-KMS, defaults to the AWS managed key
+	KMSKeyID string
+	// CustomerKey is the 256 bit key of SSE-C, the store encrypts with it but does not keep it,
+	// it must be given to download the object
+	CustomerKey []byte
+	// ClientKey is the 256 bit key of the client side envelope encryption, every object is encrypted
+	// before upload with a random data key which is stored in the metadata wrapped by ClientKey.
+	// Client side encrypted objects are larger than their content, and cannot be compared by Sync.
+	ClientKey []byte
+}
+
+func (e *Encryption) validate() error {
+	if e == nil {
+		return nil
+	}
+	if e.CustomerKey != nil && len(e.CustomerKey) != 32 {
+		return errors.New("SSE-C customer key must be 256 bits")
+	}
+	if e.CustomerKey != nil && e.SSE != "" {
+		return errors.New("SSE-C cannot be combined with SSE-S3 or SSE-KMS")
+	}
+	if e.ClientKey != nil && len(e.ClientKey) != 32 {
+		return errors.New("client side encryption key must be 256 bits")
+	}
+	return nil
+}
+
+func (e *Encryption) customerKey() (alg, key, keyMD5 *string) {
+	if e == nil || e.CustomerKey == nil {
+		return nil, nil, nil
+	}
+	sum := md5.Sum(e.CustomerKey)
+	a := string(types.ServerSideEncryptionAes256)
+	k := base64.StdEncoding.EncodeToString(e.CustomerKey)
+	m := base64.StdEncoding.EncodeToString(sum[:])
+	return &a, &k, &m
+}
+
+// applyPut sets the server side encryption of the upload and encrypts its body with the client key
+func (e *Encryption) applyPut(input *awss3.PutObjectInput) error {
+	if e == nil {
+		return nil
+	}
+	if err := e.validate(); err != nil {
+		return err
+	}
+	input.ServerSideEncryption = e.SSE
+	if e.KMSKeyID != "" {
+		input.SSEKMSKeyId = &e.KMSKeyID
+	}
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = e.customerKey()
+	if e.ClientKey == nil {
+		return nil
+	}
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wrapped, err := wrapKey(e.ClientKey, dataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string, len(input.Metadata)+3)
+	for k, v := range input.Metadata {
+		metadata[k] = v
+	}
+	metadata[cseAlgMetadataKey] = CSEAlgorithm
+	metadata[cseKeyMetadataKey] = base64.StdEncoding.EncodeToString(wrapped)
+	metadata[cseNonceMetadataKey] = base64.StdEncoding.EncodeToString(nonce)
+	input.Metadata = metadata
+	input.Body = encryptReader(input.Body, aead, nonce)
+	return nil
+}
+
+func (e *Encryption) applyGet(input *awss3.GetObjectInput) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = e.customerKey()
+}
+
+func (e *Encryption) applyHead(input *awss3.HeadObjectInput) {
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = e.customerKey()
+}
+
+// decryptReader returns the plaintext of a client side encrypted object given its metadata
+func (e *Encryption) decryptReader(body io.Reader, metadata map[string]string) (io.Reader, error) {
+	if metadata[cseAlgMetadataKey] == "" {
+		return nil, ErrNotEncrypted
+	}
+	if metadata[cseAlgMetadataKey] != CSEAlgorithm {
+		return nil, errors.Errorf("unsupported client side encryption algorithm %s", metadata[cseAlgMetadataKey])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[cseKeyMetadataKey])
+	if err != nil {
+		return nil, errors.Wrap(ErrDecrypt, "invalid data key")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(metadata[cseNonceMetadataKey])
+	if err != nil || len(nonce) != 12 {
+		return nil, errors.Wrap(ErrDecrypt, "invalid nonce")
+	}
+	dataKey, err := unwrapKey(e.ClientKey, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return decryptReader(body, aead, nonce), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey seals the data key with the key encryption key, the nonce is prepended
+func wrapKey(kek, dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(cseKeyMetadataKey)), nil
+}
+
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.Wrap(ErrDecrypt, "invalid data key")
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(cseKeyMetadataKey))
+	if err != nil {
+		return nil, errors.Wrap(ErrDecrypt, "wrong client key")
+	}
+	return dataKey, nil
+}
+
+// plaintextSize returns the content length of a client side encrypted object of the given size,
+// every chunk, including the empty last chunk of an empty content, is sealed with a GCM tag
+func plaintextSize(size int64) int64 {
+	const overhead = 16
+	chunks := (size + CSEChunkSize + overhead - 1) / (CSEChunkSize + overhead)
+	if chunks == 0 {
+		return 0
+	}
+	return size - chunks*overhead
+}
+
+// chunkNonce derives the nonce of a chunk by xoring its index into the last 8 bytes of the base nonce
+func chunkNonce(base []byte, index uint64) []byte {
+	nonce := append([]byte{}, base...)
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(nonce[4:])^index)
+	return nonce
+}
+
+// chunkAAD marks the last chunk so that truncating the content at a chunk boundary is detected
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// readChunk reads up to size bytes, an empty chunk means the end of the stream
+func readChunk(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// chunkReader transforms src chunk by chunk, reading one chunk ahead to know which one is the last
+type chunkReader struct {
+	src     io.Reader
+	size    int
+	process func(chunk []byte, index uint64, last bool) ([]byte, error)
+	index   uint64
+	next    []byte
+	out     []byte
+	done    bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *chunkReader) fill() (err error) {
+	if r.next == nil {
+		if r.next, err = readChunk(r.src, r.size); err != nil {
+			return
+		}
+	}
+	following, err := readChunk(r.src, r.size)
+	if err != nil {
+		return
+	}
+	last := len(following) == 0
+	if r.out, err = r.process(r.next, r.index, last); err != nil {
+		return
+	}
+	r.index++
+	r.next, r.done = following, last
+	return nil
+}
+
+func encryptReader(src io.Reader, aead cipher.AEAD, nonce []byte) io.Reader {
+	return &chunkReader{src: src, size: CSEChunkSize, process: func(chunk []byte, index uint64, last bool) ([]byte, error) {
+		return aead.Seal(nil, chunkNonce(nonce, index), chunk, chunkAAD(last)), nil
+	}}
+}
+
+func decryptReader(src io.Reader, aead cipher.AEAD, nonce []byte) io.Reader {
+	return &chunkReader{src: src, size: CSEChunkSize + aead.Overhead(), process: func(chunk []byte, index uint64, last bool) ([]byte, error) {
+		out, err := aead.Open(nil, chunkNonce(nonce, index), chunk, chunkAAD(last))
+		if err != nil {
+			return nil, errors.Wrapf(ErrDecrypt, "chunk %d", index)
+		}
+		return out, nil
+	}}
+}
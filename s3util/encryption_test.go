@@ -0,0 +1,90 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptTestObject(t *testing.T, e *Encryption, plain []byte) ([]byte, map[string]string) {
+	input := &awss3.PutObjectInput{Body: bytes.NewReader(plain), Metadata: map[string]string{"sha256": "0x01"}}
+	require.NoError(t, e.applyPut(input))
+	sealed, err := io.ReadAll(input.Body)
+	require.NoError(t, err)
+	return sealed, input.Metadata
+}
+
+func TestClientSideEncryption(t *testing.T) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	e := &Encryption{ClientKey: key}
+
+	for _, size := range []int{0, 10, CSEChunkSize, 3*CSEChunkSize + 7} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		sealed, metadata := encryptTestObject(t, e, plain)
+		assert.Equal(t, "0x01", metadata["sha256"])
+		assert.Equal(t, CSEAlgorithm, metadata[cseAlgMetadataKey])
+		assert.Equal(t, int64(size), plaintextSize(int64(len(sealed))), size)
+		if size > 0 {
+			assert.NotContains(t, string(sealed), string(plain))
+		}
+
+		r, err := e.decryptReader(bytes.NewReader(sealed), metadata)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, size)
+		assert.Equal(t, plain, got, size)
+	}
+
+	plain := make([]byte, 2*CSEChunkSize+1)
+	sealed, metadata := encryptTestObject(t, e, plain)
+	decrypt := func(sealed []byte, e *Encryption) error {
+		r, err := e.decryptReader(bytes.NewReader(sealed), metadata)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadAll(r)
+		return err
+	}
+	// truncated at a chunk boundary
+	assert.True(t, errors.Is(decrypt(sealed[:2*(CSEChunkSize+16)], e), ErrDecrypt))
+	// tampered
+	tampered := append([]byte{}, sealed...)
+	tampered[10] ^= 1
+	assert.True(t, errors.Is(decrypt(tampered, e), ErrDecrypt))
+	// wrong key
+	assert.True(t, errors.Is(decrypt(sealed, &Encryption{ClientKey: make([]byte, 32)}), ErrDecrypt))
+	// plaintext object
+	_, err := e.decryptReader(bytes.NewReader(plain), nil)
+	assert.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestServerSideEncryption(t *testing.T) {
+	input := &awss3.PutObjectInput{}
+	require.NoError(t, (&Encryption{SSE: "aws:kms", KMSKeyID: "key"}).applyPut(input))
+	assert.EqualValues(t, "aws:kms", input.ServerSideEncryption)
+	assert.Equal(t, "key", *input.SSEKMSKeyId)
+
+	input = &awss3.PutObjectInput{}
+	require.NoError(t, (&Encryption{CustomerKey: make([]byte, 32)}).applyPut(input))
+	assert.Equal(t, "AES256", *input.SSECustomerAlgorithm)
+	sum := md5.Sum(make([]byte, 32))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(sum[:]), *input.SSECustomerKeyMD5)
+
+	assert.Error(t, (&Encryption{CustomerKey: make([]byte, 16)}).applyPut(&awss3.PutObjectInput{}))
+	assert.Error(t, (&Encryption{SSE: "AES256", CustomerKey: make([]byte, 32)}).applyPut(&awss3.PutObjectInput{}))
+}
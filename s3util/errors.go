@@ -0,0 +1,32 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"github.com/aws/smithy-go"
+	"github.com/pkg/errors"
+)
+
+// ErrorCode returns the S3 error code of err, e.g. NoSuchKey, or an empty string if it is not an API error
+func ErrorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// IsNotFound reports whether err is a missing bucket, object, version or bucket configuration.
+// HEAD requests have no body and return a bare NotFound code.
+func IsNotFound(err error) bool {
+	switch ErrorCode(err) {
+	case "NotFound", "NoSuchKey", "NoSuchBucket", "NoSuchVersion", "NoSuchUpload",
+		"NoSuchLifecycleConfiguration", "NoSuchPublicAccessBlockConfiguration",
+		"ServerSideEncryptionConfigurationNotFoundError":
+		return true
+	}
+	return false
+}
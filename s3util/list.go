@@ -0,0 +1,172 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/alt-research/operator-kit/ptr"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+)
+
+// maxListKeys is the maximum number of keys returned by a single ListObjectsV2 call
+const maxListKeys = 1000
+
+// ErrStopWalk can be returned by a Walk callback to stop the walk without error
+var ErrStopWalk = errors.New("stop walk")
+
+// ObjectInfo is the metadata of a listed object, or a common prefix when listing with a delimiter
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	StorageClass types.ObjectStorageClass
+	// IsPrefix is true for the "directories" returned when listing with a delimiter, only Key is set
+	IsPrefix bool
+}
+
+type ListOptions struct {
+	// Delimiter groups the keys sharing the same prefix up to the delimiter into a single prefix entry,
+	// e.g. "/" lists a single level of "directories"
+	Delimiter string
+	// MaxResults limits the number of returned entries, 0 returns all of them
+	MaxResults int
+	// StartAfter starts listing after this key
+	StartAfter string
+}
+
+// ObjectIterator iterates over the objects of a listing, fetching pages as needed
+//
+//	it := b.Iter(ctx, "prefix/", nil)
+//	for it.Next() {
+//		obj := it.Object()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+type ObjectIterator struct {
+	ctx          context.Context
+	b            *BucketManager
+	prefix       string
+	opts         ListOptions
+	continuation *string
+	page         []ObjectInfo
+	current      ObjectInfo
+	count        int
+	done         bool
+	err          error
+}
+
+// Iter returns an iterator over the objects under the given prefix, in key order
+func (b *BucketManager) Iter(ctx context.Context, prefix string, opts *ListOptions) *ObjectIterator {
+	it := &ObjectIterator{ctx: ctx, b: b, prefix: prefix}
+	if opts != nil {
+		it.opts = *opts
+	}
+	return it
+}
+
+// Next advances to the next object, it returns false when the listing is exhausted or failed
+func (it *ObjectIterator) Next() bool {
+	if it.err != nil || (it.opts.MaxResults > 0 && it.count >= it.opts.MaxResults) {
+		return false
+	}
+	for len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+		if it.err = it.fetch(); it.err != nil {
+			return false
+		}
+	}
+	it.current, it.page = it.page[0], it.page[1:]
+	it.count++
+	return true
+}
+
+// Object returns the current object
+func (it *ObjectIterator) Object() ObjectInfo {
+	return it.current
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *ObjectIterator) Err() error {
+	return it.err
+}
+
+func (it *ObjectIterator) fetch() error {
+	input := &awss3.ListObjectsV2Input{
+		Bucket:            &it.b.Bucket,
+		Prefix:            &it.prefix,
+		ContinuationToken: it.continuation,
+		MaxKeys:           ptr.Of(int32(maxListKeys)),
+	}
+	if it.opts.Delimiter != "" {
+		input.Delimiter = &it.opts.Delimiter
+	}
+	if it.opts.StartAfter != "" && it.continuation == nil {
+		input.StartAfter = &it.opts.StartAfter
+	}
+	if it.opts.MaxResults > 0 && it.opts.MaxResults-it.count < maxListKeys {
+		input.MaxKeys = ptr.Of(int32(it.opts.MaxResults - it.count))
+	}
+	out, err := it.b.client.ListObjectsV2(it.ctx, input)
+	if err != nil {
+		return err
+	}
+	page := make([]ObjectInfo, 0, len(out.Contents)+len(out.CommonPrefixes))
+	for _, o := range out.Contents {
+		info := ObjectInfo{Key: *o.Key, StorageClass: o.StorageClass}
+		if o.Size != nil {
+			info.Size = *o.Size
+		}
+		if o.ETag != nil {
+			info.ETag = *o.ETag
+		}
+		if o.LastModified != nil {
+			info.LastModified = *o.LastModified
+		}
+		page = append(page, info)
+	}
+	for _, p := range out.CommonPrefixes {
+		page = append(page, ObjectInfo{Key: *p.Prefix, IsPrefix: true})
+	}
+	// objects and prefixes are sorted separately
+	sort.Slice(page, func(a, b int) bool { return page[a].Key < page[b].Key })
+	it.page = page
+	it.continuation = out.NextContinuationToken
+	it.done = out.IsTruncated == nil || !*out.IsTruncated
+	return nil
+}
+
+// Walk calls fn for every object under the given prefix in key order, until fn returns an error.
+// Returning ErrStopWalk stops the walk without error.
+func (b *BucketManager) Walk(ctx context.Context, prefix string, opts *ListOptions, fn func(ObjectInfo) error) error {
+	it := b.Iter(ctx, prefix, opts)
+	for it.Next() {
+		if err := fn(it.Object()); err != nil {
+			if errors.Is(err, ErrStopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// List returns the objects under the given prefix in key order
+func (b *BucketManager) List(ctx context.Context, prefix string, opts *ListOptions) ([]ObjectInfo, error) {
+	var objs []ObjectInfo
+	err := b.Walk(ctx, prefix, opts, func(o ObjectInfo) error {
+		objs = append(objs, o)
+		return nil
+	})
+	return objs, err
+}
@@ -12,6 +12,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -30,9 +31,11 @@ import (
 
 type BucketManager struct {
 	aws.Config
-	Opts        awstools.AWSCfgOpts
-	Bucket      string
-	Prefix      string
+	Opts   awstools.AWSCfgOpts
+	Bucket string
+	Prefix string
+	// Encryption applies to every upload and download, unless overridden by UploadOptions.Encryption
+	Encryption  *Encryption
 	concurrency int
 	client      *awss3.Client
 	uploader    *s3mgr.Uploader
@@ -80,80 +83,207 @@ func (b *BucketManager) SetConcurrency(n int) {
 	b.sem = semaphore.NewWeighted(int64(n))
 }
 
+// SHA256MetadataKey is the object metadata key holding the SHA256 of the object content, as set by Sync
+const SHA256MetadataKey = "sha256"
+
 type UploadOptions struct {
 	ACL          types.ObjectCannedACL
 	StorageClass types.StorageClass
 	Tagging      *string
+	// Metadata is stored as user-defined object metadata (x-amz-meta-*), see OwnerMetadata
+	Metadata map[string]string
+	// ContentType is detected from the key extension or else from the content when empty
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	// Encryption overrides the encryption of the BucketManager
+	Encryption *Encryption
+	// PartSize is the size of the parts of multipart uploads, defaults to 5MiB. Uploads of unknown size,
+	// such as UploadStream, are limited to 10000 parts.
+	PartSize int64
+	// FailFast stops a directory upload on the first failure, the uploads in progress are canceled
+	FailFast bool
+	// Progress is called after every file of a directory upload is uploaded, calls are not concurrent
+	Progress func(UploadProgress)
+}
+
+// UploadProgress is the progress of a directory upload
+type UploadProgress struct {
+	Files      int
+	TotalFiles int
+	Bytes      int64
+	TotalBytes int64
+}
+
+func reportProgress(opts *UploadOptions, progress UploadProgress) {
+	if opts != nil && opts.Progress != nil {
+		opts.Progress(progress)
+	}
+}
+
+// FileError is the failure of a single file of a directory upload
+type FileError struct {
+	Path string
+	Key  string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// UploadError aggregates the failed files of a directory upload, sorted by path
+type UploadError struct {
+	Errors []*FileError
+}
+
+func (e *UploadError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("failed to upload %d files: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *UploadError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
 }
 
 type UploadOutput struct {
 	s3mgr.UploadOutput
-	Endpoint string
-	Region   string
-	Bucket   string
-	Size     int64
+	Endpoint    string
+	Region      string
+	Bucket      string
+	Size        int64
+	ContentType string
+	Metadata    map[string]string
 }
 
 type UploadOutputs struct {
 	syncmap.Map[string, UploadOutput]
 }
 
+// Upload uploads a file to keyOrPrefix, or the files of a directory selected by filter under the keyOrPrefix prefix.
+// A directory upload runs up to the configured concurrency of uploads at a time, by default every file is
+// attempted and the failures are returned as an *UploadError along with the successful uploads.
 func (b *BucketManager) Upload(ctx context.Context, src, keyOrPrefix string, filter func(string) bool, opts *UploadOptions) (*UploadOutputs, error) {
 	uploaded := new(UploadOutputs)
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		out, err := b.UploadSingle(ctx, src, keyOrPrefix, opts)
+		if err != nil || out == nil {
+			return nil, err
+		}
+		out.Size = info.Size()
+		uploaded.Store(src, *out)
+		reportProgress(opts, UploadProgress{Files: 1, TotalFiles: 1, Bytes: info.Size(), TotalBytes: info.Size()})
+		return uploaded, nil
+	}
+
+	type file struct {
+		path, rel string
+		size      int64
+	}
+	var files []file
+	progress := UploadProgress{}
+	if err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if filter != nil && !filter(path) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.ReplaceAll(path, `\`, `/`), src)
+		rel = strings.TrimPrefix(rel, "/")
+		files = append(files, file{path: path, rel: rel, size: stat.Size()})
+		progress.TotalFiles++
+		progress.TotalBytes += stat.Size()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
 	log := log.FromContext(ctx)
+	failFast := opts != nil && opts.FailFast
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	wg := &sync.WaitGroup{}
-	if info, err := os.Stat(src); err == nil {
-		if !info.IsDir() {
-			out, err := b.UploadSingle(ctx, src, keyOrPrefix, opts)
-			if err != nil || out == nil {
-				return nil, err
+	mu := &sync.Mutex{}
+	uploadErr := &UploadError{}
+	for _, f := range files {
+		f := f
+		if err := b.sem.Acquire(uploadCtx, 1); err != nil {
+			// only canceled by a failure in fail fast mode, or by the caller
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer b.sem.Release(1)
+			defer wg.Done()
+			key := filepath.Join(keyOrPrefix, f.rel)
+			out, err := b.uploadFile(uploadCtx, f.path, filepath.Join(b.Prefix, key), opts)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && failFast && len(uploadErr.Errors) > 0 {
+				// canceled by an earlier failure
+				return
 			}
-			out.Size = info.Size()
-			uploaded.Store(src, *out)
-			return uploaded, err
-		} else {
-			if err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
-				if d.IsDir() {
-					return nil
-				}
-				if filter != nil && !filter(path) {
-					return nil
+			if err != nil {
+				log.Error(err, "upload failed", "path", f.path, "key", key, "bucket", b.Bucket)
+				uploadErr.Errors = append(uploadErr.Errors, &FileError{Path: f.path, Key: key, Err: err})
+				if failFast {
+					cancel()
 				}
-				// if err := b.sem.Acquire(ctx, 1); err != nil {
-				// 	return errors.Wrap(err, "Failed to acquire semaphore")
-				// }
-				wg.Add(1)
-				go func() {
-					// defer b.sem.Release(1)
-					defer wg.Done()
-					rel := strings.TrimPrefix(strings.ReplaceAll(path, `\`, `/`), src)
-					rel = strings.TrimPrefix(rel, "/")
-					key := filepath.Join(keyOrPrefix, rel)
-					out, err := b.UploadSingle(ctx, path, key, opts)
-					if err != nil || out == nil {
-						log.Error(err, "upload failed", "path", path, "key", key, "bucket", b.Bucket)
-						return
-					}
-					log.V(1).Info("Uploaded file", "path", path, "key", out.Key, "etag", out.ETag, "bucket", b.Bucket)
-					stat, err := os.Stat(path)
-					if err != nil {
-						log.Error(err, "Failed to stat file", "path", path)
-						return
-					}
-					out.Size = stat.Size()
-					uploaded.Store(rel, *out)
-				}()
-				return nil
-			}); err != nil {
-				wg.Wait()
-				return nil, err
+				return
 			}
-		}
+			log.V(1).Info("Uploaded file", "path", f.path, "key", out.Key, "etag", out.ETag, "bucket", b.Bucket)
+			out.Size = f.size
+			uploaded.Store(f.rel, *out)
+			progress.Files++
+			progress.Bytes += f.size
+			reportProgress(opts, progress)
+		}()
 	}
 	wg.Wait()
+	if len(uploadErr.Errors) > 0 {
+		sort.Slice(uploadErr.Errors, func(i, j int) bool { return uploadErr.Errors[i].Path < uploadErr.Errors[j].Path })
+		return uploaded, uploadErr
+	}
+	if err := ctx.Err(); err != nil {
+		return uploaded, err
+	}
 	return uploaded, nil
 }
 
+// uploadFile uploads a file to the given key, without resolving nor prefixing it
+func (b *BucketManager) uploadFile(ctx context.Context, src, key string, opts *UploadOptions) (*UploadOutput, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return b.putObject(ctx, key, file, opts)
+}
+
 func (b *BucketManager) UploadSingle(ctx context.Context, src, keyOrPrefix string, opts *UploadOptions) (*UploadOutput, error) {
 	file, err := os.Open(src)
 	if err != nil {
@@ -176,6 +306,35 @@ func (b *BucketManager) UploadReader(ctx context.Context, name string, src io.Re
 	} else if is {
 		key = filepath.Join(key, filepath.Base(name))
 	}
+	return b.putObject(ctx, key, src, opts)
+}
+
+// putObject uploads src to the given key, without prefixing it
+func (b *BucketManager) putObject(ctx context.Context, key string, src io.Reader, opts *UploadOptions) (*UploadOutput, error) {
+	input, err := b.putObjectInput(key, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	up, err := b.uploader.Upload(ctx, input, func(u *s3mgr.Uploader) {
+		if opts != nil && opts.PartSize > 0 {
+			u.PartSize = opts.PartSize
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &UploadOutput{
+		UploadOutput: *up,
+		Endpoint:     b.Opts.Endpoint,
+		Region:       b.Region,
+		Bucket:       b.Bucket,
+		ContentType:  *input.ContentType,
+		Metadata:     input.Metadata,
+	}, nil
+}
+
+// putObjectInput returns the upload of src to key with the options and the encryption applied
+func (b *BucketManager) putObjectInput(key string, src io.Reader, opts *UploadOptions) (*awss3.PutObjectInput, error) {
 	input := &awss3.PutObjectInput{
 		Bucket: &b.Bucket,
 		Key:    &key,
@@ -185,12 +344,21 @@ func (b *BucketManager) UploadReader(ctx context.Context, name string, src io.Re
 		input.ACL = opts.ACL
 		input.StorageClass = opts.StorageClass
 		input.Tagging = opts.Tagging
+		input.Metadata = opts.Metadata
 	}
-	up, err := b.uploader.Upload(ctx, input)
-	if err != nil {
+	opts.applyContent(input)
+	if err := b.encryption(opts).applyPut(input); err != nil {
 		return nil, err
 	}
-	return &UploadOutput{UploadOutput: *up, Endpoint: b.Opts.Endpoint, Region: b.Region, Bucket: b.Bucket}, nil
+	return input, nil
+}
+
+// encryption returns the encryption of an upload, the one of opts or else of the manager
+func (b *BucketManager) encryption(opts *UploadOptions) *Encryption {
+	if opts != nil && opts.Encryption != nil {
+		return opts.Encryption
+	}
+	return b.Encryption
 }
 
 func (b *BucketManager) IsPathDir(ctx context.Context, path string) (bool, error) {
@@ -218,20 +386,7 @@ type HeadObjectOutput struct {
 }
 
 func (b *BucketManager) HeadObject(ctx context.Context, key string) (HeadObjectOutput, error) {
-	h, err := b.client.HeadObject(ctx, &awss3.HeadObjectInput{
-		Bucket: &b.Bucket,
-		Key:    &key,
-	})
-	if err != nil {
-		return HeadObjectOutput{}, err
-	}
-	return HeadObjectOutput{
-		Endpoint:         b.Opts.Endpoint,
-		Bucket:           b.Bucket,
-		Region:           b.Region,
-		Key:              key,
-		HeadObjectOutput: *h,
-	}, nil
+	return b.HeadObjectVersion(ctx, key, "")
 }
 
 func (b *BucketManager) DeleteObject(ctx context.Context, key string) (*awss3.DeleteObjectOutput, error) {
@@ -258,26 +413,15 @@ func (b *BucketManager) Download(ctx context.Context, key string, dst string, ov
 		return []string{}, err
 	}
 	var keys []string
-	var continuation *string
-	for {
-		objects, err := b.client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{
-			Bucket:            &b.Bucket,
-			Prefix:            &key,
-			ContinuationToken: continuation,
-		})
-		if err != nil {
-			return []string{}, err
-		}
-		for _, obj := range objects.Contents {
-			keys = append(keys, *obj.Key)
-		}
-		if !(objects.IsTruncated != nil && *objects.IsTruncated) {
-			break
-		}
-		continuation = objects.NextContinuationToken
+	err = b.Walk(ctx, key, nil, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return []string{}, err
 	}
 	errG, ctx := errgroup.WithContext(ctx)
-	filenameCh := make(chan string, len(keys))
+	var mu sync.Mutex
 	for _, k := range keys {
 		k := k
 		errG.Go(func() error {
@@ -290,68 +434,60 @@ func (b *BucketManager) Download(ctx context.Context, key string, dst string, ov
 				log.Log.Error(err, "Failed to download file", "key", k)
 				return err
 			}
-			filenameCh <- filename
+			mu.Lock()
+			files = append(files, filename)
+			mu.Unlock()
 			return nil
 		})
 	}
-	go func() {
-		for filename := range filenameCh {
-			files = append(files, filename)
-		}
-	}()
 	err = errG.Wait()
-	close(filenameCh)
 	return
 }
 
 func (b *BucketManager) DownloadSingle(ctx context.Context, key string, dst string, overwrite bool) (string, error) {
-	// if dest is dir, create file in this dir with the filename as the filename of key
-	if info, err := os.Stat(dst); err == nil && info.IsDir() {
-		dst = filepath.Join(dst, filepath.Base(key))
+	return b.DownloadVersion(ctx, key, "", dst, overwrite)
+}
+
+// DownloadWriter downloads an object to dst, client side encrypted objects are decrypted
+// and written sequentially instead of in concurrent parts
+func (b *BucketManager) DownloadWriter(ctx context.Context, key string, dst io.WriterAt) (int64, error) {
+	return b.downloadWriter(ctx, key, "", dst)
+}
+
+func (b *BucketManager) downloadWriter(ctx context.Context, key, versionID string, dst io.WriterAt) (int64, error) {
+	input := &awss3.GetObjectInput{
+		Bucket:    &b.Bucket,
+		Key:       &key,
+		VersionId: optional(versionID),
 	}
-	if !overwrite {
-		if _, err := os.Stat(dst); err == nil {
-			return "", errors.Errorf("dest %s already exists", dst)
-		}
+	b.Encryption.applyGet(input)
+	if b.Encryption == nil || b.Encryption.ClientKey == nil {
+		return b.downloader.Download(ctx, dst, input)
 	}
-	file, err := os.Create(dst)
+	body, err := b.openObject(ctx, key, versionID)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-	defer file.Close()
-	_, err = b.DownloadWriter(ctx, key, file)
-	return dst, err
-}
-
-func (b *BucketManager) DownloadWriter(ctx context.Context, key string, dst io.WriterAt) (int64, error) {
-	return b.downloader.Download(ctx, dst, &awss3.GetObjectInput{
-		Bucket: &b.Bucket,
-		Key:    &key,
-	})
+	defer body.Close()
+	return io.Copy(io.NewOffsetWriter(dst, 0), body)
 }
 
 func (b *BucketManager) Delete(ctx context.Context, key string) (deletes *awss3.DeleteObjectsOutput, err error) {
 	var keys []types.ObjectIdentifier
-	var continuation *string
-	for {
-		objects, err := b.client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{
-			Bucket:            &b.Bucket,
-			Prefix:            &key,
-			ContinuationToken: continuation,
-		})
-		if err != nil {
-			return nil, err
-		}
-		for _, obj := range objects.Contents {
-			keys = append(keys, types.ObjectIdentifier{Key: obj.Key})
-		}
-		if !(objects.IsTruncated != nil && *objects.IsTruncated) {
-			break
-		}
-		continuation = objects.NextContinuationToken
+	err = b.Walk(ctx, key, nil, func(obj ObjectInfo) error {
+		keys = append(keys, types.ObjectIdentifier{Key: ptr.Of(obj.Key)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return b.deleteKeys(ctx, keys)
+}
+
+// deleteKeys deletes the given objects in batches of 1000
+func (b *BucketManager) deleteKeys(ctx context.Context, keys []types.ObjectIdentifier) (*awss3.DeleteObjectsOutput, error) {
 	if len(keys) == 0 {
-		return
+		return nil, nil
 	}
 	length := len(keys)
 	out := &awss3.DeleteObjectsOutput{}
@@ -6,12 +6,311 @@
 package s3util
 
 import (
-	. "github.com/onsi/ginkgo/v2"
-	// . "github.com/onsi/gomega"
-	// awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3mgr "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const BucketTestBucket = "test"
 
-var _ = Describe("Manager", func() {
-})
+func newFakeManager(t *testing.T, prefix string) (*BucketManager, *s3fake.Server) {
+	srv := s3fake.NewServer(BucketTestBucket)
+	t.Cleanup(srv.Close)
+	b, err := NewManagerWithClient(srv.Client(), BucketTestBucket, prefix, 4)
+	require.NoError(t, err)
+	return b, srv
+}
+
+func TestManagerUploadDownload(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "data")
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a.json"), []byte(`{"a":1}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "sub", "b.txt"), []byte("b"), 0o644))
+
+	_, err := b.Upload(ctx, src, "dir", nil, &UploadOptions{Metadata: map[string]string{"owner": "devnet"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"data/dir/a.json", "data/dir/sub/b.txt"}, srv.Keys(BucketTestBucket))
+
+	head, err := b.HeadObject(ctx, "data/dir/a.json")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), aws.ToInt64(head.ContentLength))
+	assert.Equal(t, "application/json", aws.ToString(head.ContentType))
+	assert.Equal(t, "devnet", head.Metadata["owner"])
+
+	objs, err := b.List(ctx, "data/dir/", &ListOptions{Delimiter: "/"})
+	require.NoError(t, err)
+	require.Len(t, objs, 2)
+	assert.Equal(t, "data/dir/a.json", objs[0].Key)
+	assert.True(t, objs[1].IsPrefix)
+
+	dst := t.TempDir()
+	files, err := b.Download(ctx, "data/dir", dst, true)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	data, err := os.ReadFile(filepath.Join(dst, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(data))
+
+	_, err = b.Delete(ctx, "data/dir")
+	require.NoError(t, err)
+	assert.Empty(t, srv.Keys(BucketTestBucket))
+	_, err = b.HeadObject(ctx, "data/dir/a.json")
+	assert.True(t, IsNotFound(err))
+}
+
+func TestManagerListPages(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	for i := 0; i < maxListKeys+5; i++ {
+		srv.PutObject(BucketTestBucket, fmt.Sprintf("logs/%05d", i), []byte("x"), nil)
+	}
+	objs, err := b.List(ctx, "logs/", nil)
+	require.NoError(t, err)
+	require.Len(t, objs, maxListKeys+5)
+	assert.Equal(t, "logs/01004", objs[len(objs)-1].Key)
+
+	objs, err = b.List(ctx, "logs/", &ListOptions{StartAfter: "logs/01000", MaxResults: 2})
+	require.NoError(t, err)
+	require.Len(t, objs, 2)
+	assert.Equal(t, "logs/01001", objs[0].Key)
+}
+
+func TestManagerListDelimiterPages(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	// the prefixes span several pages and are interleaved with the objects of the level
+	for i := 0; i < maxListKeys+2; i++ {
+		srv.PutObject(BucketTestBucket, fmt.Sprintf("tree/d%05d/x", i), []byte("x"), nil)
+		srv.PutObject(BucketTestBucket, fmt.Sprintf("tree/d%05d/y", i), []byte("y"), nil)
+	}
+	srv.PutObject(BucketTestBucket, "tree/d00500.txt", []byte("x"), nil)
+	objs, err := b.List(ctx, "tree/", &ListOptions{Delimiter: "/"})
+	require.NoError(t, err)
+	require.Len(t, objs, maxListKeys+3)
+	assert.Equal(t, ObjectInfo{Key: "tree/d00000/", IsPrefix: true}, objs[0])
+	assert.Equal(t, "tree/d00500.txt", objs[500].Key)
+	assert.False(t, objs[500].IsPrefix)
+	assert.Equal(t, int64(1), objs[500].Size)
+	assert.Equal(t, "tree/d01001/", objs[len(objs)-1].Key)
+
+	objs, err = b.List(ctx, "tree/", &ListOptions{Delimiter: "/", StartAfter: "tree/d00999/", MaxResults: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []ObjectInfo{{Key: "tree/d01000/", IsPrefix: true}, {Key: "tree/d01001/", IsPrefix: true}}, objs)
+}
+
+func TestManagerDownloadDeletePages(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	n := maxListKeys + 5
+	for i := 0; i < n; i++ {
+		srv.PutObject(BucketTestBucket, fmt.Sprintf("bulk/%05d", i), []byte(fmt.Sprint(i)), nil)
+	}
+	srv.PutObject(BucketTestBucket, "other/00000", []byte("other"), nil)
+
+	dst := t.TempDir()
+	files, err := b.Download(ctx, "bulk", dst, true)
+	require.NoError(t, err)
+	assert.Len(t, files, n)
+	data, err := os.ReadFile(filepath.Join(dst, fmt.Sprintf("%05d", n-1)))
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(n-1), string(data))
+
+	// the keys of every page are deleted in batches
+	out, err := b.Delete(ctx, "bulk/")
+	require.NoError(t, err)
+	assert.Len(t, out.Deleted, n)
+	assert.Empty(t, out.Errors)
+	assert.Equal(t, []string{"other/00000"}, srv.Keys(BucketTestBucket))
+
+	out, err = b.Delete(ctx, "bulk/")
+	require.NoError(t, err)
+	assert.Nil(t, out)
+}
+
+func TestManagerSync(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newFakeManager(t, "")
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "b"), []byte("b"), 0o644))
+
+	res, err := b.SyncUp(ctx, src, "sync", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, res.Transferred)
+	res, err = b.SyncUp(ctx, src, "sync", nil)
+	require.NoError(t, err)
+	assert.Empty(t, res.Transferred)
+	assert.Equal(t, []string{"a", "b"}, res.Skipped)
+
+	// a file of the same size is compared by content
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("c"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(src, "b")))
+	res, err = b.SyncUp(ctx, src, "sync", &SyncOptions{Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+	assert.Equal(t, []string{"b"}, res.Deleted)
+
+	dst := t.TempDir()
+	res, err = b.SyncDown(ctx, "sync", dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+	data, err := os.ReadFile(filepath.Join(dst, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(data))
+}
+
+func TestManagerSyncEncryption(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newFakeManager(t, "")
+	b.Encryption = &Encryption{ClientKey: bytes.Repeat([]byte("k"), 32)}
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("a"), 0o644))
+
+	// the ciphertext is larger than the file, the plaintext size and SHA256 are compared
+	res, err := b.SyncUp(ctx, src, "sync", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+	res, err = b.SyncUp(ctx, src, "sync", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Skipped)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "a"), []byte("c"), 0o644))
+	res, err = b.SyncUp(ctx, src, "sync", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+
+	dst := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "a"), []byte("c"), 0o644))
+	res, err = b.SyncDown(ctx, "sync", dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Skipped)
+}
+
+func TestManagerSyncDown(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	srv.PutObject(BucketTestBucket, "sync/a", []byte("a"), nil)
+	srv.PutObject(BucketTestBucket, "sync/sub/deep/b", []byte("b"), nil)
+	dst := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dst, "a"), []byte("changed"), 0o644))
+
+	res, err := b.SyncDown(ctx, "sync", dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "sub/deep/b"}, res.Transferred)
+	data, err := os.ReadFile(filepath.Join(dst, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	// the directories emptied by the deletions are removed
+	_, err = b.Delete(ctx, "sync/sub/")
+	require.NoError(t, err)
+	res, err = b.SyncDown(ctx, "sync", dst, &SyncOptions{Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sub/deep/b"}, res.Deleted)
+	assert.Equal(t, []string{"a"}, res.Skipped)
+	assert.NoDirExists(t, filepath.Join(dst, "sub"))
+	assert.DirExists(t, dst)
+
+	// keys escaping the destination are rejected before anything is written
+	srv.PutObject(BucketTestBucket, "evil/x", []byte("x"), nil)
+	srv.PutObject(BucketTestBucket, "evil/../../escaped", []byte("x"), nil)
+	out := filepath.Join(t.TempDir(), "out")
+	_, err = b.SyncDown(ctx, "evil", out, nil)
+	assert.ErrorContains(t, err, "outside of the destination directory")
+	assert.NoFileExists(t, filepath.Join(out, "x"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(out), "escaped"))
+}
+
+func TestManagerCopyAndVersions(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	_, err := b.EnsureBucket(ctx, BucketConfig{Versioning: ptr.Of(true)})
+	require.NoError(t, err)
+
+	v1, err := b.UploadReader(ctx, "spec.json", bytes.NewReader([]byte("v1")), "spec.json", nil)
+	require.NoError(t, err)
+	_, err = b.UploadReader(ctx, "spec.json", bytes.NewReader([]byte("v2")), "spec.json", nil)
+	require.NoError(t, err)
+	versions, err := b.ListVersions(ctx, "spec.json", nil)
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.True(t, versions[0].IsLatest)
+	assert.Equal(t, aws.ToString(v1.VersionID), versions[1].VersionID)
+
+	_, err = b.RestoreVersion(ctx, "spec.json", aws.ToString(v1.VersionID))
+	require.NoError(t, err)
+	data, _ := srv.GetObject(BucketTestBucket, "spec.json")
+	assert.Equal(t, "v1", string(data))
+
+	out, err := b.Copy(ctx, "spec.json", nil, "release/spec.json", &CopyOptions{PartSize: 1})
+	require.NoError(t, err)
+	assert.True(t, out.ServerSide)
+	data, _ = srv.GetObject(BucketTestBucket, "release/spec.json")
+	assert.Equal(t, "v1", string(data))
+
+	_, err = b.Move(ctx, "release/spec.json", nil, "archive/spec.json", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"archive/spec.json", "spec.json"}, srv.Keys(BucketTestBucket))
+}
+
+func TestManagerStreams(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	content := bytes.Repeat([]byte("0123456789"), 1<<20)
+	_, err := b.UploadStream(ctx, "stream", func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}, &UploadOptions{PartSize: 5 << 20})
+	require.NoError(t, err)
+
+	r, err := b.Open(ctx, "stream")
+	require.NoError(t, err)
+	r.ChunkSize = 3 << 20
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.True(t, bytes.Equal(content, got))
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "snapshot")
+	require.NoError(t, os.WriteFile(src, content, 0o644))
+	store := &FileStateStore{Dir: filepath.Join(dir, "state")}
+	_, err = b.UploadResumable(ctx, src, "snapshot", store, &UploadOptions{PartSize: 5 << 20})
+	require.NoError(t, err)
+	assert.Zero(t, srv.Uploads(BucketTestBucket))
+	n, err := b.DownloadResumable(ctx, "snapshot", filepath.Join(dir, "download"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+}
+
+func TestManagerEncryption(t *testing.T) {
+	ctx := context.Background()
+	b, srv := newFakeManager(t, "")
+	b.Encryption = &Encryption{CustomerKey: bytes.Repeat([]byte("c"), 32), ClientKey: bytes.Repeat([]byte("k"), 32)}
+	_, err := b.UploadReader(ctx, "secret", bytes.NewReader([]byte("plain")), "secret", nil)
+	require.NoError(t, err)
+	data, _ := srv.GetObject(BucketTestBucket, "secret")
+	assert.NotContains(t, string(data), "plain")
+
+	buf := s3mgr.NewWriteAtBuffer(nil)
+	_, err = b.DownloadWriter(ctx, "secret", buf)
+	require.NoError(t, err)
+	assert.Equal(t, "plain", string(buf.Bytes()))
+
+	plain, err := NewManagerWithClient(srv.Client(), BucketTestBucket, "", 1)
+	require.NoError(t, err)
+	_, err = plain.DownloadWriter(ctx, "secret", buf)
+	assert.Error(t, err)
+}
@@ -0,0 +1,101 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/alt-research/operator-kit/must"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+// DefaultPresignExpiry is the validity of presigned URLs when no expiry is given
+const DefaultPresignExpiry = 15 * time.Minute
+
+// PresignedURL is a time limited URL granting access to an object without credentials
+type PresignedURL struct {
+	URL    string
+	Method string
+	// Header must be sent along with the request, e.g. the metadata of a presigned upload
+	Header  http.Header
+	Expires time.Time
+}
+
+// PresignGet returns a URL to download the object, valid for expiry. The objects of a bucket using SSE-C
+// or client side encryption cannot be downloaded by a presigned URL, the key would have to be handed out.
+func (b *BucketManager) PresignGet(ctx context.Context, key string, expiry time.Duration) (*PresignedURL, error) {
+	return b.PresignGetVersion(ctx, key, "", expiry)
+}
+
+// PresignGetVersion returns a URL to download the given version of the object, the latest one if versionID is empty
+func (b *BucketManager) PresignGetVersion(ctx context.Context, key, versionID string, expiry time.Duration) (*PresignedURL, error) {
+	if err := b.Encryption.presignable(); err != nil {
+		return nil, err
+	}
+	expiry = must.Default(expiry, DefaultPresignExpiry)
+	expires := time.Now().Add(expiry)
+	req, err := awss3.NewPresignClient(b.client).PresignGetObject(ctx, &awss3.GetObjectInput{
+		Bucket:    &b.Bucket,
+		Key:       &key,
+		VersionId: optional(versionID),
+	}, awss3.WithPresignExpires(expiry))
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedURL{URL: req.URL, Method: req.Method, Header: req.SignedHeader, Expires: expires}, nil
+}
+
+// PresignPut returns a URL to upload the object, valid for expiry. The ACL, storage class, tagging,
+// metadata and content headers of opts and the server side encryption of the bucket are signed, their
+// headers are returned and must be sent with the upload. Buckets using SSE-C or client side encryption
+// cannot be presigned.
+func (b *BucketManager) PresignPut(ctx context.Context, key string, expiry time.Duration, opts *UploadOptions) (*PresignedURL, error) {
+	if err := b.Encryption.presignable(); err != nil {
+		return nil, err
+	}
+	expiry = must.Default(expiry, DefaultPresignExpiry)
+	expires := time.Now().Add(expiry)
+	input := &awss3.PutObjectInput{
+		Bucket: &b.Bucket,
+		Key:    &key,
+	}
+	if opts != nil {
+		input.ACL = opts.ACL
+		input.StorageClass = opts.StorageClass
+		input.Tagging = opts.Tagging
+		input.Metadata = opts.Metadata
+		input.ContentType = optional(opts.ContentType)
+		input.ContentEncoding = optional(opts.ContentEncoding)
+		input.CacheControl = optional(opts.CacheControl)
+		input.ContentDisposition = optional(opts.ContentDisposition)
+	}
+	if err := b.Encryption.applyPut(input); err != nil {
+		return nil, err
+	}
+	req, err := awss3.NewPresignClient(b.client).PresignPutObject(ctx, input, awss3.WithPresignExpires(expiry))
+	if err != nil {
+		return nil, err
+	}
+	return &PresignedURL{URL: req.URL, Method: req.Method, Header: req.SignedHeader, Expires: expires}, nil
+}
+
+// presignable returns an error if the objects cannot be transferred by a presigned URL: the content of
+// client side encrypted objects never reaches the store in clear, and SSE-C requests need the key in their headers
+func (e *Encryption) presignable() error {
+	if e == nil {
+		return nil
+	}
+	if e.ClientKey != nil {
+		return errors.New("client side encrypted objects cannot be presigned")
+	}
+	if e.CustomerKey != nil {
+		return errors.New("SSE-C objects cannot be presigned, the customer key would be handed out")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPresignTestManager(t *testing.T) *BucketManager {
+	client := awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String("http://minio.local:9000"),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+	return b
+}
+
+func TestPresign(t *testing.T) {
+	ctx := context.Background()
+	b := newPresignTestManager(t)
+
+	get, err := b.PresignGet(ctx, "dir/spec.json", 10*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodGet, get.Method)
+	assert.Contains(t, get.URL, "http://minio.local:9000/test/dir/spec.json?")
+	assert.Contains(t, get.URL, "X-Amz-Expires=600")
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), get.Expires, time.Second)
+
+	put, err := b.PresignPut(ctx, "dir/spec.json", 0, &UploadOptions{Metadata: map[string]string{"sha256": "0x01"}})
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPut, put.Method)
+	assert.Contains(t, put.URL, "X-Amz-Expires=900")
+	assert.Equal(t, "0x01", put.Header.Get("X-Amz-Meta-Sha256"))
+}
+
+func TestPresignEncryption(t *testing.T) {
+	ctx := context.Background()
+	b := newPresignTestManager(t)
+
+	b.Encryption = &Encryption{SSE: types.ServerSideEncryptionAwsKms, KMSKeyID: "alias/data"}
+	put, err := b.PresignPut(ctx, "dir/spec.json", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "aws:kms", put.Header.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "alias/data", put.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	assert.Contains(t, put.URL, "x-amz-server-side-encryption")
+	_, err = b.PresignGet(ctx, "dir/spec.json", 0)
+	require.NoError(t, err)
+
+	b.Encryption = &Encryption{CustomerKey: bytes.Repeat([]byte{1}, 32)}
+	// the signed headers would hand out the customer key
+	_, err = b.PresignPut(ctx, "dir/spec.json", 0, nil)
+	assert.ErrorContains(t, err, "SSE-C")
+	_, err = b.PresignGet(ctx, "dir/spec.json", 0)
+	assert.ErrorContains(t, err, "SSE-C")
+
+	b.Encryption = &Encryption{ClientKey: bytes.Repeat([]byte{1}, 32)}
+	_, err = b.PresignPut(ctx, "dir/spec.json", 0, nil)
+	assert.ErrorContains(t, err, "client side encrypted")
+	_, err = b.PresignGet(ctx, "dir/spec.json", 0)
+	assert.ErrorContains(t, err, "client side encrypted")
+}
@@ -0,0 +1,425 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alt-research/operator-kit/must"
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3mgr "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// DefaultResumablePartSize is the part size of UploadResumable, the parts are the unit of resumption
+const DefaultResumablePartSize = 16 << 20
+
+// UploadState is the progress of a resumable upload. Only Key and UploadID are required to resume,
+// the parts already uploaded are listed from the bucket, so that a state can be kept in a CR status.
+type UploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"uploadId"`
+	PartSize int64  `json:"partSize,omitempty"`
+	// Size and ModTime identify the uploaded file, the upload restarts if the file changed
+	Size    int64          `json:"size,omitempty"`
+	ModTime time.Time      `json:"modTime,omitempty"`
+	Parts   []UploadedPart `json:"parts,omitempty"`
+}
+
+type UploadedPart struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// UploadStateStore persists the state of resumable uploads by object key, Load returns nil if there is none
+type UploadStateStore interface {
+	Load(ctx context.Context, key string) (*UploadState, error)
+	Save(ctx context.Context, state *UploadState) error
+	Delete(ctx context.Context, key string) error
+}
+
+// FileStateStore stores the upload states as JSON files in Dir
+type FileStateStore struct {
+	Dir string
+}
+
+var _ UploadStateStore = &FileStateStore{}
+
+func (s *FileStateStore) path(key string) string {
+	return filepath.Join(s.Dir, strings.ReplaceAll(key, "/", "_")+".upload.json")
+}
+
+func (s *FileStateStore) Load(_ context.Context, key string) (*UploadState, error) {
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &UploadState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "invalid upload state %s", s.path(key))
+	}
+	return state, nil
+}
+
+func (s *FileStateStore) Save(_ context.Context, state *UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	// write then rename so that a crash never leaves a truncated state
+	tmp := s.path(state.Key) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(state.Key))
+}
+
+func (s *FileStateStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// UploadResumable uploads a file to key, prefixed like UploadReader, by a multipart upload whose state is
+// saved to store after every part. If store has the state of an earlier attempt for the same file, the
+// upload is resumed and only the missing parts are uploaded. The state is deleted once the upload completes.
+// Client side encryption is not supported, as the parts could not be encrypted independently.
+func (b *BucketManager) UploadResumable(ctx context.Context, src, key string, store UploadStateStore, opts *UploadOptions) (*UploadOutput, error) {
+	log := log.FromContext(ctx)
+	key = filepath.Join(b.Prefix, key)
+	if store == nil {
+		return nil, errors.New("upload state store is required")
+	}
+	if e := b.encryption(opts); e != nil && e.ClientKey != nil {
+		return nil, errors.New("client side encryption is not supported by resumable uploads")
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	state, err := store.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		if state, err = b.resumeState(ctx, state, info); err != nil {
+			return nil, err
+		}
+	}
+	input, err := b.putObjectInput(key, file, opts)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		partSize := int64(DefaultResumablePartSize)
+		if opts != nil && opts.PartSize > 0 {
+			partSize = opts.PartSize
+		}
+		for info.Size() > partSize*maxParts {
+			partSize *= 2
+		}
+		mp, err := b.client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			ACL:                  input.ACL,
+			StorageClass:         input.StorageClass,
+			Tagging:              input.Tagging,
+			Metadata:             input.Metadata,
+			ContentType:          input.ContentType,
+			ContentEncoding:      input.ContentEncoding,
+			CacheControl:         input.CacheControl,
+			ContentDisposition:   input.ContentDisposition,
+			ServerSideEncryption: input.ServerSideEncryption,
+			SSEKMSKeyId:          input.SSEKMSKeyId,
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		})
+		if err != nil {
+			return nil, err
+		}
+		state = &UploadState{Key: key, UploadID: *mp.UploadId, PartSize: partSize, Size: info.Size(), ModTime: info.ModTime()}
+		if err = store.Save(ctx, state); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Info("Resuming upload", "bucket", b.Bucket, "key", key, "uploadId", state.UploadID, "parts", len(state.Parts))
+	}
+
+	done := map[int32]bool{}
+	for _, p := range state.Parts {
+		done[p.Number] = true
+	}
+	mu := sync.Mutex{}
+	errG, partCtx := errgroup.WithContext(ctx)
+	errG.SetLimit(b.concurrency)
+	for offset, number := int64(0), int32(1); offset < info.Size() || number == 1; offset, number = offset+state.PartSize, number+1 {
+		if done[number] {
+			continue
+		}
+		offset, number := offset, number
+		errG.Go(func() error {
+			size := state.PartSize
+			if offset+size > info.Size() {
+				size = info.Size() - offset
+			}
+			part := &awss3.UploadPartInput{
+				Bucket:               input.Bucket,
+				Key:                  input.Key,
+				UploadId:             &state.UploadID,
+				PartNumber:           &number,
+				Body:                 io.NewSectionReader(file, offset, size),
+				ContentLength:        &size,
+				SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+				SSECustomerKey:       input.SSECustomerKey,
+				SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+			}
+			out, err := b.client.UploadPart(partCtx, part)
+			if err != nil {
+				return errors.Wrapf(err, "failed to upload part %d of %s", number, src)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			state.Parts = append(state.Parts, UploadedPart{Number: number, ETag: aws.ToString(out.ETag), Size: size})
+			return store.Save(ctx, state)
+		})
+	}
+	if err = errG.Wait(); err != nil {
+		// the upload is kept to be resumed
+		return nil, err
+	}
+	sort.Slice(state.Parts, func(i, j int) bool { return state.Parts[i].Number < state.Parts[j].Number })
+	parts := make([]types.CompletedPart, len(state.Parts))
+	for i, p := range state.Parts {
+		parts[i] = types.CompletedPart{PartNumber: ptr.Of(p.Number), ETag: ptr.Of(p.ETag)}
+	}
+	out, err := b.client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		UploadId:             &state.UploadID,
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = store.Delete(ctx, key); err != nil {
+		log.Error(err, "Failed to delete upload state", "key", key)
+	}
+	return &UploadOutput{
+		UploadOutput: s3mgr.UploadOutput{
+			Location:  aws.ToString(out.Location),
+			VersionID: out.VersionId,
+			ETag:      out.ETag,
+			UploadID:  state.UploadID,
+			Key:       out.Key,
+		},
+		Endpoint:    b.Opts.Endpoint,
+		Region:      b.Region,
+		Bucket:      b.Bucket,
+		Size:        info.Size(),
+		ContentType: aws.ToString(input.ContentType),
+		Metadata:    input.Metadata,
+	}, nil
+}
+
+// resumeState reconciles a saved state with the parts of the upload, the state is reset if the upload
+// no longer exists or the file changed, in which case the upload is aborted
+func (b *BucketManager) resumeState(ctx context.Context, state *UploadState, info os.FileInfo) (*UploadState, error) {
+	if (state.Size != 0 && state.Size != info.Size()) || (!state.ModTime.IsZero() && !state.ModTime.Equal(info.ModTime())) {
+		log.FromContext(ctx).Info("File changed since the upload started, restarting it", "key", state.Key, "uploadId", state.UploadID)
+		if err := b.AbortMultipartUpload(ctx, state.Key, state.UploadID); err != nil && !IsNotFound(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	parts, err := b.listParts(ctx, state.Key, state.UploadID)
+	if IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the parts are listed from the bucket, the state may have missed the last ones before a crash
+	state.Parts = parts
+	if len(parts) > 0 && state.PartSize == 0 {
+		state.PartSize = parts[0].Size
+	}
+	state.PartSize = must.Default(state.PartSize, DefaultResumablePartSize)
+	state.Size, state.ModTime = info.Size(), info.ModTime()
+	// a listed part with an unexpected size cannot be part of this upload, it is uploaded again
+	valid := parts[:0]
+	for _, p := range parts {
+		expected := info.Size() - int64(p.Number-1)*state.PartSize
+		if expected > state.PartSize {
+			expected = state.PartSize
+		}
+		if p.Size == expected {
+			valid = append(valid, p)
+		}
+	}
+	state.Parts = valid
+	return state, nil
+}
+
+func (b *BucketManager) listParts(ctx context.Context, key, uploadID string) ([]UploadedPart, error) {
+	var parts []UploadedPart
+	input := &awss3.ListPartsInput{Bucket: &b.Bucket, Key: &key, UploadId: &uploadID}
+	for {
+		out, err := b.client.ListParts(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range out.Parts {
+			parts = append(parts, UploadedPart{Number: aws.ToInt32(p.PartNumber), ETag: aws.ToString(p.ETag), Size: aws.ToInt64(p.Size)})
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = out.NextPartNumberMarker
+	}
+}
+
+// MultipartUpload is an upload in progress, or abandoned
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+// ListMultipartUploads returns the multipart uploads in progress under the given prefix
+func (b *BucketManager) ListMultipartUploads(ctx context.Context, prefix string) ([]MultipartUpload, error) {
+	var uploads []MultipartUpload
+	input := &awss3.ListMultipartUploadsInput{Bucket: &b.Bucket, Prefix: &prefix}
+	for {
+		out, err := b.client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range out.Uploads {
+			uploads = append(uploads, MultipartUpload{
+				Key:       aws.ToString(u.Key),
+				UploadID:  aws.ToString(u.UploadId),
+				Initiated: aws.ToTime(u.Initiated),
+			})
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return uploads, nil
+		}
+		input.KeyMarker, input.UploadIdMarker = out.NextKeyMarker, out.NextUploadIdMarker
+	}
+}
+
+// AbortMultipartUpload aborts a multipart upload and deletes its parts
+func (b *BucketManager) AbortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	_, err := b.client.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{
+		Bucket:   &b.Bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	return err
+}
+
+// AbortStaleUploads aborts the multipart uploads under the given prefix initiated more than olderThan ago,
+// it returns the aborted uploads
+func (b *BucketManager) AbortStaleUploads(ctx context.Context, prefix string, olderThan time.Duration) ([]MultipartUpload, error) {
+	uploads, err := b.ListMultipartUploads(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var aborted []MultipartUpload
+	for _, u := range uploads {
+		if time.Since(u.Initiated) < olderThan {
+			continue
+		}
+		if err = b.AbortMultipartUpload(ctx, u.Key, u.UploadID); err != nil && !IsNotFound(err) {
+			return aborted, errors.Wrapf(err, "failed to abort upload %s of %s", u.UploadID, u.Key)
+		}
+		log.FromContext(ctx).Info("Aborted stale upload", "bucket", b.Bucket, "key", u.Key, "uploadId", u.UploadID, "initiated", u.Initiated)
+		aborted = append(aborted, u)
+	}
+	return aborted, nil
+}
+
+// DownloadResumable downloads an object to the file dst, through the partial file dst.partial which is
+// renamed to dst once complete. A partial file left by an earlier attempt is continued from its end if
+// the object has not changed since, client side encrypted objects are always downloaded from the start.
+func (b *BucketManager) DownloadResumable(ctx context.Context, key, dst string) (int64, error) {
+	r, err := b.Open(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	partial, etagFile := dst+".partial", dst+".partial.etag"
+	etag := aws.ToString(r.Head.ETag)
+	var offset int64
+	if saved, err := os.ReadFile(etagFile); err == nil && string(saved) == etag && !r.whole {
+		if info, err := os.Stat(partial); err == nil && info.Size() <= r.size {
+			offset = info.Size()
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	if err = os.WriteFile(etagFile, []byte(etag), 0o644); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if err = file.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		log.FromContext(ctx).Info("Resuming download", "bucket", b.Bucket, "key", key, "offset", offset)
+	}
+	r.offset = offset
+	n, err := io.Copy(file, r)
+	if err != nil {
+		return offset + n, err
+	}
+	if err = file.Close(); err != nil {
+		return offset + n, err
+	}
+	if err = os.Rename(partial, dst); err != nil {
+		return offset + n, err
+	}
+	_ = os.Remove(etagFile)
+	return offset + n, nil
+}
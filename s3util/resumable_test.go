@@ -0,0 +1,134 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadResumable(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		parts    = map[int]int{}
+		uploaded []int
+		failPart = 2
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>`)
+		case r.Method == http.MethodPut && q.Has("partNumber"):
+			number, _ := strconv.Atoi(q.Get("partNumber"))
+			if number == failPart {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			parts[number] = len(body)
+			uploaded = append(uploaded, number)
+			w.Header().Set("ETag", fmt.Sprintf(`"p%d"`, number))
+		case r.Method == http.MethodGet && q.Has("uploadId"):
+			fmt.Fprint(w, `<ListPartsResult><IsTruncated>false</IsTruncated>`)
+			for number, size := range parts {
+				fmt.Fprintf(w, `<Part><PartNumber>%d</PartNumber><ETag>"p%d"</ETag><Size>%d</Size></Part>`, number, number, size)
+			}
+			fmt.Fprint(w, `</ListPartsResult>`)
+		case r.Method == http.MethodPost && q.Has("uploadId"):
+			fmt.Fprint(w, `<CompleteMultipartUploadResult><Key>snapshot</Key><ETag>"m-3"</ETag></CompleteMultipartUploadResult>`)
+		}
+	}))
+	defer srv.Close()
+	client := awss3.New(awss3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(srv.URL),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "snapshot")
+	require.NoError(t, os.WriteFile(src, bytes.Repeat([]byte("a"), 10), 0o644))
+	store := &FileStateStore{Dir: filepath.Join(dir, "state")}
+
+	_, err = b.UploadResumable(ctx, src, "snapshot", store, &UploadOptions{PartSize: 4})
+	require.Error(t, err)
+	state, err := store.Load(ctx, "snapshot")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, "u1", state.UploadID)
+	assert.Equal(t, []UploadedPart{{Number: 1, ETag: `"p1"`, Size: 4}}, state.Parts)
+
+	failPart = 0
+	out, err := b.UploadResumable(ctx, src, "snapshot", store, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "u1", out.UploadID)
+	assert.Equal(t, int64(10), out.Size)
+	sort.Ints(uploaded)
+	assert.Equal(t, []int{1, 2, 3}, uploaded)
+	state, err = store.Load(ctx, "snapshot")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestDownloadResumable(t *testing.T) {
+	content := []byte("0123456789")
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"e"`)
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start, end int
+		_, _ = fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(content[start : end+1])
+	}))
+	defer srv.Close()
+	client := awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+	dst := filepath.Join(t.TempDir(), "snapshot")
+	require.NoError(t, os.WriteFile(dst+".partial", content[:6], 0o644))
+	require.NoError(t, os.WriteFile(dst+".partial.etag", []byte(`"e"`), 0o644))
+
+	n, err := b.DownloadResumable(context.Background(), "snapshot", dst)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.Equal(t, []string{"bytes=6-9"}, ranges)
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.NoFileExists(t, dst+".partial")
+}
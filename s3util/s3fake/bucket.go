@@ -0,0 +1,333 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3fake
+
+import (
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configNotFound are the error codes of the bucket configurations stored as they are put
+var configNotFound = map[string]string{
+	"lifecycle":         "NoSuchLifecycleConfiguration",
+	"encryption":        "ServerSideEncryptionConfigurationNotFoundError",
+	"publicAccessBlock": "NoSuchPublicAccessBlockConfiguration",
+}
+
+// serveBucket handles the requests without a key
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, name string, body []byte) error {
+	q := r.URL.Query()
+	b, ok := s.buckets[name]
+	if r.Method == http.MethodPut && !hasSubresource(q) {
+		if ok {
+			return &apiError{http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it."}
+		}
+		s.createBucket(name)
+		w.Header().Set("Location", "/"+name)
+		return nil
+	}
+	if !ok {
+		return errNoSuchBucket
+	}
+	for sub, code := range configNotFound {
+		if q.Has(sub) {
+			return b.serveConfig(w, r, sub, code, body)
+		}
+	}
+	switch {
+	case q.Has("versioning"):
+		return b.serveVersioning(w, r, body)
+	case r.Method == http.MethodHead:
+		return nil
+	case r.Method == http.MethodPost && q.Has("delete"):
+		return s.deleteObjects(w, b, body)
+	case r.Method == http.MethodGet && q.Has("uploads"):
+		return b.listUploads(w, r)
+	case r.Method == http.MethodGet && q.Has("versions"):
+		return b.listVersions(w, r)
+	case r.Method == http.MethodGet && q.Get("list-type") == "2":
+		return b.listObjects(w, r)
+	case r.Method == http.MethodDelete && !hasSubresource(q):
+		if len(b.objects) > 0 || len(b.uploads) > 0 {
+			return &apiError{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+		}
+		delete(s.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errNotImplemented
+}
+
+func hasSubresource(q map[string][]string) bool {
+	for k := range q {
+		if k != "x-id" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveConfig stores, returns or deletes a bucket configuration as sent by the client
+func (b *bucket) serveConfig(w http.ResponseWriter, r *http.Request, sub, code string, body []byte) error {
+	switch r.Method {
+	case http.MethodPut:
+		b.configs[sub] = body
+		return nil
+	case http.MethodGet:
+		config, ok := b.configs[sub]
+		if !ok {
+			return &apiError{http.StatusNotFound, code, "The " + sub + " configuration does not exist"}
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = w.Write(config)
+		return nil
+	case http.MethodDelete:
+		delete(b.configs, sub)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errNotImplemented
+}
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:",omitempty"`
+}
+
+func (b *bucket) serveVersioning(w http.ResponseWriter, r *http.Request, body []byte) error {
+	switch r.Method {
+	case http.MethodPut:
+		var config versioningConfiguration
+		if err := readXML(body, &config); err != nil {
+			return err
+		}
+		if config.Status != "Enabled" && config.Status != "Suspended" {
+			return errMalformedXML
+		}
+		b.versioning = config.Status
+		return nil
+	case http.MethodGet:
+		writeXML(w, http.StatusOK, versioningConfiguration{Status: b.versioning})
+		return nil
+	}
+	return errNotImplemented
+}
+
+type listObjectsResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []objectEntry
+	CommonPrefixes        []commonPrefix
+}
+
+type objectEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+func maxKeys(q map[string][]string) (int, error) {
+	values := q["max-keys"]
+	if len(values) == 0 {
+		return 1000, nil
+	}
+	n, err := strconv.Atoi(values[0])
+	if err != nil || n < 0 {
+		return 0, invalidArgument("Provided max-keys not an integer or within integer range")
+	}
+	if n > 1000 {
+		n = 1000
+	}
+	return n, nil
+}
+
+// listObjects handles ListObjectsV2, the continuation token is the last key or common prefix returned
+func (b *bucket) listObjects(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	limit, err := maxKeys(q)
+	if err != nil {
+		return err
+	}
+	res := listObjectsResult{
+		Name:              b.name,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           limit,
+	}
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		after = res.ContinuationToken
+	}
+	last := ""
+	for _, key := range b.keys() {
+		if !strings.HasPrefix(key, res.Prefix) {
+			continue
+		}
+		entry := key
+		if res.Delimiter != "" {
+			if i := strings.Index(key[len(res.Prefix):], res.Delimiter); i >= 0 {
+				entry = key[:len(res.Prefix)+i+len(res.Delimiter)]
+			}
+		}
+		if entry <= after || entry == last {
+			continue
+		}
+		if res.KeyCount == limit {
+			res.IsTruncated = limit > 0
+			break
+		}
+		if entry != key {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{entry})
+		} else {
+			o := b.objects[key][len(b.objects[key])-1]
+			res.Contents = append(res.Contents, o.entry())
+		}
+		res.KeyCount++
+		last = entry
+	}
+	if res.IsTruncated {
+		res.NextContinuationToken = last
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+func (o *object) entry() objectEntry {
+	return objectEntry{
+		Key:          o.key,
+		LastModified: timestamp(o.modified),
+		ETag:         o.etag,
+		Size:         len(o.data),
+		StorageClass: storageClass(o.header),
+	}
+}
+
+func storageClass(header http.Header) string {
+	if class := header.Get(storageClassHeader); class != "" {
+		return class
+	}
+	return "STANDARD"
+}
+
+type listVersionsResult struct {
+	XMLName       xml.Name `xml:"ListVersionsResult"`
+	Name          string
+	Prefix        string
+	KeyMarker     string
+	MaxKeys       int
+	IsTruncated   bool
+	Versions      []versionEntry `xml:"Version"`
+	DeleteMarkers []versionEntry `xml:"DeleteMarker"`
+}
+
+type versionEntry struct {
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified string
+	ETag         string `xml:",omitempty"`
+	Size         *int   `xml:",omitempty"`
+	StorageClass string `xml:",omitempty"`
+}
+
+// listVersions handles ListObjectVersions, all the versions are returned in a single page
+func (b *bucket) listVersions(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	res := listVersionsResult{Name: b.name, Prefix: q.Get("prefix"), KeyMarker: q.Get("key-marker"), MaxKeys: 1000}
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, res.Prefix) && key > res.KeyMarker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		versions := b.objects[key]
+		for i := len(versions) - 1; i >= 0; i-- {
+			o := versions[i]
+			entry := versionEntry{
+				Key:          o.key,
+				VersionID:    o.versionID,
+				IsLatest:     i == len(versions)-1,
+				LastModified: timestamp(o.modified),
+			}
+			if o.deleteMarker {
+				res.DeleteMarkers = append(res.DeleteMarkers, entry)
+				continue
+			}
+			size := len(o.data)
+			entry.ETag, entry.Size, entry.StorageClass = o.etag, &size, storageClass(o.header)
+			res.Versions = append(res.Versions, entry)
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key       string
+		VersionID string `xml:"VersionId"`
+	} `xml:"Object"`
+	Quiet bool
+}
+
+type deleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []deletedEntry
+}
+
+type deletedEntry struct {
+	Key                   string
+	VersionID             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:",omitempty"`
+	DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+// deleteObjects handles DeleteObjects, deleting missing keys succeeds like S3
+func (s *Server) deleteObjects(w http.ResponseWriter, b *bucket, body []byte) error {
+	var req deleteRequest
+	if err := readXML(body, &req); err != nil {
+		return err
+	}
+	if len(req.Objects) > 1000 {
+		return errMalformedXML
+	}
+	var res deleteResult
+	for _, o := range req.Objects {
+		deleted := s.delete(b, o.Key, o.VersionID)
+		if req.Quiet {
+			continue
+		}
+		entry := deletedEntry{Key: o.Key, VersionID: o.VersionID}
+		if deleted != nil && deleted.deleteMarker {
+			entry.DeleteMarker = true
+			entry.DeleteMarkerVersionID = deleted.versionID
+		}
+		res.Deleted = append(res.Deleted, entry)
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3fake
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPartNumber is the maximum number of parts of a multipart upload
+const maxPartNumber = 10000
+
+type upload struct {
+	key       string
+	id        string
+	initiated time.Time
+	header    http.Header
+	parts     map[int]*part
+}
+
+type part struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// upload returns the multipart upload of key with the given id
+func (b *bucket) upload(key, id string) (*upload, error) {
+	u, ok := b.uploads[id]
+	if !ok || u.key != key {
+		return nil, errNoSuchUpload
+	}
+	return u, nil
+}
+
+type initiateUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, b *bucket, key string) error {
+	u := &upload{
+		key:       key,
+		id:        fmt.Sprintf("upload-%d", s.nextID()),
+		initiated: s.now(),
+		header:    objectHeader(r.Header),
+		parts:     map[int]*part{},
+	}
+	b.uploads[u.id] = u
+	writeXML(w, http.StatusOK, initiateUploadResult{Bucket: b.name, Key: key, UploadID: u.id})
+	return nil
+}
+
+type copyPartResult struct {
+	XMLName      xml.Name `xml:"CopyPartResult"`
+	ETag         string
+	LastModified string
+}
+
+// uploadPart handles UploadPart and UploadPartCopy
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, b *bucket, key string, body []byte) error {
+	q := r.URL.Query()
+	u, err := b.upload(key, q.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		return invalidArgument("Part number must be an integer between 1 and 10000, inclusive")
+	}
+	if r.Header.Get(copySourceHeader) == "" {
+		p := &part{data: body, etag: etag(body), modified: s.now()}
+		u.parts[number] = p
+		w.Header().Set("ETag", p.etag)
+		return nil
+	}
+	_, src, err := s.copySource(r)
+	if err != nil {
+		return err
+	}
+	data := src.data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+			return invalidArgument("The x-amz-copy-source-range value must be of the form bytes=first-last where first and last are the zero-based offsets of the first and last bytes to copy")
+		}
+		data = data[start : end+1]
+	}
+	p := &part{data: data, etag: etag(data), modified: s.now()}
+	u.parts[number] = p
+	if src.versionID != "null" {
+		w.Header().Set("X-Amz-Copy-Source-Version-Id", src.versionID)
+	}
+	writeXML(w, http.StatusOK, copyPartResult{ETag: p.etag, LastModified: timestamp(p.modified)})
+	return nil
+}
+
+type completeUploadRequest struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// completeUpload assembles the listed parts, the ETag is the MD5 of the part MD5s and the number of parts like S3
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, b *bucket, key string, body []byte) error {
+	u, err := b.upload(key, r.URL.Query().Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	var req completeUploadRequest
+	if err := readXML(body, &req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+	var data, sums []byte
+	for i, listed := range req.Parts {
+		if i > 0 && listed.PartNumber <= req.Parts[i-1].PartNumber {
+			return &apiError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order. The parts list must be specified in order by part number."}
+		}
+		p, ok := u.parts[listed.PartNumber]
+		if !ok || strings.Trim(listed.ETag, `"`) != strings.Trim(p.etag, `"`) {
+			return &apiError{http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d could not be found or its ETag does not match", listed.PartNumber)}
+		}
+		if i < len(req.Parts)-1 && int64(len(p.data)) < s.MinPartSize {
+			return &apiError{http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size."}
+		}
+		sum, _ := hex.DecodeString(strings.Trim(p.etag, `"`))
+		sums = append(sums, sum...)
+		data = append(data, p.data...)
+	}
+	sum := md5.Sum(sums)
+	o := s.put(b, &object{
+		key:    key,
+		data:   data,
+		etag:   fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts)),
+		header: u.header,
+	})
+	delete(b.uploads, u.id)
+	writeVersionHeader(w, o)
+	writeXML(w, http.StatusOK, completeUploadResult{Location: "/" + b.name + "/" + key, Bucket: b.name, Key: key, ETag: o.etag})
+	return nil
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name `xml:"ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadID             string `xml:"UploadId"`
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []partEntry `xml:"Part"`
+}
+
+type partEntry struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+// listParts handles ListParts, paginated by part number like S3
+func (b *bucket) listParts(w http.ResponseWriter, r *http.Request, key string) error {
+	q := r.URL.Query()
+	u, err := b.upload(key, q.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	res := listPartsResult{Bucket: b.name, Key: key, UploadID: u.id, MaxParts: 1000}
+	res.PartNumberMarker, _ = strconv.Atoi(q.Get("part-number-marker"))
+	if n, err := strconv.Atoi(q.Get("max-parts")); err == nil && n > 0 && n < res.MaxParts {
+		res.MaxParts = n
+	}
+	numbers := make([]int, 0, len(u.parts))
+	for number := range u.parts {
+		if number > res.PartNumberMarker {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	if len(numbers) > res.MaxParts {
+		numbers, res.IsTruncated = numbers[:res.MaxParts], true
+	}
+	for _, number := range numbers {
+		p := u.parts[number]
+		res.Parts = append(res.Parts, partEntry{PartNumber: number, LastModified: timestamp(p.modified), ETag: p.etag, Size: len(p.data)})
+		res.NextPartNumberMarker = number
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
+
+type listUploadsResult struct {
+	XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+	Bucket      string
+	Prefix      string
+	MaxUploads  int
+	IsTruncated bool
+	Uploads     []uploadEntry `xml:"Upload"`
+}
+
+type uploadEntry struct {
+	Key          string
+	UploadID     string `xml:"UploadId"`
+	Initiated    string
+	StorageClass string
+}
+
+// listUploads handles ListMultipartUploads, all the uploads are returned in a single page
+func (b *bucket) listUploads(w http.ResponseWriter, r *http.Request) error {
+	res := listUploadsResult{Bucket: b.name, Prefix: r.URL.Query().Get("prefix"), MaxUploads: 1000}
+	uploads := make([]*upload, 0, len(b.uploads))
+	for _, u := range b.uploads {
+		if strings.HasPrefix(u.key, res.Prefix) {
+			uploads = append(uploads, u)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].key != uploads[j].key {
+			return uploads[i].key < uploads[j].key
+		}
+		return uploads[i].initiated.Before(uploads[j].initiated)
+	})
+	for _, u := range uploads {
+		res.Uploads = append(res.Uploads, uploadEntry{Key: u.key, UploadID: u.id, Initiated: timestamp(u.initiated), StorageClass: storageClass(u.header)})
+	}
+	writeXML(w, http.StatusOK, res)
+	return nil
+}
@@ -0,0 +1,272 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	metaPrefix           = "X-Amz-Meta-"
+	storageClassHeader   = "X-Amz-Storage-Class"
+	versionIDHeader      = "X-Amz-Version-Id"
+	deleteMarkerHeader   = "X-Amz-Delete-Marker"
+	copySourceHeader     = "X-Amz-Copy-Source"
+	customerKeyMD5       = "X-Amz-Server-Side-Encryption-Customer-Key-Md5"
+	customerKeyAlgorithm = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+)
+
+// storedHeaders are the headers of a put request stored with the object and returned by GET and HEAD
+var storedHeaders = []string{
+	"Content-Type",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Disposition",
+	"Cache-Control",
+	"Expires",
+	storageClassHeader,
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	customerKeyAlgorithm,
+	customerKeyMD5,
+}
+
+// objectHeader returns the headers of a put request to store with the object
+func objectHeader(h http.Header) http.Header {
+	header := http.Header{}
+	for k, v := range h {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if strings.HasPrefix(k, metaPrefix) {
+			header[k] = v
+		}
+	}
+	for _, k := range storedHeaders {
+		if v := h.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "binary/octet-stream")
+	}
+	return header
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// serveObject handles the requests of a key
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, b *bucket, key string, body []byte) error {
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		return s.createUpload(w, r, b, key)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		return s.completeUpload(w, r, b, key, body)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		return s.uploadPart(w, r, b, key, body)
+	case r.Method == http.MethodGet && q.Has("uploadId"):
+		return b.listParts(w, r, key)
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		if _, err := b.upload(key, q.Get("uploadId")); err != nil {
+			return err
+		}
+		delete(b.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case hasSubresource(q) && !q.Has("versionId"):
+		return errNotImplemented
+	case r.Method == http.MethodPut && r.Header.Get(copySourceHeader) != "":
+		return s.copyObject(w, r, b, key)
+	case r.Method == http.MethodPut:
+		o := s.put(b, &object{key: key, data: body, etag: etag(body), header: objectHeader(r.Header)})
+		writeVersionHeader(w, o)
+		w.Header().Set("ETag", o.etag)
+		return nil
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return b.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		if o := s.delete(b, key, q.Get("versionId")); o != nil {
+			writeVersionHeader(w, o)
+			if o.deleteMarker {
+				w.Header().Set(deleteMarkerHeader, "true")
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errNotImplemented
+}
+
+func writeVersionHeader(w http.ResponseWriter, o *object) {
+	if o.versionID != "null" {
+		w.Header().Set(versionIDHeader, o.versionID)
+	}
+}
+
+// put stores a new version of an object, replacing the null version unless versioning is enabled
+func (s *Server) put(b *bucket, o *object) *object {
+	o.modified = s.now()
+	o.versionID = "null"
+	if b.versioning == "Enabled" {
+		o.versionID = strconv.Itoa(s.nextID())
+	} else {
+		b.removeVersion(o.key, "null")
+	}
+	b.objects[o.key] = append(b.objects[o.key], o)
+	return o
+}
+
+// delete deletes a version of key, or the key by a delete marker when the bucket is versioned.
+// It returns the deleted version or the delete marker, nil if nothing was deleted.
+func (s *Server) delete(b *bucket, key, versionID string) *object {
+	if versionID != "" {
+		return b.removeVersion(key, versionID)
+	}
+	if b.versioning == "" {
+		versions := b.objects[key]
+		delete(b.objects, key)
+		if len(versions) == 0 {
+			return nil
+		}
+		return versions[len(versions)-1]
+	}
+	return s.put(b, &object{key: key, deleteMarker: true, header: http.Header{}})
+}
+
+func (b *bucket) removeVersion(key, versionID string) *object {
+	versions := b.objects[key]
+	for i, o := range versions {
+		if o.versionID != versionID {
+			continue
+		}
+		versions = append(versions[:i:i], versions[i+1:]...)
+		if len(versions) == 0 {
+			delete(b.objects, key)
+		} else {
+			b.objects[key] = versions
+		}
+		return o
+	}
+	return nil
+}
+
+// latest returns the given version of key, or its latest version if versionID is empty
+func (b *bucket) latest(key, versionID string) (*object, error) {
+	versions := b.objects[key]
+	if versionID == "" {
+		if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+			return nil, errNoSuchKey
+		}
+		return versions[len(versions)-1], nil
+	}
+	for _, o := range versions {
+		if o.versionID != versionID {
+			continue
+		}
+		if o.deleteMarker {
+			return nil, &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+		}
+		return o, nil
+	}
+	return nil, errNoSuchVersion
+}
+
+// getObject handles GetObject and HeadObject, including ranges and conditional requests
+func (b *bucket) getObject(w http.ResponseWriter, r *http.Request, key string) error {
+	o, err := b.latest(key, r.URL.Query().Get("versionId"))
+	if err != nil {
+		return err
+	}
+	if sum := o.header.Get(customerKeyMD5); sum != "" && sum != r.Header.Get(customerKeyMD5) {
+		return &apiError{http.StatusBadRequest, "InvalidRequest", "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object."}
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != o.etag {
+		return errPrecondition
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && match == o.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	writeVersionHeader(w, o)
+	w.Header().Set("ETag", o.etag)
+	// the conditions are checked above with S3 errors
+	r.Header.Del("If-Match")
+	r.Header.Del("If-None-Match")
+	http.ServeContent(w, r, "", o.modified, bytes.NewReader(o.data))
+	return nil
+}
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	ETag         string
+	LastModified string
+}
+
+// copySource returns the object of the x-amz-copy-source header, bucket/key?versionId=id
+func (s *Server) copySource(r *http.Request) (*bucket, *object, error) {
+	source := strings.TrimPrefix(r.Header.Get(copySourceHeader), "/")
+	path, query, _ := strings.Cut(source, "?")
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, nil, invalidArgument("Invalid copy source encoding")
+	}
+	name, key, ok := strings.Cut(path, "/")
+	if !ok || key == "" {
+		return nil, nil, invalidArgument("Invalid copy source object key")
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, nil, invalidArgument("Invalid copy source version id")
+	}
+	b, ok := s.buckets[name]
+	if !ok {
+		return nil, nil, errNoSuchBucket
+	}
+	o, err := b.latest(key, values.Get("versionId"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if match := r.Header.Get("X-Amz-Copy-Source-If-Match"); match != "" && match != o.etag {
+		return nil, nil, errPrecondition
+	}
+	return b, o, nil
+}
+
+// copyObject handles CopyObject, the metadata is copied unless the directive is REPLACE
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, b *bucket, key string) error {
+	srcBucket, src, err := s.copySource(r)
+	if err != nil {
+		return err
+	}
+	replace := r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE"
+	if srcBucket == b && src.key == key && !replace && !strings.Contains(r.Header.Get(copySourceHeader), "versionId=") {
+		return &apiError{http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes."}
+	}
+	header := src.header
+	if replace {
+		header = objectHeader(r.Header)
+	}
+	o := s.put(b, &object{key: key, data: src.data, etag: src.etag, header: header})
+	writeVersionHeader(w, o)
+	if src.versionID != "null" {
+		w.Header().Set("X-Amz-Copy-Source-Version-Id", src.versionID)
+	}
+	writeXML(w, http.StatusOK, copyObjectResult{ETag: o.etag, LastModified: timestamp(o.modified)})
+	return nil
+}
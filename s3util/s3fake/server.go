@@ -0,0 +1,279 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+// Package s3fake is an in-memory S3 compatible server for tests, implementing the subset of the S3 API
+// used by s3util: objects, listings, versions, copies, multipart uploads and bucket configurations.
+// Requests are not authenticated and buckets are addressed by path.
+package s3fake
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Server is an in-memory S3 server listening on a local address
+type Server struct {
+	// URL is the endpoint of the server, e.g. http://127.0.0.1:1234
+	URL string
+	// MinPartSize is the minimum size of all but the last part of a multipart upload.
+	// S3 requires 5MiB, the default of zero accepts parts of any size.
+	MinPartSize int64
+
+	srv     *httptest.Server
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	seq     int
+	last    time.Time
+}
+
+type bucket struct {
+	name       string
+	created    time.Time
+	versioning string
+	// objects are the versions of each key, the latest last
+	objects map[string][]*object
+	uploads map[string]*upload
+	// configs are the raw lifecycle, encryption and publicAccessBlock configurations
+	configs map[string][]byte
+}
+
+type object struct {
+	key          string
+	versionID    string
+	data         []byte
+	etag         string
+	modified     time.Time
+	header       http.Header
+	deleteMarker bool
+}
+
+// NewServer starts a server with the given buckets, it must be closed
+func NewServer(buckets ...string) *Server {
+	s := &Server{buckets: map[string]*bucket{}}
+	for _, name := range buckets {
+		s.CreateBucket(name)
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns an anonymous path style S3 client of the server, to be used with s3util.NewManagerWithClient
+func (s *Server) Client() *awss3.Client {
+	return awss3.New(awss3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String(s.URL),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+		Credentials:      aws.AnonymousCredentials{},
+	})
+}
+
+// CreateBucket creates an empty bucket, an existing bucket is kept
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.createBucket(name)
+}
+
+func (s *Server) createBucket(name string) *bucket {
+	if b, ok := s.buckets[name]; ok {
+		return b
+	}
+	b := &bucket{
+		name:    name,
+		created: s.now(),
+		objects: map[string][]*object{},
+		uploads: map[string]*upload{},
+		configs: map[string][]byte{},
+	}
+	s.buckets[name] = b
+	return b
+}
+
+// PutObject stores data at key, creating the bucket if needed
+func (s *Server) PutObject(bucketName, key string, data []byte, metadata map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	header := http.Header{}
+	for k, v := range metadata {
+		header.Set(metaPrefix+k, v)
+	}
+	s.put(s.createBucket(bucketName), &object{key: key, data: data, etag: etag(data), header: header})
+}
+
+// GetObject returns the content of the latest version of key
+func (s *Server) GetObject(bucketName, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	o, err := b.latest(key, "")
+	if err != nil {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Keys returns the keys of the bucket in order, deleted keys are omitted
+func (s *Server) Keys(bucketName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil
+	}
+	return b.keys()
+}
+
+// Uploads returns the number of multipart uploads in progress in the bucket
+func (s *Server) Uploads(bucketName string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buckets[bucketName]; ok {
+		return len(b.uploads)
+	}
+	return 0
+}
+
+// now returns the time of a modification, strictly after the previous one so versions are ordered
+func (s *Server) now() time.Time {
+	t := time.Now().UTC().Truncate(time.Millisecond)
+	if !t.After(s.last) {
+		t = s.last.Add(time.Millisecond)
+	}
+	s.last = t
+	return t
+}
+
+func (s *Server) nextID() int {
+	s.seq++
+	return s.seq
+}
+
+// keys returns the keys whose latest version is not a delete marker
+func (b *bucket) keys() []string {
+	keys := make([]string, 0, len(b.objects))
+	for key, versions := range b.objects {
+		if !versions[len(versions)-1].deleteMarker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP handles a path style S3 request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, &apiError{http.StatusBadRequest, "IncompleteBody", err.Error()})
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if name == "" {
+		writeError(w, r, errNotImplemented)
+		return
+	}
+	if key == "" {
+		err = s.serveBucket(w, r, name, body)
+	} else {
+		b, ok := s.buckets[name]
+		if !ok {
+			err = errNoSuchBucket
+		} else {
+			err = s.serveObject(w, r, b, key, body)
+		}
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errNoSuchBucket   = &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey      = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchVersion  = &apiError{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist."}
+	errNoSuchUpload   = &apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errNotImplemented = &apiError{http.StatusNotImplemented, "NotImplemented", "The request is not implemented by s3fake"}
+	errPrecondition   = &apiError{http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the preconditions you specified did not hold"}
+	errMalformedXML   = &apiError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+)
+
+func invalidArgument(message string) *apiError {
+	return &apiError{http.StatusBadRequest, "InvalidArgument", message}
+}
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	RequestID string `xml:"RequestId"`
+}
+
+// writeError writes err as an S3 error, HEAD responses only have the status like S3
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*apiError)
+	if !ok {
+		e = &apiError{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeXML(w, e.status, errorResponse{Code: e.code, Message: e.message, RequestID: "s3fake"})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(data)
+}
+
+func readXML(body []byte, v any) error {
+	if err := xml.Unmarshal(body, v); err != nil {
+		return errMalformedXML
+	}
+	return nil
+}
+
+// timestamp formats t like the timestamps of S3 XML responses
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
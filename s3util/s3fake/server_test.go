@@ -0,0 +1,160 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3fake
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+func TestObjects(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer("b")
+	defer srv.Close()
+	client := srv.Client()
+
+	_, err := client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket:      aws.String("b"),
+		Key:         aws.String("dir/a b.txt"),
+		Body:        strings.NewReader("0123456789"),
+		ContentType: aws.String("text/plain"),
+		Metadata:    map[string]string{"owner": "devnet"},
+	})
+	require.NoError(t, err)
+	out, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("dir/a b.txt"), Range: aws.String("bytes=2-4")})
+	require.NoError(t, err)
+	data, err := io.ReadAll(out.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "234", string(data))
+	assert.Equal(t, "bytes 2-4/10", aws.ToString(out.ContentRange))
+	assert.Equal(t, "text/plain", aws.ToString(out.ContentType))
+	assert.Equal(t, "devnet", out.Metadata["owner"])
+
+	_, err = client.HeadObject(ctx, &awss3.HeadObjectInput{Bucket: aws.String("b"), Key: aws.String("dir/a b.txt"), IfMatch: aws.String(`"other"`)})
+	assert.Error(t, err)
+	_, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("missing")})
+	assert.Equal(t, "NoSuchKey", errorCode(err))
+	_, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("missing"), Key: aws.String("k")})
+	assert.Equal(t, "NoSuchBucket", errorCode(err))
+
+	for _, key := range []string{"dir/b", "dir/sub/c", "dir/sub/d", "dir/tmp/e", "f"} {
+		srv.PutObject("b", key, []byte(key), nil)
+	}
+	var keys []string
+	input := &awss3.ListObjectsV2Input{Bucket: aws.String("b"), Prefix: aws.String("dir/"), Delimiter: aws.String("/"), MaxKeys: aws.Int32(2)}
+	for p := awss3.NewListObjectsV2Paginator(client, input); p.HasMorePages(); {
+		page, err := p.NextPage(ctx)
+		require.NoError(t, err)
+		for _, o := range page.Contents {
+			keys = append(keys, *o.Key)
+		}
+		for _, cp := range page.CommonPrefixes {
+			keys = append(keys, *cp.Prefix)
+		}
+	}
+	assert.Equal(t, []string{"dir/a b.txt", "dir/b", "dir/sub/", "dir/tmp/"}, keys)
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer("b")
+	defer srv.Close()
+	client := srv.Client()
+	_, err := client.PutBucketVersioning(ctx, &awss3.PutBucketVersioningInput{
+		Bucket:                  aws.String("b"),
+		VersioningConfiguration: &types.VersioningConfiguration{Status: types.BucketVersioningStatusEnabled},
+	})
+	require.NoError(t, err)
+
+	v1, err := client.PutObject(ctx, &awss3.PutObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), Body: strings.NewReader("v1")})
+	require.NoError(t, err)
+	require.NotEmpty(t, aws.ToString(v1.VersionId))
+	del, err := client.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k")})
+	require.NoError(t, err)
+	assert.True(t, aws.ToBool(del.DeleteMarker))
+	assert.Empty(t, srv.Keys("b"))
+
+	versions, err := client.ListObjectVersions(ctx, &awss3.ListObjectVersionsInput{Bucket: aws.String("b")})
+	require.NoError(t, err)
+	require.Len(t, versions.Versions, 1)
+	require.Len(t, versions.DeleteMarkers, 1)
+	assert.True(t, aws.ToBool(versions.DeleteMarkers[0].IsLatest))
+	assert.False(t, aws.ToBool(versions.Versions[0].IsLatest))
+
+	out, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), VersionId: v1.VersionId})
+	require.NoError(t, err)
+	data, _ := io.ReadAll(out.Body)
+	assert.Equal(t, "v1", string(data))
+
+	_, err = client.DeleteObject(ctx, &awss3.DeleteObjectInput{Bucket: aws.String("b"), Key: aws.String("k"), VersionId: del.VersionId})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k"}, srv.Keys("b"))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer("b")
+	defer srv.Close()
+	srv.MinPartSize = 4
+	client := srv.Client()
+
+	created, err := client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{Bucket: aws.String("b"), Key: aws.String("k")})
+	require.NoError(t, err)
+	var parts []types.CompletedPart
+	for i, content := range []string{"ab", "cdef", "g"} {
+		out, err := client.UploadPart(ctx, &awss3.UploadPartInput{
+			Bucket:     aws.String("b"),
+			Key:        aws.String("k"),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       strings.NewReader(content),
+		})
+		require.NoError(t, err)
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(int32(i + 1)), ETag: out.ETag})
+	}
+	listed, err := client.ListParts(ctx, &awss3.ListPartsInput{Bucket: aws.String("b"), Key: aws.String("k"), UploadId: created.UploadId})
+	require.NoError(t, err)
+	assert.Len(t, listed.Parts, 3)
+
+	complete := &awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("b"),
+		Key:             aws.String("k"),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}
+	_, err = client.CompleteMultipartUpload(ctx, complete)
+	assert.Equal(t, "EntityTooSmall", errorCode(err))
+
+	srv.MinPartSize = 0
+	out, err := client.CompleteMultipartUpload(ctx, complete)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(aws.ToString(out.ETag), `-3"`))
+	data, ok := srv.GetObject("b", "k")
+	require.True(t, ok)
+	assert.Equal(t, "abcdefg", string(data))
+	assert.Zero(t, srv.Uploads("b"))
+
+	_, err = client.AbortMultipartUpload(ctx, &awss3.AbortMultipartUploadInput{Bucket: aws.String("b"), Key: aws.String("k"), UploadId: created.UploadId})
+	assert.Equal(t, "NoSuchUpload", errorCode(err))
+}
@@ -0,0 +1,181 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultStreamPartSize is the part size of UploadStream, which allows streams up to 160GiB
+	DefaultStreamPartSize = 16 << 20
+	// DefaultReadChunkSize is the size of the ranged GET requests of an ObjectReader
+	DefaultReadChunkSize = 16 << 20
+	// maxReadRetries is the number of times a failed ranged GET is retried from where it failed
+	maxReadRetries = 3
+)
+
+var errUploadStopped = errors.New("upload stopped")
+
+// UploadStream uploads the content written by write to key, which is prefixed like UploadReader.
+// The content is streamed to a multipart upload as it is written, with at most the concurrency of
+// the uploader parts in memory. If write fails the upload is aborted and its error is returned.
+func (b *BucketManager) UploadStream(ctx context.Context, key string, write func(io.Writer) error, opts *UploadOptions) (*UploadOutput, error) {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return nil, errors.Wrap(err, "Failed to acquire semaphore")
+	}
+	defer b.sem.Release(1)
+	up := UploadOptions{PartSize: DefaultStreamPartSize}
+	if opts != nil {
+		up = *opts
+		if up.PartSize == 0 {
+			up.PartSize = DefaultStreamPartSize
+		}
+	}
+	pr, pw := io.Pipe()
+	written := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		// a nil error closes the stream, a failure is returned to the uploader reading it
+		pw.CloseWithError(err)
+		written <- err
+	}()
+	out, err := b.putObject(ctx, filepath.Join(b.Prefix, key), pr, &up)
+	// unblock the writer if the upload failed before reading everything
+	pr.CloseWithError(errUploadStopped)
+	// a writer stopped by the failed upload only reports the upload error
+	if writeErr := <-written; writeErr != nil && (err == nil || !errors.Is(writeErr, errUploadStopped)) {
+		return nil, errors.Wrapf(writeErr, "failed to write %s", key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ObjectReader reads an object sequentially by ranged GET requests pinned to its ETag, an object
+// replaced while it is read fails instead of mixing contents. A request failing in the middle of
+// its range is resumed from the last byte read. Client side encrypted objects are read by a single
+// GET, as their content must be decrypted from the start.
+type ObjectReader struct {
+	// Head is the metadata of the object being read
+	Head HeadObjectOutput
+	// ChunkSize is the size of the ranged GET requests, defaults to DefaultReadChunkSize
+	ChunkSize int64
+
+	ctx     context.Context
+	b       *BucketManager
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+	whole   bool
+	retries int
+}
+
+// Open returns a reader of the content of the object, it must be closed
+func (b *BucketManager) Open(ctx context.Context, key string) (*ObjectReader, error) {
+	head, err := b.HeadObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	r := &ObjectReader{Head: head, ctx: ctx, b: b, size: aws.ToInt64(head.ContentLength)}
+	if b.Encryption != nil && b.Encryption.ClientKey != nil {
+		r.whole = true
+		if r.body, err = b.openObject(ctx, key, aws.ToString(head.VersionId)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Size returns the length of the content read, the plaintext length of client side encrypted objects
+// whose ContentLength is the length of the ciphertext
+func (r *ObjectReader) Size() int64 {
+	if r.whole {
+		return plaintextSize(r.size)
+	}
+	return r.size
+}
+
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if r.whole {
+		return r.body.Read(p)
+	}
+	for {
+		if r.body == nil {
+			if r.offset >= r.size {
+				return 0, io.EOF
+			}
+			if err := r.fetch(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.retries = 0
+		}
+		if err == nil {
+			return n, nil
+		}
+		r.body.Close()
+		r.body = nil
+		if err != io.EOF {
+			if r.retries++; r.retries > maxReadRetries {
+				return n, errors.Wrapf(err, "failed to read %s at offset %d", r.Head.Key, r.offset)
+			}
+			log.FromContext(r.ctx).Info("Resuming object read", "bucket", r.b.Bucket, "key", r.Head.Key, "offset", r.offset, "error", err.Error())
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// fetch requests the next range of the object
+func (r *ObjectReader) fetch() error {
+	end := r.offset + r.chunkSize()
+	if end > r.size {
+		end = r.size
+	}
+	input := &awss3.GetObjectInput{
+		Bucket:  &r.b.Bucket,
+		Key:     &r.Head.Key,
+		Range:   aws.String(fmt.Sprintf("bytes=%d-%d", r.offset, end-1)),
+		IfMatch: r.Head.ETag,
+	}
+	r.b.Encryption.applyGet(input)
+	out, err := r.b.client.GetObject(r.ctx, input)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s at offset %d", r.Head.Key, r.offset)
+	}
+	r.body = out.Body
+	return nil
+}
+
+func (r *ObjectReader) chunkSize() int64 {
+	if r.ChunkSize > 0 {
+		return r.ChunkSize
+	}
+	return DefaultReadChunkSize
+}
+
+func (r *ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/alt-research/operator-kit/s3util/s3fake"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectReader(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	var ranges []string
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"e"`)
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+		assert.Equal(t, `"e"`, r.Header.Get("If-Match"))
+		ranges = append(ranges, r.Header.Get("Range"))
+		var start, end int
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+		require.NoError(t, err)
+		part := content[start : end+1]
+		w.Header().Set("Content-Length", strconv.Itoa(len(part)))
+		w.WriteHeader(http.StatusPartialContent)
+		if start == 40 && !failed {
+			// the connection is dropped in the middle of the range
+			failed = true
+			_, _ = w.Write(part[:5])
+			return
+		}
+		_, _ = w.Write(part)
+	}))
+	defer srv.Close()
+	client := awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+
+	r, err := b.Open(context.Background(), "data.tar.gz")
+	require.NoError(t, err)
+	r.ChunkSize = 40
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	assert.Equal(t, content, got)
+	assert.Equal(t, []string{"bytes=0-39", "bytes=40-79", "bytes=45-84", "bytes=85-99"}, ranges)
+}
+
+func TestUploadStreamWriteError(t *testing.T) {
+	client := awss3.New(awss3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://127.0.0.1:1"),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+
+	writeErr := errors.New("archive failed")
+	_, err = b.UploadStream(context.Background(), "data.tar.gz", func(w io.Writer) error {
+		return writeErr
+	}, nil)
+	assert.ErrorIs(t, err, writeErr)
+}
+
+func TestUploadStreamUploadError(t *testing.T) {
+	srv := s3fake.NewServer(BucketTestBucket)
+	defer srv.Close()
+	b, err := NewManagerWithClient(srv.Client(), "missing", "", 1)
+	require.NoError(t, err)
+
+	// the writer is stopped by the failed upload, the S3 error is returned
+	_, err = b.UploadStream(context.Background(), "data.tar.gz", func(w io.Writer) error {
+		buf := make([]byte, 1<<20)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+	}, nil)
+	require.Error(t, err)
+	assert.True(t, IsNotFound(err), err.Error())
+	assert.NotContains(t, err.Error(), errUploadStopped.Error())
+}
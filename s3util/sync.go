@@ -0,0 +1,347 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alt-research/operator-kit/hextool"
+	"github.com/alt-research/operator-kit/maputil"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+type SyncOptions struct {
+	// Delete removes the destination files or objects which are missing from the source
+	Delete bool
+	// Filter selects the relative paths to sync, the paths not selected are neither transferred nor deleted
+	Filter func(rel string) bool
+	// DryRun only reports what would be transferred and deleted
+	DryRun bool
+	// Upload is applied to the uploaded objects
+	Upload *UploadOptions
+}
+
+// SyncResult lists the relative paths of a Sync, sorted
+type SyncResult struct {
+	Transferred []string
+	Skipped     []string
+	Deleted     []string
+	// Bytes is the size of the transferred files
+	Bytes int64
+
+	mu sync.Mutex
+}
+
+func (r *SyncResult) add(list *[]string, rel string, size int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*list = append(*list, rel)
+	r.Bytes += size
+}
+
+func (r *SyncResult) sort() {
+	sort.Strings(r.Transferred)
+	sort.Strings(r.Skipped)
+	sort.Strings(r.Deleted)
+}
+
+// SyncUp mirrors the local directory src to the given prefix, only the new and changed files are uploaded.
+// A file is unchanged if the object has the same size and either the same MD5 ETag or the same SHA256
+// metadata, the uploaded objects store their SHA256 so that multipart uploads can be compared.
+// With client side encryption only the SHA256 metadata is compared, with the plaintext size of the objects.
+func (b *BucketManager) SyncUp(ctx context.Context, src, prefix string, opts *SyncOptions) (*SyncResult, error) {
+	opts = syncOptions(opts)
+	log := log.FromContext(ctx)
+	remote, err := b.syncObjects(ctx, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	local, err := syncFiles(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	rst := &SyncResult{}
+	// the deletions run after the group, they must not use its canceled context
+	errG, gctx := errgroup.WithContext(ctx)
+	for rel, info := range local {
+		rel, info := rel, info
+		errG.Go(func() error {
+			if err := b.sem.Acquire(gctx, 1); err != nil {
+				return errors.Wrap(err, "Failed to acquire semaphore")
+			}
+			defer b.sem.Release(1)
+			file := filepath.Join(src, filepath.FromSlash(rel))
+			var sum string
+			if obj, ok := remote[rel]; ok {
+				same, err := b.sameContent(gctx, file, info.Size(), &sum, obj)
+				if err != nil {
+					return err
+				}
+				if same {
+					rst.add(&rst.Skipped, rel, 0)
+					return nil
+				}
+			}
+			rst.add(&rst.Transferred, rel, info.Size())
+			if opts.DryRun {
+				return nil
+			}
+			if sum == "" {
+				var err error
+				if sum, err = hextool.SHA256OfFile(file); err != nil {
+					return err
+				}
+			}
+			f, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			up := UploadOptions{}
+			if opts.Upload != nil {
+				up = *opts.Upload
+			}
+			maputil.Copy(&up.Metadata, up.Metadata)
+			up.Metadata[SHA256MetadataKey] = sum
+			if _, err = b.putObject(gctx, b.syncKey(prefix, rel), f, &up); err != nil {
+				return errors.Wrapf(err, "failed to upload %s", rel)
+			}
+			log.V(1).Info("Synced file", "path", file, "bucket", b.Bucket, "key", b.syncKey(prefix, rel))
+			return nil
+		})
+	}
+	if err = errG.Wait(); err != nil {
+		return rst, err
+	}
+	if opts.Delete {
+		for rel, obj := range remote {
+			if _, ok := local[rel]; ok {
+				continue
+			}
+			rst.add(&rst.Deleted, rel, 0)
+			if opts.DryRun {
+				continue
+			}
+			if err = b.DeleteSingle(ctx, obj.Key); err != nil {
+				return rst, err
+			}
+		}
+	}
+	rst.sort()
+	return rst, nil
+}
+
+// SyncDown mirrors the given prefix to the local directory dst, only the new and changed objects are downloaded,
+// see SyncUp for how files are compared
+func (b *BucketManager) SyncDown(ctx context.Context, prefix, dst string, opts *SyncOptions) (*SyncResult, error) {
+	opts = syncOptions(opts)
+	remote, err := b.syncObjects(ctx, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dst, 0o755); err != nil {
+		return nil, err
+	}
+	local, err := syncFiles(dst, opts)
+	if err != nil {
+		return nil, err
+	}
+	// keys like a/../../b would be written outside of dst, and a/./b would shadow the file a/b
+	for rel, obj := range remote {
+		if path.Clean(rel) != rel || !filepath.IsLocal(filepath.FromSlash(rel)) {
+			return nil, errors.Errorf("object %s is outside of the destination directory", obj.Key)
+		}
+	}
+	rst := &SyncResult{}
+	errG, ctx := errgroup.WithContext(ctx)
+	for rel, obj := range remote {
+		rel, obj := rel, obj
+		errG.Go(func() error {
+			if err := b.sem.Acquire(ctx, 1); err != nil {
+				return errors.Wrap(err, "Failed to acquire semaphore")
+			}
+			defer b.sem.Release(1)
+			file := filepath.Join(dst, filepath.FromSlash(rel))
+			if info, ok := local[rel]; ok {
+				var sum string
+				same, err := b.sameContent(ctx, file, info.Size(), &sum, obj)
+				if err != nil {
+					return err
+				}
+				if same {
+					rst.add(&rst.Skipped, rel, 0)
+					return nil
+				}
+			}
+			rst.add(&rst.Transferred, rel, obj.Size)
+			if opts.DryRun {
+				return nil
+			}
+			if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+				return err
+			}
+			f, err := os.Create(file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = b.DownloadWriter(ctx, obj.Key, f); err != nil {
+				return errors.Wrapf(err, "failed to download %s", obj.Key)
+			}
+			return nil
+		})
+	}
+	if err = errG.Wait(); err != nil {
+		return rst, err
+	}
+	if opts.Delete {
+		for rel := range local {
+			if _, ok := remote[rel]; ok {
+				continue
+			}
+			rst.add(&rst.Deleted, rel, 0)
+			if opts.DryRun {
+				continue
+			}
+			file := filepath.Join(dst, filepath.FromSlash(rel))
+			if err = os.Remove(file); err != nil {
+				return rst, err
+			}
+			removeEmptyDirs(dst, filepath.Dir(file))
+		}
+	}
+	rst.sort()
+	return rst, nil
+}
+
+func syncOptions(opts *SyncOptions) *SyncOptions {
+	if opts == nil {
+		return &SyncOptions{}
+	}
+	return opts
+}
+
+// syncKey returns the object key of a relative path under prefix
+func (b *BucketManager) syncKey(prefix, rel string) string {
+	return path.Join(b.Prefix, prefix, rel)
+}
+
+// syncObjects lists the objects under prefix by relative path
+func (b *BucketManager) syncObjects(ctx context.Context, prefix string, opts *SyncOptions) (map[string]ObjectInfo, error) {
+	dir := path.Join(b.Prefix, prefix)
+	if dir != "" && dir != "." {
+		dir += "/"
+	} else {
+		dir = ""
+	}
+	objs := map[string]ObjectInfo{}
+	err := b.Walk(ctx, dir, nil, func(obj ObjectInfo) error {
+		rel := strings.TrimPrefix(obj.Key, dir)
+		// skip the "directory" placeholders
+		if rel == "" || strings.HasSuffix(rel, "/") {
+			return nil
+		}
+		if opts.Filter == nil || opts.Filter(rel) {
+			objs[rel] = obj
+		}
+		return nil
+	})
+	return objs, err
+}
+
+// syncFiles lists the regular files under dir by relative slash separated path
+func syncFiles(dir string, opts *SyncOptions) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if opts.Filter != nil && !opts.Filter(rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[rel] = info
+		return nil
+	})
+	return files, err
+}
+
+// sameContent compares a local file with its object. The SHA256 of the file is only computed when
+// the sizes match and the ETag is not an MD5, it is stored in sum so that it is not computed again.
+// Client side encrypted objects are compared by their plaintext size and SHA256 metadata.
+func (b *BucketManager) sameContent(ctx context.Context, file string, size int64, sum *string, obj ObjectInfo) (bool, error) {
+	clientSide := b.Encryption != nil && b.Encryption.ClientKey != nil
+	objSize := obj.Size
+	if clientSide {
+		objSize = plaintextSize(obj.Size)
+	}
+	if size != objSize {
+		return false, nil
+	}
+	// the ETag of single part uploads is the MD5 of the content, multipart ones have a -<parts> suffix,
+	// it is the MD5 of the ciphertext for client side encrypted objects
+	etag := strings.Trim(obj.ETag, `"`)
+	if !clientSide && etag != "" && !strings.Contains(etag, "-") {
+		f, err := os.Open(file)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		h := md5.New()
+		if _, err = io.Copy(h, f); err != nil {
+			return false, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == etag {
+			return true, nil
+		}
+	}
+	head, err := b.HeadObject(ctx, obj.Key)
+	if err != nil {
+		return false, err
+	}
+	remote := head.Metadata[SHA256MetadataKey]
+	if remote == "" {
+		return false, nil
+	}
+	if *sum, err = hextool.SHA256OfFile(file); err != nil {
+		return false, err
+	}
+	return remote == *sum, nil
+}
+
+// removeEmptyDirs removes dir and its parents up to root, stopping at the first one which is not empty
+func removeEmptyDirs(root, dir string) {
+	root = filepath.Clean(root)
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "sub/c"} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644))
+	}
+	// nothing listens on the endpoint, every upload fails
+	client := awss3.New(awss3.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://127.0.0.1:1"),
+		UsePathStyle:     true,
+		RetryMaxAttempts: 1,
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 2)
+	require.NoError(t, err)
+
+	_, err = b.Upload(context.Background(), dir, "prefix/", nil, nil)
+	var uploadErr *UploadError
+	require.True(t, errors.As(err, &uploadErr))
+	require.Len(t, uploadErr.Errors, 3)
+	assert.Equal(t, filepath.Join(dir, "a"), uploadErr.Errors[0].Path)
+	assert.Equal(t, "prefix/sub/c", uploadErr.Errors[2].Key)
+
+	_, err = b.Upload(context.Background(), dir, "prefix/", nil, &UploadOptions{FailFast: true})
+	require.True(t, errors.As(err, &uploadErr))
+	assert.Less(t, len(uploadErr.Errors), 3)
+}
@@ -0,0 +1,160 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AddressingStyle is how the bucket is addressed in object URLs
+type AddressingStyle string
+
+const (
+	// AddressingAuto uses the virtual host style on AWS and the path style on custom endpoints,
+	// which is how NewManager addresses them
+	AddressingAuto AddressingStyle = ""
+	// AddressingPath builds <endpoint>/<bucket>/<key> URLs
+	AddressingPath AddressingStyle = "path"
+	// AddressingVirtual builds <bucket>.<endpoint host>/<key> URLs
+	AddressingVirtual AddressingStyle = "virtual"
+)
+
+// ObjectLocation is an object addressed by an URL, Endpoint is empty for AWS
+type ObjectLocation struct {
+	Endpoint string
+	Region   string
+	Bucket   string
+	Key      string
+	Style    AddressingStyle
+}
+
+// ObjectURL returns the URL of an object on the given endpoint, or on AWS if endpoint is empty.
+// Endpoints without scheme use https.
+func ObjectURL(endpoint, region, bucket, key string, style AddressingStyle) string {
+	path := EscapeKey(key)
+	if endpoint == "" || isAWSHost(endpointHost(endpoint)) {
+		host := "s3.amazonaws.com"
+		if region != "" && region != "us-east-1" {
+			host = "s3." + region + ".amazonaws.com"
+		}
+		// bucket names with dots do not match the wildcard certificate of virtual hosts
+		if style == AddressingPath || strings.Contains(bucket, ".") {
+			return fmt.Sprintf("https://%s/%s/%s", host, bucket, path)
+		}
+		return fmt.Sprintf("https://%s.%s/%s", bucket, host, path)
+	}
+	u := endpointURL(endpoint)
+	if style == AddressingVirtual {
+		u.Host = bucket + "." + u.Host
+		return strings.TrimSuffix(u.String(), "/") + "/" + path
+	}
+	return strings.TrimSuffix(u.String(), "/") + "/" + bucket + "/" + path
+}
+
+// ObjectURL returns the URL of an object of the bucket
+func (b *BucketManager) ObjectURL(key string) string {
+	return ObjectURL(b.Opts.Endpoint, b.Region, b.Bucket, key, AddressingAuto)
+}
+
+// ParseObjectURL parses s3://<bucket>/<key> URIs, AWS virtual host and path style URLs and path style URLs
+// of custom endpoints. Virtual host URLs of a custom endpoint are only recognized when it is given.
+func ParseObjectURL(rawURL string, endpoint string) (*ObjectLocation, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	loc := &ObjectLocation{}
+	if u.Scheme == "s3" {
+		loc.Bucket = u.Host
+		loc.Key = strings.TrimPrefix(u.Path, "/")
+		return checkLocation(loc, rawURL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("unsupported object URL %s", rawURL)
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	if isAWSHost(u.Hostname()) {
+		host := u.Hostname()
+		i := strings.LastIndex(host, ".s3.")
+		if i < 0 {
+			i = strings.LastIndex(host, ".s3-")
+		}
+		if i > 0 {
+			// <bucket>.s3.<region>.amazonaws.com, <bucket>.s3-<region>.amazonaws.com or <bucket>.s3.amazonaws.com
+			loc.Bucket, loc.Key, loc.Style = host[:i], path, AddressingVirtual
+			host = host[i+1:]
+		} else {
+			loc.Bucket, loc.Key, _ = strings.Cut(path, "/")
+			loc.Style = AddressingPath
+		}
+		loc.Region = awsRegion(host)
+		return checkLocation(loc, rawURL)
+	}
+	if endpoint != "" {
+		e := endpointURL(endpoint)
+		if bucket, ok := strings.CutSuffix(u.Host, "."+e.Host); ok {
+			loc.Endpoint, loc.Bucket, loc.Key, loc.Style = endpoint, bucket, path, AddressingVirtual
+			return checkLocation(loc, rawURL)
+		}
+	}
+	loc.Endpoint = u.Scheme + "://" + u.Host
+	if endpoint != "" && endpointURL(endpoint).Host == u.Host {
+		loc.Endpoint = endpoint
+	}
+	loc.Bucket, loc.Key, _ = strings.Cut(path, "/")
+	loc.Style = AddressingPath
+	return checkLocation(loc, rawURL)
+}
+
+func checkLocation(loc *ObjectLocation, rawURL string) (*ObjectLocation, error) {
+	if loc.Bucket == "" || loc.Key == "" {
+		return nil, errors.Errorf("object URL %s has no bucket or key", rawURL)
+	}
+	return loc, nil
+}
+
+// EscapeKey escapes the segments of an object key for use in an URL path
+func EscapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func endpointURL(endpoint string) *url.URL {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return &url.URL{Scheme: "https", Host: endpoint}
+	}
+	return u
+}
+
+func endpointHost(endpoint string) string {
+	return endpointURL(endpoint).Hostname()
+}
+
+func isAWSHost(host string) bool {
+	return host == "amazonaws.com" || strings.HasSuffix(host, ".amazonaws.com")
+}
+
+// awsRegion returns the region of a s3.<region>.amazonaws.com or s3-<region>.amazonaws.com host
+func awsRegion(host string) string {
+	host = strings.TrimSuffix(host, ".amazonaws.com")
+	for _, prefix := range []string{"s3.", "s3-"} {
+		if region, ok := strings.CutPrefix(host, prefix); ok {
+			return region
+		}
+	}
+	return "us-east-1"
+}
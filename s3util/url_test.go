@@ -0,0 +1,42 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectURL(t *testing.T) {
+	for _, c := range []struct {
+		style AddressingStyle
+		loc   ObjectLocation
+		url   string
+	}{
+		{AddressingAuto, ObjectLocation{Region: "us-east-1", Bucket: "b", Key: "dir/a b.json", Style: AddressingVirtual}, "https://b.s3.amazonaws.com/dir/a%20b.json"},
+		{AddressingAuto, ObjectLocation{Region: "eu-west-1", Bucket: "b", Key: "k", Style: AddressingVirtual}, "https://b.s3.eu-west-1.amazonaws.com/k"},
+		{AddressingPath, ObjectLocation{Region: "eu-west-1", Bucket: "b", Key: "k", Style: AddressingPath}, "https://s3.eu-west-1.amazonaws.com/b/k"},
+		{AddressingAuto, ObjectLocation{Region: "eu-west-1", Bucket: "b.with.dots", Key: "k", Style: AddressingPath}, "https://s3.eu-west-1.amazonaws.com/b.with.dots/k"},
+		{AddressingAuto, ObjectLocation{Endpoint: "http://minio:9000", Bucket: "b", Key: "dir/k", Style: AddressingPath}, "http://minio:9000/b/dir/k"},
+		{AddressingVirtual, ObjectLocation{Endpoint: "https://r2.example.com", Bucket: "b", Key: "k", Style: AddressingVirtual}, "https://b.r2.example.com/k"},
+	} {
+		assert.Equal(t, c.url, ObjectURL(c.loc.Endpoint, c.loc.Region, c.loc.Bucket, c.loc.Key, c.style))
+		loc, err := ParseObjectURL(c.url, c.loc.Endpoint)
+		require.NoError(t, err, c.url)
+		assert.Equal(t, c.loc, *loc, c.url)
+	}
+
+	loc, err := ParseObjectURL("s3://b/dir/k", "")
+	require.NoError(t, err)
+	assert.Equal(t, ObjectLocation{Bucket: "b", Key: "dir/k"}, *loc)
+	loc, err = ParseObjectURL("https://b.s3-us-west-2.amazonaws.com/k", "")
+	require.NoError(t, err)
+	assert.Equal(t, "us-west-2", loc.Region)
+	_, err = ParseObjectURL("https://s3.amazonaws.com/b", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/alt-research/operator-kit/ptr"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ObjectVersion is a version of an object in a versioned bucket, or a delete marker
+type ObjectVersion struct {
+	Key          string
+	VersionID    string
+	IsLatest     bool
+	LastModified time.Time
+	// IsDeleteMarker is true for the markers left by deleting an object without version,
+	// they have no content
+	IsDeleteMarker bool
+	Size           int64
+	ETag           string
+	StorageClass   types.ObjectVersionStorageClass
+}
+
+// ListVersions returns the versions and delete markers of the objects under the given prefix, sorted by key
+// and from the newest to the oldest version of each key. StartAfter of opts is a key, the delimiter is ignored.
+func (b *BucketManager) ListVersions(ctx context.Context, prefix string, opts *ListOptions) ([]ObjectVersion, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	input := &awss3.ListObjectVersionsInput{
+		Bucket:  &b.Bucket,
+		Prefix:  &prefix,
+		MaxKeys: ptr.Of(int32(maxListKeys)),
+	}
+	if opts.StartAfter != "" {
+		input.KeyMarker = &opts.StartAfter
+	}
+	var versions []ObjectVersion
+	for {
+		out, err := b.client.ListObjectVersions(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		page := make([]ObjectVersion, 0, len(out.Versions)+len(out.DeleteMarkers))
+		for _, v := range out.Versions {
+			version := ObjectVersion{
+				Key:          aws.ToString(v.Key),
+				VersionID:    aws.ToString(v.VersionId),
+				StorageClass: v.StorageClass,
+			}
+			if v.IsLatest != nil {
+				version.IsLatest = *v.IsLatest
+			}
+			if v.LastModified != nil {
+				version.LastModified = *v.LastModified
+			}
+			if v.Size != nil {
+				version.Size = *v.Size
+			}
+			if v.ETag != nil {
+				version.ETag = *v.ETag
+			}
+			page = append(page, version)
+		}
+		for _, m := range out.DeleteMarkers {
+			version := ObjectVersion{Key: aws.ToString(m.Key), VersionID: aws.ToString(m.VersionId), IsDeleteMarker: true}
+			if m.IsLatest != nil {
+				version.IsLatest = *m.IsLatest
+			}
+			if m.LastModified != nil {
+				version.LastModified = *m.LastModified
+			}
+			page = append(page, version)
+		}
+		// versions and delete markers are sorted separately
+		sortVersions(page)
+		versions = append(versions, page...)
+		if opts.MaxResults > 0 && len(versions) >= opts.MaxResults {
+			return versions[:opts.MaxResults], nil
+		}
+		if out.IsTruncated == nil || !*out.IsTruncated {
+			return versions, nil
+		}
+		input.KeyMarker, input.VersionIdMarker = out.NextKeyMarker, out.NextVersionIdMarker
+	}
+}
+
+func sortVersions(versions []ObjectVersion) {
+	sort.SliceStable(versions, func(a, b int) bool {
+		if versions[a].Key != versions[b].Key {
+			return versions[a].Key < versions[b].Key
+		}
+		return versions[a].LastModified.After(versions[b].LastModified)
+	})
+}
+
+// HeadObjectVersion returns the metadata of a version of an object, the latest one if versionID is empty
+func (b *BucketManager) HeadObjectVersion(ctx context.Context, key, versionID string) (HeadObjectOutput, error) {
+	input := &awss3.HeadObjectInput{
+		Bucket:    &b.Bucket,
+		Key:       &key,
+		VersionId: optional(versionID),
+	}
+	b.Encryption.applyHead(input)
+	h, err := b.client.HeadObject(ctx, input)
+	if err != nil {
+		return HeadObjectOutput{}, err
+	}
+	return HeadObjectOutput{
+		Endpoint:         b.Opts.Endpoint,
+		Bucket:           b.Bucket,
+		Region:           b.Region,
+		Key:              key,
+		HeadObjectOutput: *h,
+	}, nil
+}
+
+// DownloadVersion downloads a version of an object to dst, the latest one if versionID is empty.
+// If dst is a directory the file is created in it with the base name of the key.
+func (b *BucketManager) DownloadVersion(ctx context.Context, key, versionID, dst string, overwrite bool) (string, error) {
+	// if dest is dir, create file in this dir with the filename as the filename of key
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(key))
+	}
+	if !overwrite {
+		if _, err := os.Stat(dst); err == nil {
+			return "", errors.Errorf("dest %s already exists", dst)
+		}
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = b.downloadWriter(ctx, key, versionID, file)
+	return dst, err
+}
+
+// DeleteVersion permanently deletes a version of an object or a delete marker. Deleting the latest
+// version makes the previous one the latest, deleting the latest delete marker undeletes the object.
+func (b *BucketManager) DeleteVersion(ctx context.Context, key, versionID string) error {
+	if versionID == "" {
+		return errors.New("version ID is required")
+	}
+	_, err := b.client.DeleteObject(ctx, &awss3.DeleteObjectInput{
+		Bucket:    &b.Bucket,
+		Key:       &key,
+		VersionId: &versionID,
+	})
+	return err
+}
+
+// RestoreVersion makes a previous version of an object the latest one by copying it over the object,
+// the newer versions are kept. The content, metadata and client side encryption of the version are
+// preserved, objects larger than 5GiB cannot be restored by a single copy.
+func (b *BucketManager) RestoreVersion(ctx context.Context, key, versionID string) (*awss3.CopyObjectOutput, error) {
+	if versionID == "" {
+		return nil, errors.New("version ID is required")
+	}
+	input := &awss3.CopyObjectInput{
+		Bucket:     &b.Bucket,
+		Key:        &key,
+		CopySource: copySource(b.Bucket, key, versionID),
+	}
+	if e := b.Encryption; e != nil {
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+		input.ServerSideEncryption = e.SSE
+		input.SSEKMSKeyId = optional(e.KMSKeyID)
+		input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = e.customerKey()
+		input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5 = e.customerKey()
+	}
+	out, err := b.client.CopyObject(ctx, input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to restore version %s of %s", versionID, key)
+	}
+	log.FromContext(ctx).Info("Restored object version", "bucket", b.Bucket, "key", key, "version", versionID, "newVersion", aws.ToString(out.VersionId))
+	return out, nil
+}
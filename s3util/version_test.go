@@ -0,0 +1,83 @@
+// Copyright (C) Alt Research Ltd. All Rights Reserved.
+//
+// This source code is licensed under the limited license found in the LICENSE file
+// in the root directory of this source tree.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const versionsPage1 = `<ListVersionsResult>
+<Name>test</Name><IsTruncated>true</IsTruncated><NextKeyMarker>a</NextKeyMarker><NextVersionIdMarker>v1</NextVersionIdMarker>
+<Version><Key>a</Key><VersionId>v1</VersionId><IsLatest>false</IsLatest><LastModified>2024-01-01T00:00:00.000Z</LastModified><Size>1</Size></Version>
+<DeleteMarker><Key>a</Key><VersionId>d1</VersionId><IsLatest>true</IsLatest><LastModified>2024-01-02T00:00:00.000Z</LastModified></DeleteMarker>
+</ListVersionsResult>`
+
+const versionsPage2 = `<ListVersionsResult>
+<Name>test</Name><IsTruncated>false</IsTruncated>
+<Version><Key>b</Key><VersionId>v2</VersionId><IsLatest>true</IsLatest><LastModified>2024-01-03T00:00:00.000Z</LastModified><Size>2</Size></Version>
+</ListVersionsResult>`
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	var requests []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		q := r.URL.Query()
+		switch {
+		case q.Has("versions") && q.Get("key-marker") == "":
+			fmt.Fprint(w, versionsPage1)
+		case q.Has("versions"):
+			fmt.Fprint(w, versionsPage2)
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			w.Header().Set("X-Amz-Version-Id", "v3")
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"e"</ETag></CopyObjectResult>`)
+		default:
+			w.Header().Set("X-Amz-Version-Id", q.Get("versionId"))
+		}
+	}))
+	defer srv.Close()
+	client := awss3.New(awss3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	b, err := NewManagerWithClient(client, BucketTestBucket, "", 1)
+	require.NoError(t, err)
+
+	versions, err := b.ListVersions(ctx, "", nil)
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, "d1", versions[0].VersionID)
+	assert.True(t, versions[0].IsDeleteMarker)
+	assert.Equal(t, "v1", versions[1].VersionID)
+	assert.Equal(t, "b", versions[2].Key)
+	assert.Equal(t, "v1", requests[1].URL.Query().Get("version-id-marker"))
+
+	versions, err = b.ListVersions(ctx, "", &ListOptions{MaxResults: 1})
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+
+	head, err := b.HeadObjectVersion(ctx, "a", "v1")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", aws.ToString(head.VersionId))
+
+	out, err := b.RestoreVersion(ctx, "dir/a b", "v1")
+	require.NoError(t, err)
+	assert.Equal(t, "v3", aws.ToString(out.VersionId))
+	assert.Equal(t, "test/dir/a%20b?versionId=v1", requests[len(requests)-1].Header.Get("X-Amz-Copy-Source"))
+
+	assert.Error(t, b.DeleteVersion(ctx, "a", ""))
+}
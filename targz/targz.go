@@ -19,10 +19,12 @@ import (
 	"bufio"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -76,6 +78,37 @@ func Extract(inputFilePath, outputFilePath string) (err error) {
 	return extract(inputFilePath, outputFilePath)
 }
 
+// CompressTo writes the archive of the folder inputFilePath points to to writer, like Compress.
+// Nothing is buffered on disk, so the archive can be streamed to a network upload.
+func CompressTo(inputFilePath string, writer io.Writer) error {
+	inputFilePath, err := filepath.Abs(stripTrailingSlashes(inputFilePath))
+	if err != nil {
+		return err
+	}
+
+	return writeArchive(inputFilePath, writer, filepath.Dir(inputFilePath))
+}
+
+// ExtractFrom extracts the archive read from reader in the directory outputFilePath points to, like Extract.
+// The archive is read to its end, so that a truncated or corrupted stream is reported by the gzip checksum.
+func ExtractFrom(reader io.Reader, outputFilePath string) (err error) {
+	outputFilePath, err = filepath.Abs(stripTrailingSlashes(outputFilePath))
+	if err != nil {
+		return err
+	}
+	undoDir, err := mkdirAll(outputFilePath, 0o755)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			undoDir()
+		}
+	}()
+
+	return readArchive(reader, outputFilePath)
+}
+
 // Creates all directories with os.MakedirAll and returns a function to remove the first created directory so cleanup is possible.
 func mkdirAll(dirPath string, perm os.FileMode) (func(), error) {
 	var undoDir string
@@ -160,30 +193,40 @@ func compress(inPath, outFilePath, subPath string) (err error) {
 		}
 	}()
 
-	gzipWriter := gzip.NewWriter(file)
-	tarWriter := tar.NewWriter(gzipWriter)
-
-	err = writeDirectory(inPath, tarWriter, subPath)
+	err = writeArchive(inPath, file, subPath)
 	if err != nil {
+		file.Close()
 		return err
 	}
 
-	err = tarWriter.Close()
+	return file.Close()
+}
+
+// Write the tar gz archive of the directory inPath to writer.
+func writeArchive(inPath string, writer io.Writer, subPath string) error {
+	files, err := os.ReadDir(inPath)
 	if err != nil {
 		return err
 	}
 
-	err = gzipWriter.Close()
+	if len(files) == 0 {
+		return errors.New("targz: input directory is empty")
+	}
+
+	gzipWriter := gzip.NewWriter(writer)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = writeDirectory(inPath, tarWriter, subPath)
 	if err != nil {
 		return err
 	}
 
-	err = file.Close()
+	err = tarWriter.Close()
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return gzipWriter.Close()
 }
 
 // Read a directy and write it to the tar writer. Recursive function that writes all sub folders.
@@ -265,7 +308,12 @@ func extract(filePath string, directory string) error {
 	}
 	defer file.Close()
 
-	gzipReader, err := gzip.NewReader(bufio.NewReader(file))
+	return readArchive(bufio.NewReader(file), directory)
+}
+
+// Extract the tar gz archive read from reader to directory.
+func readArchive(reader io.Reader, directory string) error {
+	gzipReader, err := gzip.NewReader(reader)
 	if err != nil {
 		return err
 	}
@@ -287,6 +335,9 @@ func extract(filePath string, directory string) error {
 		if dir == directory {
 			continue
 		}
+		if !strings.HasPrefix(dir, directory+string(filepath.Separator)) {
+			return fmt.Errorf("targz: %s is outside of the output directory", header.Name)
+		}
 		err = os.MkdirAll(dir, 0o755)
 		if err != nil {
 			return err
@@ -312,24 +363,15 @@ func extract(filePath string, directory string) error {
 
 		writer := bufio.NewWriter(file)
 
-		buffer := make([]byte, 4096)
-		for {
-			n, err := tarReader.Read(buffer)
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			if n == 0 {
-				break
-			}
-
-			_, err = writer.Write(buffer[:n])
-			if err != nil {
-				return err
-			}
+		_, err = io.Copy(writer, tarReader)
+		if err != nil {
+			file.Close()
+			return err
 		}
 
 		err = writer.Flush()
 		if err != nil {
+			file.Close()
 			return err
 		}
 
@@ -343,5 +385,7 @@ func extract(filePath string, directory string) error {
 		}
 	}
 
-	return nil
+	// Read up to the gzip trailer so that its checksum and size are verified.
+	_, err = io.Copy(io.Discard, gzipReader)
+	return err
 }
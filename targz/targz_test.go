@@ -6,6 +6,7 @@
 package targz
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
@@ -180,6 +181,37 @@ func Test_ThatOutputDirIsRemovedIfExtractFails(t *testing.T) {
 	}
 }
 
+func Test_CompressToAndExtractFrom(t *testing.T) {
+	tmpDir, dirToCompress := createTestData()
+	defer os.RemoveAll(tmpDir)
+	createFiles(dirToCompress, "a.txt", "b.txt")
+
+	structureBefore := directoryStructureString(dirToCompress)
+
+	var archive bytes.Buffer
+	err := CompressTo(dirToCompress, &archive)
+	if err != nil {
+		t.Errorf("CompressTo error: %s", err)
+	}
+	data := archive.Bytes()
+
+	err = ExtractFrom(bytes.NewReader(data), filepath.Join(tmpDir, "extracted"))
+	if err != nil {
+		t.Errorf("ExtractFrom error: %s", err)
+	}
+
+	structureAfter := directoryStructureString(filepath.Join(tmpDir, "extracted", "my_folder"))
+
+	if structureAfter != structureBefore {
+		t.Errorf("Directory structure before compress and after extract does not match. Before {%s}, After {%s}", structureBefore, structureAfter)
+	}
+
+	err = ExtractFrom(bytes.NewReader(data[:len(data)-4]), filepath.Join(tmpDir, "truncated"))
+	if err == nil {
+		t.Errorf("Should return error for a truncated archive")
+	}
+}
+
 func Test_CompabilityWithTar(t *testing.T) {
 	_, err := exec.LookPath("tar")
 	if err == nil {
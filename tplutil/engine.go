@@ -8,6 +8,7 @@ package tplutil
 import (
 	"bytes"
 	"html/template"
+	texttemplate "text/template"
 
 	"github.com/Masterminds/sprig/v3"
 )
@@ -23,3 +24,15 @@ func Render(t *template.Template, data interface{}) (string, error) {
 	err := t.Execute(&buf, data)
 	return buf.String(), err
 }
+
+// NewText creates a text template with the same functions as New, its output is not escaped,
+// use it to render scripts and config files
+func NewText(name string) *texttemplate.Template {
+	return texttemplate.New(name).Funcs(sprig.TxtFuncMap()).Funcs(texttemplate.FuncMap(FuncMap))
+}
+
+func RenderText(t *texttemplate.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	return buf.String(), err
+}